@@ -0,0 +1,196 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+)
+
+// archiveReader iterates over the files in an archive, for -archives.
+type archiveReader interface {
+	// Next returns the name and contents of the next file in the archive,
+	// skipping directories, or io.EOF at the end. The contents are only
+	// valid until the next call.
+	Next() (string, io.Reader, error)
+	Close() error
+}
+
+// archiveFormat is a type of archive which can be read by -archives.
+type archiveFormat struct {
+	name string
+	exts []string // file name extensions, in lower case
+
+	// open returns a reader for an archive. f is a file in the tree, which
+	// is an io.ReaderAt for formats which need random access.
+	open func(f fs.File, size int64) (archiveReader, error)
+}
+
+var archiveFormats []archiveFormat
+
+func registerArchiveFormat(af archiveFormat) {
+	archiveFormats = append(archiveFormats, af)
+}
+
+// archiveFormatFor returns the archive format of a file, based on its name,
+// or nil if it isn't an archive.
+func archiveFormatFor(name string) *archiveFormat {
+	name = strings.ToLower(name)
+	for i, af := range archiveFormats {
+		for _, ext := range af.exts {
+			if strings.HasSuffix(name, ext) {
+				return &archiveFormats[i]
+			}
+		}
+	}
+	return nil
+}
+
+// hashArchive hashes each file in an archive, sending a result for each
+// named "archive!member". If the archive can't be read, a result with the
+// error is sent for the archive itself.
+func hashArchive(hf hashFactory, task hashTask, buf []byte, results chan<- hashResult) {
+	fail := func(err error) {
+		results <- hashResult{path: task.path, err: err}
+	}
+
+	af := archiveFormatFor(task.path)
+	f, err := task.fs.Open(task.path)
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		fail(err)
+		return
+	}
+	ar, err := af.open(f, fi.Size())
+	if err != nil {
+		fail(fmt.Errorf("%s: reading %s archive: %w", task.path, af.name, err))
+		return
+	}
+	defer ar.Close()
+
+	for {
+		name, rd, err := ar.Next()
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			fail(fmt.Errorf("%s: reading %s archive: %w", task.path, af.name, err))
+			return
+		}
+		r := hashReader(hf, rd, buf)
+		r.path = task.path + "!" + strings.TrimPrefix(name, "./")
+		r.root, r.algo = task.root, algoFor(task.path)
+		results <- r
+	}
+}
+
+// readerAt returns f as an io.ReaderAt, for formats which need random access.
+func readerAt(f fs.File) (io.ReaderAt, error) {
+	ra, ok := f.(io.ReaderAt)
+	if !ok {
+		return nil, errors.New("file does not support random access")
+	}
+	return ra, nil
+}
+
+func init() {
+	registerArchiveFormat(archiveFormat{
+		name: "zip",
+		exts: []string{".zip"},
+		open: func(f fs.File, size int64) (archiveReader, error) {
+			ra, err := readerAt(f)
+			if err != nil {
+				return nil, err
+			}
+			zr, err := zip.NewReader(ra, size)
+			if err != nil {
+				return nil, err
+			}
+			return &zipArchiveReader{files: zr.File}, nil
+		},
+	})
+	registerArchiveFormat(archiveFormat{
+		name: "tar",
+		exts: []string{".tar"},
+		open: func(f fs.File, size int64) (archiveReader, error) {
+			return &tarArchiveReader{tr: tar.NewReader(f)}, nil
+		},
+	})
+	registerArchiveFormat(archiveFormat{
+		name: "tar.gz",
+		exts: []string{".tar.gz", ".tgz"},
+		open: func(f fs.File, size int64) (archiveReader, error) {
+			zr, err := gzip.NewReader(f)
+			if err != nil {
+				return nil, err
+			}
+			return &tarArchiveReader{tr: tar.NewReader(zr), c: zr}, nil
+		},
+	})
+}
+
+// zipArchiveReader reads zip archives, including ZIP64.
+type zipArchiveReader struct {
+	files []*zip.File
+	cur   io.ReadCloser
+}
+
+func (ar *zipArchiveReader) Next() (string, io.Reader, error) {
+	ar.Close()
+	for len(ar.files) > 0 {
+		zf := ar.files[0]
+		ar.files = ar.files[1:]
+		if zf.FileInfo().IsDir() {
+			continue
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			return "", nil, err
+		}
+		ar.cur = rc
+		return zf.Name, rc, nil
+	}
+	return "", nil, io.EOF
+}
+
+func (ar *zipArchiveReader) Close() error {
+	if ar.cur == nil {
+		return nil
+	}
+	err := ar.cur.Close()
+	ar.cur = nil
+	return err
+}
+
+// tarArchiveReader reads tar archives, optionally compressed.
+type tarArchiveReader struct {
+	tr *tar.Reader
+	c  io.Closer // decompressor, if any
+}
+
+func (ar *tarArchiveReader) Next() (string, io.Reader, error) {
+	for {
+		hdr, err := ar.tr.Next()
+		if err != nil {
+			return "", nil, err
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			return hdr.Name, ar.tr, nil
+		}
+	}
+}
+
+func (ar *tarArchiveReader) Close() error {
+	if ar.c != nil {
+		return ar.c.Close()
+	}
+	return nil
+}
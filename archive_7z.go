@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io"
+	"io/fs"
+
+	"github.com/bodgit/sevenzip"
+)
+
+func init() {
+	registerArchiveFormat(archiveFormat{
+		name: "7z",
+		exts: []string{".7z"},
+		open: func(f fs.File, size int64) (archiveReader, error) {
+			ra, err := readerAt(f)
+			if err != nil {
+				return nil, err
+			}
+			zr, err := sevenzip.NewReader(ra, size)
+			if err != nil {
+				return nil, err
+			}
+			return &sevenZipArchiveReader{files: zr.File}, nil
+		},
+	})
+}
+
+// sevenZipArchiveReader reads 7z archives. Encrypted archives aren't
+// supported.
+type sevenZipArchiveReader struct {
+	files []*sevenzip.File
+	cur   io.ReadCloser
+}
+
+func (ar *sevenZipArchiveReader) Next() (string, io.Reader, error) {
+	ar.Close()
+	for len(ar.files) > 0 {
+		zf := ar.files[0]
+		ar.files = ar.files[1:]
+		if zf.FileInfo().IsDir() {
+			continue
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			return "", nil, err
+		}
+		ar.cur = rc
+		return zf.Name, rc, nil
+	}
+	return "", nil, io.EOF
+}
+
+func (ar *sevenZipArchiveReader) Close() error {
+	if ar.cur == nil {
+		return nil
+	}
+	err := ar.cur.Close()
+	ar.cur = nil
+	return err
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io"
+	"io/fs"
+
+	"github.com/nwaples/rardecode"
+)
+
+func init() {
+	registerArchiveFormat(archiveFormat{
+		name: "rar",
+		exts: []string{".rar"},
+		open: func(f fs.File, size int64) (archiveReader, error) {
+			rr, err := rardecode.NewReader(f, "")
+			if err != nil {
+				return nil, err
+			}
+			return &rarArchiveReader{rr}, nil
+		},
+	})
+}
+
+// rarArchiveReader reads single-volume RAR archives. Encrypted archives
+// aren't supported.
+type rarArchiveReader struct {
+	rr *rardecode.Reader
+}
+
+func (ar *rarArchiveReader) Next() (string, io.Reader, error) {
+	for {
+		hdr, err := ar.rr.Next()
+		if err != nil {
+			return "", nil, err
+		}
+		if !hdr.IsDir {
+			return hdr.Name, ar.rr, nil
+		}
+	}
+}
+
+func (ar *rarArchiveReader) Close() error {
+	return nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// benchTime is how long each measurement by the bench subcommand runs.
+const benchTime = 500 * time.Millisecond
+
+// benchHashes are the hash functions measured by bench, and benchSecure are
+// the ones it may recommend, which are still collision-resistant.
+var (
+	benchHashes = []string{"adler32", "crc32", "md5", "sha1", "sha224", "sha256", "sha512", "blake2b-256", "blake2b-512", "blake2s", "ripemd160", "whirlpool"}
+	benchSecure = map[string]bool{"sha256": true, "sha512": true, "blake2b-256": true, "blake2b-512": true, "blake2s": true}
+)
+
+// benchGenericEnv is set when bench runs itself with the generic
+// implementations, to measure them.
+const benchGenericEnv = "HASHTREE_BENCH_GENERIC"
+
+// benchRate returns the throughput of a hash function in bytes per second,
+// hashing in memory with the given number of jobs.
+func benchRate(hf hashFactory, jobs int) float64 {
+	var total int64
+	var wg sync.WaitGroup
+	start := time.Now()
+	deadline := start.Add(benchTime)
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 1024*1024)
+			h := hf()
+			var n int64
+			for time.Now().Before(deadline) {
+				h.Write(buf)
+				n += int64(len(buf))
+			}
+			atomic.AddInt64(&total, n)
+		}()
+	}
+	wg.Wait()
+	return float64(total) / time.Since(start).Seconds()
+}
+
+// benchRates measures each hash function with one job.
+func benchRates() map[string]float64 {
+	rates := make(map[string]float64)
+	for _, name := range benchHashes {
+		rates[name] = benchRate(hashByName(name, nil), 1)
+	}
+	return rates
+}
+
+// benchGenericRates runs hashtree bench again with the CPU's hashing
+// instructions turned off, and returns its measurements.
+func benchGenericRates() (map[string]float64, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	c := exec.Command(exe, "bench")
+	c.Env = append(genericEnv(), benchGenericEnv+"=1")
+	c.Stderr = os.Stderr
+	out, err := c.Output()
+	if err != nil {
+		return nil, err
+	}
+	var rates map[string]float64
+	if err := json.NewDecoder(bytes.NewReader(out)).Decode(&rates); err != nil {
+		return nil, err
+	}
+	return rates, nil
+}
+
+// runBench implements the bench subcommand, which measures how fast each
+// hash function is on this machine, with and without the CPU's hashing
+// instructions (such as SHA-NI and the ARMv8 cryptography extensions), and
+// recommends -hash and -jobs settings. Only hashing is measured, in memory,
+// so real runs are slower wherever reading the files is the bottleneck.
+func runBench() {
+	if os.Getenv(benchGenericEnv) != "" {
+		if err := json.NewEncoder(os.Stdout).Encode(benchRates()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	rates := benchRates()
+	generic, err := benchGenericRates()
+	if err != nil {
+		warnf("couldn't measure the generic implementations: %v", err)
+	}
+	fmt.Printf("%-12s %14s %14s %8s\n", "hash", "auto", "generic", "speedup")
+	best := ""
+	for _, name := range benchHashes {
+		g, speedup := "-", "-"
+		if r, ok := generic[name]; ok && r > 0 {
+			g, speedup = formatBytes(int64(r))+"/s", fmt.Sprintf("%.1fx", rates[name]/r)
+		}
+		fmt.Printf("%-12s %14s %14s %8s\n", name, formatBytes(int64(rates[name]))+"/s", g, speedup)
+		if benchSecure[name] && (best == "" || rates[name] > rates[best]) {
+			best = name
+		}
+	}
+
+	// The fewest jobs within 10% of the best throughput, since more only
+	// compete with each other for the disk
+	hf := hashByName(best, nil)
+	jobs, bestRate := 1, 0.0
+	var measured []string
+	for n := 1; ; n *= 2 {
+		if n > runtime.NumCPU() {
+			n = runtime.NumCPU()
+		}
+		r := benchRate(hf, n)
+		measured = append(measured, fmt.Sprintf("%d: %s/s", n, formatBytes(int64(r))))
+		if r > bestRate*1.1 {
+			jobs = n
+		}
+		if r > bestRate {
+			bestRate = r
+		}
+		if n == runtime.NumCPU() {
+			break
+		}
+	}
+	fmt.Printf("\n%s with -jobs %s\n", best, strings.Join(measured, ", "))
+
+	impl := ""
+	if generic[best] > rates[best] {
+		impl = " -hash-impl generic"
+	}
+	fmt.Printf("\nrecommended: -hash %s -jobs %d%s\n", best, jobs, impl)
+}
+
+// checkHashImpl validates -hash-impl. With generic, hashtree runs itself
+// again with the CPU's hashing instructions turned off, through GODEBUG,
+// which the Go runtime only reads when it starts.
+func checkHashImpl(cmd string) {
+	switch *flagHashImpl {
+	case "auto":
+		return
+	case "generic":
+	default:
+		log.Fatal("-hash-impl must be auto or generic")
+	}
+	if cmd == "bench" {
+		log.Fatal("-hash-impl cannot be used with bench, which measures both")
+	}
+	if strings.Contains(os.Getenv("GODEBUG"), genericGODEBUG) {
+		return
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		log.Fatalf("-hash-impl generic: %v", err)
+	}
+	debugf("running again with GODEBUG=%s", genericGODEBUG)
+	reexec(exe, genericEnv())
+}
+
+// genericGODEBUG turns off the CPU features used by the accelerated hash
+// implementations, in both the standard library and x/sys/cpu.
+const genericGODEBUG = "cpu.all=off"
+
+// genericEnv returns the environment with genericGODEBUG added to GODEBUG.
+func genericEnv() []string {
+	env := []string{"GODEBUG=" + genericGODEBUG}
+	for _, e := range os.Environ() {
+		if strings.HasPrefix(e, "GODEBUG=") {
+			env[0] = e + "," + genericGODEBUG
+		} else {
+			env = append(env, e)
+		}
+	}
+	return env
+}
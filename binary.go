@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Binary manifests are a zstd-compressed stream, which begins with
+// binaryMagic and the name of the hash function (as a uvarint length followed
+// by the bytes), followed by one record per file: the path, then the hash,
+// each also prefixed by its length as a uvarint.
+const binaryMagic = "HTM\x01"
+
+// zstdMagic is the magic number at the start of every zstd frame.
+const zstdMagic = "\x28\xb5\x2f\xfd"
+
+// binaryHashPrinter writes hashes as a binary manifest.
+type binaryHashPrinter struct {
+	zw  *zstd.Encoder
+	buf []byte
+}
+
+func newBinaryHashPrinter(w io.Writer) *binaryHashPrinter {
+	zw, err := zstd.NewWriter(w)
+	if err != nil {
+		log.Fatal(err)
+	}
+	hp := &binaryHashPrinter{zw: zw}
+	hp.buf = append(hp.buf, binaryMagic...)
+	hp.buf = appendBinaryField(hp.buf, []byte(*flagHash))
+	hp.write()
+	return hp
+}
+
+func (hp *binaryHashPrinter) Print(r hashResult) {
+	hp.buf = appendBinaryField(hp.buf, []byte(r.path))
+	hp.buf = appendBinaryField(hp.buf, r.hash)
+	hp.write()
+}
+
+func (hp *binaryHashPrinter) write() {
+	if _, err := hp.zw.Write(hp.buf); err != nil {
+		log.Fatal(fmt.Errorf("writing binary manifest: %w", err))
+	}
+	hp.buf = hp.buf[:0]
+}
+
+func (hp *binaryHashPrinter) Close() error {
+	return hp.zw.Close()
+}
+
+func appendBinaryField(b, field []byte) []byte {
+	var n [binary.MaxVarintLen64]byte
+	b = append(b, n[:binary.PutUvarint(n[:], uint64(len(field)))]...)
+	return append(b, field...)
+}
+
+// binaryManifestReader reads a binary manifest one entry at a time, so that
+// very large manifests can be converted without holding them in memory.
+type binaryManifestReader struct {
+	zr   *zstd.Decoder
+	br   *bufio.Reader
+	algo string
+}
+
+func newBinaryManifestReader(r io.Reader) (*binaryManifestReader, error) {
+	zr, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	mr := &binaryManifestReader{zr: zr, br: bufio.NewReader(zr)}
+
+	magic := make([]byte, len(binaryMagic))
+	if _, err := io.ReadFull(mr.br, magic); err != nil || string(magic) != binaryMagic {
+		zr.Close()
+		return nil, errors.New("not a binary manifest")
+	}
+	algo, err := mr.readField()
+	if err != nil {
+		zr.Close()
+		return nil, err
+	}
+	mr.algo = string(algo)
+	return mr, nil
+}
+
+// Next returns the next entry in the manifest, or io.EOF at the end.
+func (mr *binaryManifestReader) Next() (manifestEntry, error) {
+	path, err := mr.readField()
+	if err != nil {
+		return manifestEntry{}, err
+	}
+	hash, err := mr.readField()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return manifestEntry{}, err
+	}
+	return manifestEntry{path: string(path), hash: hash, algo: mr.algo}, nil
+}
+
+func (mr *binaryManifestReader) readField() ([]byte, error) {
+	n, err := binary.ReadUvarint(mr.br)
+	if err != nil {
+		return nil, err
+	}
+	if n > 1<<20 {
+		return nil, errors.New("binary manifest is corrupt")
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(mr.br, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+func (mr *binaryManifestReader) Close() {
+	mr.zr.Close()
+}
+
+// readBinaryManifest reads a whole binary manifest.
+func readBinaryManifest(r io.Reader) ([]manifestEntry, error) {
+	mr, err := newBinaryManifestReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer mr.Close()
+
+	var entries []manifestEntry
+	for {
+		e, err := mr.Next()
+		if err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+}
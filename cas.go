@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// casDir is the content-addressed store being exported to by export-cas, or
+// empty if not exporting.
+var casDir string
+
+func checkCASLink() {
+	switch *flagCASLink {
+	case "copy", "hardlink", "reflink":
+	default:
+		log.Fatal("-cas-link must be copy, hardlink, or reflink")
+	}
+}
+
+// exportCAS places a file which has just been hashed into the store, at
+// casDir/ab/cdef... for a digest of abcdef..., unless a file with the same
+// digest is already present. Copies are hashed again before they're placed,
+// since the file may have changed since it was hashed.
+func exportCAS(hf hashFactory, task hashTask, digest, buf []byte) error {
+	h := hex.EncodeToString(digest)
+	dir := filepath.Join(casDir, h[:2])
+	dst := filepath.Join(dir, h[2:])
+	if _, err := os.Lstat(dst); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	src := task.osPath()
+	switch *flagCASLink {
+	case "hardlink":
+		if err := os.Link(src, dst); err != nil && !errors.Is(err, fs.ErrExist) {
+			return err
+		}
+		return nil
+	case "reflink":
+		return placeFile(dst, src, hf, digest, buf, func(tmp *os.File) error {
+			return cloneFile(src, tmp)
+		})
+	default:
+		return placeFile(dst, src, hf, digest, buf, func(tmp *os.File) error {
+			f, err := os.Open(src)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = io.Copy(tmp, f)
+			return err
+		})
+	}
+}
+
+// placeFile creates dst atomically by filling in a temporary file next to it
+// from src, and renaming it into place if its contents have the digest. If
+// another worker stores the same content concurrently, one of the identical
+// files simply replaces the other.
+func placeFile(dst, src string, hf hashFactory, digest, buf []byte, fill func(tmp *os.File) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".tmp-")
+	if err != nil {
+		return err
+	}
+	if err = fill(tmp); err == nil {
+		err = checkStored(tmp, src, hf, digest, buf)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	// Stored files are never modified in place.
+	if err := os.Chmod(tmp.Name(), 0444); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// checkStored hashes a file which has been filled in for the store from src,
+// and fails if it doesn't have the digest it's to be stored under.
+func checkStored(tmp *os.File, src string, hf hashFactory, digest, buf []byte) error {
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	h := hf()
+	if _, err := io.CopyBuffer(h, tmp, buf); err != nil {
+		return err
+	}
+	sum, err := sumHash(h)
+	releaseHash(h)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(sum, digest) {
+		return &os.PathError{Op: "export", Path: src, Err: errors.New("changed while it was being exported")}
+	}
+	return nil
+}
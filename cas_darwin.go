@@ -0,0 +1,19 @@
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// cloneFile makes dst a clone of src, sharing its extents. clonefile()
+// requires that the destination not exist, so dst is replaced.
+func cloneFile(src string, dst *os.File) error {
+	if err := os.Remove(dst.Name()); err != nil {
+		return err
+	}
+	if err := unix.Clonefile(src, dst.Name(), 0); err != nil {
+		return &os.PathError{Op: "clonefile", Path: src, Err: err}
+	}
+	return nil
+}
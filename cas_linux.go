@@ -0,0 +1,21 @@
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// cloneFile makes dst a reflink copy of src, sharing its extents.
+func cloneFile(src string, dst *os.File) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := unix.IoctlFileClone(int(dst.Fd()), int(f.Fd())); err != nil {
+		return &os.PathError{Op: "FICLONE", Path: src, Err: err}
+	}
+	return nil
+}
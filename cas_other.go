@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func cloneFile(src string, dst *os.File) error {
+	return &os.PathError{Op: "clone", Path: src, Err: errors.New("reflinks are not supported on this platform")}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+)
+
+// runCat implements the cat subcommand, which converts a manifest in any
+// format, including a binary manifest, to the -fmt format. Binary manifests
+// are converted one entry at a time, so they can be larger than memory.
+func runCat(name string) {
+	f, err := openManifest(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+
+	// Each entry is passed to print as it's read
+	var each func(print func(manifestEntry)) error
+	if format, err := detectFormat(br); err != nil {
+		log.Fatalf("%s: %v", name, err)
+	} else if format == "binary" {
+		mr, err := newBinaryManifestReader(br)
+		if err != nil {
+			log.Fatalf("%s: %v", name, err)
+		}
+		defer mr.Close()
+		if !flagWasSet("hash") {
+			*flagHash = mr.algo
+		}
+		each = func(print func(manifestEntry)) error {
+			for {
+				e, err := mr.Next()
+				if err == io.EOF {
+					return nil
+				} else if err != nil {
+					return err
+				}
+				print(e)
+			}
+		}
+	} else {
+		entries, header, err := readManifest(name, "auto")
+		if err != nil {
+			log.Fatalf("%s: %v", name, err)
+		}
+		if header != nil {
+			headerRoots = header.roots
+		}
+		if !flagWasSet("hash") {
+			*flagHash = detectAlgorithm(entries)
+		}
+		each = func(print func(manifestEntry)) error {
+			for _, e := range entries {
+				print(e)
+			}
+			return nil
+		}
+	}
+
+	out := *flagOutput
+	if out == "" {
+		out = "-"
+	}
+	w, err := createOutput(out)
+	if err != nil {
+		log.Fatal(err)
+	}
+	bw := bufio.NewWriter(w)
+
+	hp := newHashPrinter(*flagFmt, bw)
+	err = each(func(e manifestEntry) {
+		hp.Print(hashResult{path: e.path, hash: e.hash, algo: e.algo})
+	})
+	if err != nil {
+		log.Fatalf("%s: %v", name, err)
+	}
+	if c, ok := hp.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		log.Fatal(fmt.Errorf("writing manifest: %w", err))
+	}
+	if err := w.Close(); err != nil {
+		log.Fatal(fmt.Errorf("writing manifest: %w", err))
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// The -chain-log is an append-only log of every scan, as JSON lines. Each
+// record includes the SHA-256 of the previous line, so the log can't be
+// edited, or records removed, without breaking the chain from that point on.
+// Truncating the end of the log can only be detected by comparing it with a
+// record digest which was kept elsewhere, such as the head digest printed by
+// verify-chain.
+
+// chainGenesis is the previous-record digest of the first record in a log.
+var chainGenesis = strings.Repeat("0", 64)
+
+// chainRecord is a record in a -chain-log. Each scan is logged as a "start"
+// record, a "file" or "error" record for each result, and an "end" record.
+type chainRecord struct {
+	Seq    int64    `json:"seq"`
+	Prev   string   `json:"prev"`
+	Type   string   `json:"type"`
+	Time   string   `json:"time,omitempty"`
+	Algo   string   `json:"algo,omitempty"`
+	Roots  []string `json:"roots,omitempty"`
+	Path   string   `json:"path,omitempty"`
+	Hash   string   `json:"hash,omitempty"`
+	Status string   `json:"status,omitempty"`
+	Error  string   `json:"error,omitempty"`
+	Files  int64    `json:"files,omitempty"`
+	Errors int64    `json:"errors,omitempty"`
+}
+
+// chainDigest returns the digest of a record's line, without its newline.
+func chainDigest(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+// chainPrinter appends each result to a -chain-log, before passing it on to
+// another printer.
+type chainPrinter struct {
+	hp hashPrinter
+	f  *os.File
+	w  *bufio.Writer
+
+	seq           int64
+	prev          string
+	files, errors int64
+}
+
+func newChainPrinter(hp hashPrinter, name string, roots []string) *chainPrinter {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		log.Fatal(err)
+	}
+	lp := &chainPrinter{hp: hp, f: f, w: bufio.NewWriter(f), prev: chainGenesis}
+	if err := lp.load(); err != nil {
+		log.Fatalf("%s: %v", name, err)
+	}
+	lp.append(chainRecord{Type: "start", Time: time.Now().UTC().Format(time.RFC3339), Algo: *flagHash, Roots: absRoots(roots)})
+	return lp
+}
+
+// load finds the sequence number and digest of the last record in the log,
+// so that new records can be chained to it.
+func (lp *chainPrinter) load() error {
+	br := bufio.NewReader(lp.f)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return nil
+		} else if err == io.EOF {
+			return errors.New("last record is incomplete")
+		} else if err != nil {
+			return err
+		}
+		line = line[:len(line)-1]
+		var rec chainRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return fmt.Errorf("record %d: %w", lp.seq+1, err)
+		}
+		lp.seq, lp.prev = rec.Seq, chainDigest(line)
+	}
+}
+
+func (lp *chainPrinter) append(rec chainRecord) {
+	lp.seq++
+	rec.Seq, rec.Prev = lp.seq, lp.prev
+	line, err := json.Marshal(rec)
+	if err != nil {
+		log.Fatal(err)
+	}
+	lp.prev = chainDigest(line)
+	lp.w.Write(append(line, '\n'))
+}
+
+func (lp *chainPrinter) Print(r hashResult) {
+	lp.files++
+	lp.append(chainRecord{Type: "file", Path: r.path, Hash: hex.EncodeToString(r.hash), Status: r.status})
+	lp.hp.Print(r)
+}
+
+func (lp *chainPrinter) PrintError(r hashResult) {
+	lp.errors++
+	lp.append(chainRecord{Type: "error", Path: r.path, Error: r.err.Error()})
+	if ep, ok := lp.hp.(errorPrinter); ok {
+		ep.PrintError(r)
+	}
+}
+
+func (lp *chainPrinter) wrapped() hashPrinter {
+	return lp.hp
+}
+
+func (lp *chainPrinter) PrintWarning(w pathWarning) {
+	printWarning(lp.hp, w)
+}
+
+// Flush writes the records so far to disk.
+func (lp *chainPrinter) Flush() error {
+	if err := lp.w.Flush(); err != nil {
+		return err
+	}
+	return lp.f.Sync()
+}
+
+// Close ends the scan's records, and closes the printer it wraps.
+func (lp *chainPrinter) Close() error {
+	lp.append(chainRecord{Type: "end", Time: time.Now().UTC().Format(time.RFC3339), Files: lp.files, Errors: lp.errors})
+	err := lp.Flush()
+	if cerr := lp.f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("writing -chain-log: %w", err)
+	}
+	if c, ok := lp.hp.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// runVerifyChain implements the verify-chain subcommand, which checks that
+// every record in a -chain-log is chained to the one before it, and prints
+// the digest of the last record. If head is given, it must be the digest of
+// one of the records, so that the log up to that point is known not to have
+// been replaced.
+func runVerifyChain(name, head string) {
+	f, err := os.Open(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	prev, seq, scans, complete := chainGenesis, int64(0), 0, true
+	headFound := head == ""
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		} else if err == io.EOF {
+			log.Fatalf("%s: record %d is incomplete", name, seq+1)
+		} else if err != nil {
+			log.Fatal(err)
+		}
+		line = bytes.TrimSuffix(line, []byte("\n"))
+
+		var rec chainRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			log.Fatalf("%s: record %d: %v", name, seq+1, err)
+		}
+		if rec.Seq != seq+1 {
+			log.Fatalf("%s: record %d has sequence number %d", name, seq+1, rec.Seq)
+		}
+		if rec.Prev != prev {
+			log.Fatalf("%s: record %d is not chained to the record before it", name, rec.Seq)
+		}
+		switch rec.Type {
+		case "start":
+			scans++
+			complete = false
+		case "end":
+			complete = true
+		}
+		seq, prev = rec.Seq, chainDigest(line)
+		if prev == strings.ToLower(head) {
+			headFound = true
+		}
+	}
+
+	if !headFound {
+		log.Fatalf("%s: no record has the digest %s", name, head)
+	}
+	fmt.Printf("%s: OK (%d records, %d scans)\n", name, seq, scans)
+	if !complete {
+		fmt.Printf("%s: the last scan did not finish\n", name)
+	}
+	fmt.Printf("head %s\n", prev)
+}
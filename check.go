@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+)
+
+// Verification statuses, for check mode and -xattr verify.
+const (
+	statusOK        = "OK"
+	statusUnchanged = "UNCHANGED"
+	statusFailed    = "FAILED"
+	statusModified  = "MODIFIED"
+	statusMissing   = "MISSING"
+	statusExtra     = "EXTRA"
+)
+
+// checkStatuses lists the statuses in the order they're summarized.
+var checkStatuses = []string{statusOK, statusUnchanged, statusFailed, statusModified, statusMissing, statusExtra}
+
+// checkPrinter compares hashes against a manifest and prints the outcome for
+// each file in the style of "sha256sum -c", as soon as it's known. Files
+// listed in the manifest but never seen are reported as missing when the
+// printer is closed, in sorted order, followed by a count of each status.
+type checkPrinter struct {
+	expected map[string][]byte
+	seen     map[string]bool
+	verified int // files which were read and compared
+	failures int
+	counts   map[string]int
+}
+
+func newCheckPrinter(entries []manifestEntry) *checkPrinter {
+	cp := &checkPrinter{
+		expected: make(map[string][]byte, len(entries)),
+		seen:     make(map[string]bool, len(entries)),
+		counts:   make(map[string]int),
+	}
+	for _, e := range entries {
+		cp.expected[e.path] = e.hash
+	}
+	return cp
+}
+
+func (cp *checkPrinter) Print(r hashResult) {
+	status := r.status
+	switch status {
+	case "":
+		cp.seen[r.path] = true
+		cp.verified++
+		status = statusOK
+		if string(cp.expected[r.path]) != string(r.hash) {
+			status = statusFailed
+		}
+	case statusUnchanged:
+		cp.seen[r.path] = true
+		cp.verified++
+	}
+	cp.report(r.path, status, "")
+}
+
+func (cp *checkPrinter) PrintError(r hashResult) {
+	cp.seen[r.path] = true
+	if errors.Is(r.err, fs.ErrNotExist) {
+		cp.report(r.path, statusMissing, "")
+	} else {
+		cp.report(r.path, statusFailed, r.err.Error())
+	}
+}
+
+func (cp *checkPrinter) report(path, status, errMsg string) {
+	switch {
+	case status == statusMissing && *flagIgnoreMissing:
+		return
+	case *flagStatus, (status == statusOK || status == statusUnchanged) && *flagQuiet:
+	case errMsg != "":
+		fmt.Printf("%s: %s (%s)\n", path, status, errMsg)
+	default:
+		fmt.Printf("%s: %s\n", path, status)
+	}
+	cp.counts[status]++
+	if status != statusOK && status != statusUnchanged {
+		cp.failures++
+		notifyMismatch(alert{Path: path, Status: status, Error: errMsg})
+	}
+}
+
+func (cp *checkPrinter) Close() error {
+	var missing []string
+	for p := range cp.expected {
+		if !cp.seen[p] {
+			missing = append(missing, p)
+		}
+	}
+	sort.Strings(missing)
+	for _, p := range missing {
+		cp.report(p, statusMissing, "")
+	}
+
+	if cp.failures > 0 {
+		return fmt.Errorf("%d files did not verify (%s)", cp.failures, cp.summary())
+	}
+	debugf("all files verified (%s)", cp.summary())
+	if *flagIgnoreMissing && cp.verified == 0 {
+		// As with "sha256sum -c --ignore-missing", verifying nothing at
+		// all is more likely a mistake than a success.
+		return errors.New("no files were verified")
+	}
+	return nil
+}
+
+// summary returns the number of files with each status, such as
+// "10 OK, 1 FAILED".
+func (cp *checkPrinter) summary() string {
+	var parts []string
+	for _, status := range checkStatuses {
+		if n := cp.counts[status]; n > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", n, status))
+		}
+	}
+	if len(parts) == 0 {
+		return "no files"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// tasks queues a task for each file in the manifest, in the order they're
+// listed, so that files are read in the same order on every run. Files which
+// aren't under any of the roots' labels are reported as missing.
+func (cp *checkPrinter) tasks(entries []manifestEntry, roots []openedRoot, tasks chan<- hashTask, results chan<- hashResult) {
+	queued := make(map[string]bool, len(cp.expected))
+	for _, e := range entries {
+		if queued[e.path] {
+			continue
+		}
+		queued[e.path] = true
+		r, ok := rootFor(roots, e.path)
+		if !ok {
+			results <- hashResult{path: e.path, err: &fs.PathError{Op: "open", Path: e.path, Err: fs.ErrNotExist}}
+			continue
+		}
+		tasks <- r.task(strings.TrimPrefix(e.path, r.prefix))
+	}
+}
+
+// unchangedEntries holds the manifest entries which have a size and mtime,
+// with -assume-unchanged-within.
+var unchangedEntries map[string]manifestEntry
+
+func loadUnchangedEntries(entries []manifestEntry) {
+	unchangedEntries = make(map[string]manifestEntry)
+	for _, e := range entries {
+		if !e.mtime.IsZero() {
+			unchangedEntries[e.path] = e
+		}
+	}
+	if len(unchangedEntries) == 0 {
+		warnf("the manifest has no sizes and modification times, so every file will be read (use -stat when generating it)")
+	}
+}
+
+// assumeUnchanged reports whether a file can be trusted without reading it,
+// because its size and mtime match the manifest's, within the tolerance of
+// -assume-unchanged-within.
+func assumeUnchanged(task hashTask) bool {
+	e, ok := unchangedEntries[displayPath(task.path)]
+	if !ok {
+		return false
+	}
+	fi, err := fs.Stat(task.fs, task.path)
+	if err != nil || !fi.Mode().IsRegular() || fi.Size() != e.size {
+		return false
+	}
+	d := fi.ModTime().Sub(e.mtime)
+	return d <= *flagAssumeUnchanged && d >= -*flagAssumeUnchanged
+}
+
+// isExtra reports whether a path found on disk is absent from the manifest.
+func (cp *checkPrinter) isExtra(path string) bool {
+	_, ok := cp.expected[displayPath(path)]
+	return !ok
+}
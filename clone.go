@@ -0,0 +1,43 @@
+package main
+
+import (
+	"log"
+	"runtime"
+	"sync"
+)
+
+// cloneCache remembers the hashes of files whose extents are shared with
+// other files, such as reflinked copies and files in filesystem snapshots,
+// so that -clones can reuse them for other files with the same extents.
+type cloneCache struct {
+	mu sync.Mutex
+	m  map[string]hashResult
+}
+
+// clones is the cache used by -clones, or nil.
+var clones *cloneCache
+
+func checkClones() {
+	if !*flagClones {
+		return
+	}
+	if runtime.GOOS != "linux" {
+		log.Fatal("-clones is only supported on Linux")
+	}
+	clones = &cloneCache{m: make(map[string]hashResult)}
+}
+
+func (cc *cloneCache) get(key string) (hashResult, bool) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	r, ok := cc.m[key]
+	return r, ok
+}
+
+func (cc *cloneCache) put(key string, r hashResult) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if _, ok := cc.m[key]; !ok {
+		cc.m[key] = hashResult{path: r.path, hash: r.hash, size: r.size, chunks: r.chunks}
+	}
+}
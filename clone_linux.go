@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// From linux/fiemap.h, which x/sys/unix doesn't provide.
+const (
+	fsIocFiemap    = 0xc020660b // _IOWR('f', 11, struct fiemap)
+	fiemapFlagSync = 0x1
+
+	fiemapExtentLast   = 0x1
+	fiemapExtentShared = 0x2000
+
+	// Extents whose data isn't (only) at their physical location, or
+	// whose location isn't known yet.
+	fiemapExtentUnreliable = 0x2 | 0x4 | 0x8 | 0x80 | 0x100 | 0x200 | 0x400 | 0x800
+)
+
+type fiemap struct {
+	start         uint64
+	length        uint64
+	flags         uint32
+	mappedExtents uint32
+	extentCount   uint32
+	reserved      uint32
+}
+
+type fiemapExtent struct {
+	logical    uint64
+	physical   uint64
+	length     uint64
+	reserved64 [2]uint64
+	flags      uint32
+	reserved   [3]uint32
+}
+
+// maxCloneExtents limits the extents read for each file, since heavily
+// fragmented files are unlikely to be clones worth finding.
+const maxCloneExtents = 4096
+
+// extentKey returns a key identifying the physical extents of a file, if
+// any of them are shared with another file. Files with the same key have the
+// same contents. It returns "" if the file has no shared extents, or its
+// extents can't be determined.
+func extentKey(f *os.File) string {
+	fi, err := f.Stat()
+	if err != nil {
+		return ""
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return ""
+	}
+
+	var req struct {
+		fiemap
+		extents [256]fiemapExtent
+	}
+	key := make([]byte, 0, 128)
+	key = appendUint64(key, uint64(st.Dev))
+	key = appendUint64(key, uint64(fi.Size()))
+	shared, total := false, 0
+	for start := uint64(0); ; {
+		req.fiemap = fiemap{start: start, length: ^uint64(0) - start, flags: fiemapFlagSync, extentCount: uint32(len(req.extents))}
+		_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), fsIocFiemap, uintptr(unsafe.Pointer(&req)))
+		if errno != 0 || req.mappedExtents == 0 {
+			return ""
+		}
+		for _, e := range req.extents[:req.mappedExtents] {
+			if e.flags&fiemapExtentUnreliable != 0 {
+				return ""
+			}
+			shared = shared || e.flags&fiemapExtentShared != 0
+			key = appendUint64(key, e.logical)
+			key = appendUint64(key, e.physical)
+			key = appendUint64(key, e.length)
+			if e.flags&fiemapExtentLast != 0 {
+				if !shared {
+					return ""
+				}
+				return string(key)
+			}
+			start = e.logical + e.length
+		}
+		if total += int(req.mappedExtents); total >= maxCloneExtents {
+			return ""
+		}
+	}
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
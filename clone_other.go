@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "os"
+
+func extentKey(f *os.File) string {
+	return ""
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// pathWarning reports that a path collides with another path, for
+// -collisions. kind is "case" if the paths only differ in case, and
+// "normalization" if they only differ in Unicode normalization. It's also
+// used for files skipped with -skip-locked, with kind "locked".
+type pathWarning struct {
+	kind  string
+	path  string
+	other string
+}
+
+func (w pathWarning) String() string {
+	if w.kind == "locked" {
+		return fmt.Sprintf("%s is locked by another process, so was skipped", w.path)
+	}
+	return fmt.Sprintf("%s collides with %s (%s)", w.path, w.other, w.kind)
+}
+
+// name returns the warning's name in JSON and -stream output, such as
+// "case-collision" or "locked".
+func (w pathWarning) name() string {
+	if w.kind == "locked" {
+		return w.kind
+	}
+	return w.kind + "-collision"
+}
+
+// warningPrinter is implemented by hash printers which can include warnings
+// in their output. For all other printers, warnings are logged.
+type warningPrinter interface {
+	PrintWarning(pathWarning)
+}
+
+// printWarning passes a warning to hp, or logs it if hp can't print it.
+func printWarning(hp hashPrinter, w pathWarning) {
+	if wp, ok := hp.(warningPrinter); ok {
+		wp.PrintWarning(w)
+	} else {
+		warnf("%s", w)
+	}
+}
+
+// collisionDetector finds paths which would collide with each other if the
+// tree was copied to a filesystem which is case-insensitive, or which
+// normalizes Unicode, like those on Windows and macOS. Directories are
+// checked too, so a file and a directory can collide, and two directories
+// which would be merged are reported once, rather than for every file in
+// them.
+//
+// Case is compared with simple, one-to-one case mappings, as Windows and
+// macOS do, so "straße" and "STRASSE" don't collide.
+type collisionDetector struct {
+	seen     map[string]string // folded path -> first path seen
+	reported map[string]bool
+}
+
+func newCollisionDetector() *collisionDetector {
+	return &collisionDetector{
+		seen:     make(map[string]string),
+		reported: make(map[string]bool),
+	}
+}
+
+// add records a path, and reports whether it, or one of its parent
+// directories, collides with a path which was added before.
+func (cd *collisionDetector) add(p string) (pathWarning, bool) {
+	for end := 0; end < len(p); end++ {
+		if i := strings.IndexByte(p[end+1:], '/'); i >= 0 {
+			end += 1 + i
+		} else {
+			end = len(p)
+		}
+		prefix := p[:end]
+
+		key := norm.NFC.String(strings.ToUpper(prefix))
+		other, ok := cd.seen[key]
+		if !ok {
+			cd.seen[key] = prefix
+			continue
+		} else if other == prefix {
+			continue
+		}
+
+		// Only the outermost collision is reported, once
+		if cd.reported[prefix] {
+			return pathWarning{}, false
+		}
+		cd.reported[prefix] = true
+		kind := "case"
+		if norm.NFC.String(prefix) == norm.NFC.String(other) {
+			kind = "normalization"
+		}
+		return pathWarning{kind, prefix, other}, true
+	}
+	return pathWarning{}, false
+}
+
+// textWarning formats a warning as a comment in a text manifest, with the
+// given comment character.
+func textWarning(comment string, w pathWarning) string {
+	return fmt.Sprintf("%s warning: %s\n", comment, w)
+}
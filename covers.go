@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"hash"
+	"io/fs"
+	"log"
+	"strings"
+)
+
+// With -digest-covers, each file's digest also covers its path, and
+// optionally its mode and mtime, so that a file which is moved or renamed
+// (or has its permissions changed) no longer matches its old digest.
+var coverMode, coverMtime bool
+
+// checkDigestCovers validates -digest-covers, which may also be taken from a
+// manifest's header in check mode.
+func checkDigestCovers(cmd string) {
+	if *flagDigestCovers == "" {
+		return
+	}
+	path := false
+	for _, field := range strings.Split(*flagDigestCovers, ",") {
+		switch field {
+		case "path":
+			path = true
+		case "mode":
+			coverMode = true
+		case "mtime":
+			coverMtime = true
+		default:
+			log.Fatalf("-digest-covers: unknown field %q", field)
+		}
+	}
+	switch {
+	case !path:
+		log.Fatal("-digest-covers must include path")
+	case cmd == "export-cas":
+		// The store is addressed by content alone
+		log.Fatal("-digest-covers cannot be used with export-cas")
+	case *flagArchives || *flagTar != "":
+		log.Fatal("-digest-covers cannot be used with -archives or -tar")
+	case *flagChunks > 0 || *flagClones:
+		log.Fatal("-digest-covers cannot be used with -chunks or -clones")
+	case *flagSidecar != "":
+		log.Fatal("-digest-covers cannot be used with -sidecar")
+	}
+}
+
+// coveredHash is a hash which begins with the path and metadata of a file,
+// for -digest-covers. The prefix is written again when the hash is reset.
+type coveredHash struct {
+	hash.Hash
+	prefix []byte
+}
+
+func (h coveredHash) Reset() {
+	h.Hash.Reset()
+	h.Hash.Write(h.prefix)
+}
+
+// coverFile returns a hashFactory for a file's digest with -digest-covers.
+// The contents are preceded by the path and a NUL byte, then the permission
+// bits in octal (as for chmod) and a NUL, if mode is covered, then the mtime
+// in seconds since the epoch and a NUL, if mtime is covered. fi is only
+// needed if either is.
+func coverFile(hf hashFactory, path string, fi fs.FileInfo) hashFactory {
+	if *flagDigestCovers == "" {
+		return hf
+	}
+	prefix := path + "\x00"
+	if coverMode {
+		mode := uint32(fi.Mode().Perm())
+		if fi.Mode()&fs.ModeSetuid != 0 {
+			mode |= 04000
+		}
+		if fi.Mode()&fs.ModeSetgid != 0 {
+			mode |= 02000
+		}
+		if fi.Mode()&fs.ModeSticky != 0 {
+			mode |= 01000
+		}
+		prefix += fmt.Sprintf("%o\x00", mode)
+	}
+	if coverMtime {
+		prefix += fmt.Sprintf("%d\x00", fi.ModTime().Unix())
+	}
+	return func() hash.Hash {
+		h := coveredHash{hf(), []byte(prefix)}
+		h.Hash.Write(h.prefix)
+		return h
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// ageMagic is the start of the header of every age-encrypted file.
+const ageMagic = "age-encryption.org/v1\n"
+
+// recipients are who output is encrypted to, with -encrypt-to or
+// -passphrase-env, or nil if it isn't encrypted.
+var recipients []age.Recipient
+
+// checkEncryption validates -encrypt-to and -passphrase-env, and sets up
+// recipients.
+func checkEncryption() {
+	for _, r := range *flagEncryptTo {
+		if strings.HasPrefix(r, "age1") {
+			rcpt, err := age.ParseX25519Recipient(r)
+			if err != nil {
+				log.Fatalf("-encrypt-to %s: %v", r, err)
+			}
+			recipients = append(recipients, rcpt)
+			continue
+		}
+
+		// Anything else is a file of recipients
+		f, err := os.Open(r)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rcpts, err := age.ParseRecipients(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("%s: %v", r, err)
+		}
+		recipients = append(recipients, rcpts...)
+	}
+
+	if pass := passphrase(); pass != "" {
+		if len(recipients) > 0 {
+			log.Fatal("-encrypt-to and -passphrase-env cannot be used together")
+		}
+		rcpt, err := age.NewScryptRecipient(pass)
+		if err != nil {
+			log.Fatal(err)
+		}
+		recipients = append(recipients, rcpt)
+	}
+}
+
+// passphrase returns the passphrase from the environment variable named by
+// -passphrase-env.
+func passphrase() string {
+	if *flagPassphraseEnv == "" {
+		return ""
+	}
+	pass := os.Getenv(*flagPassphraseEnv)
+	if pass == "" {
+		log.Fatalf("-passphrase-env: $%s is not set", *flagPassphraseEnv)
+	}
+	return pass
+}
+
+// encryptOutput returns a writer which encrypts what's written to w, if
+// output is to be encrypted. Closing it closes w.
+func encryptOutput(w io.WriteCloser) (io.WriteCloser, error) {
+	if recipients == nil {
+		return w, nil
+	}
+	ew, err := age.Encrypt(w, recipients...)
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	return encryptedWriter{ew, w}, nil
+}
+
+type encryptedWriter struct {
+	io.WriteCloser           // encrypts
+	w              io.Closer // underlying output
+}
+
+func (ew encryptedWriter) Close() error {
+	err := ew.WriteCloser.Close()
+	if cerr := ew.w.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// openManifest opens a manifest for reading, decrypting it with -identity
+// or -passphrase-env if it's encrypted.
+func openManifest(name string) (io.ReadCloser, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(f)
+	if b, _ := br.Peek(len(ageMagic)); string(b) != ageMagic {
+		return readCloser{br, f}, nil
+	}
+
+	ids, err := identities()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	r, err := age.Decrypt(br, ids...)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return readCloser{r, f}, nil
+}
+
+// identities returns the identities to decrypt manifests with.
+func identities() ([]age.Identity, error) {
+	var ids []age.Identity
+	for _, name := range *flagIdentity {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		fileIDs, err := age.ParseIdentities(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		ids = append(ids, fileIDs...)
+	}
+	if pass := passphrase(); pass != "" {
+		id, err := age.NewScryptIdentity(pass)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return nil, errors.New("manifest is encrypted; use -identity or -passphrase-env to decrypt it")
+	}
+	return ids, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// isDAV reports whether a root is a WebDAV URL, dav://host/path (over
+// HTTP) or davs://host/path (over HTTPS).
+func isDAV(root string) bool {
+	return strings.HasPrefix(root, "dav://") || strings.HasPrefix(root, "davs://")
+}
+
+// checkDAV rejects options which need a local filesystem, if any root is on
+// WebDAV.
+func checkDAV(roots []string, cmd string) {
+	dav := false
+	for _, root := range roots {
+		dav = dav || isDAV(root)
+	}
+	if !dav {
+		return
+	}
+	switch {
+	case cmd == "export-cas" || cmd == "gate":
+		log.Fatalf("%s cannot be used with WebDAV paths", cmd)
+	case *flagXattr != "" || *flagFollowSymlinks || *flagADS || *flagSnapshot != "" || *flagSidecar == "write":
+		log.Fatal("-xattr, -follow-symlinks, -ads, -snapshot, and -sidecar write cannot be used with WebDAV paths")
+	}
+}
+
+// davFS is an fs.FS for a tree on a WebDAV server. Directories are listed
+// with PROPFIND requests, and files are read with GET requests, as for -urls.
+type davFS struct {
+	base   *url.URL
+	header http.Header
+}
+
+// davPropfind is the body of a PROPFIND request, asking only for the
+// properties which are needed to walk the tree.
+const davPropfind = `<?xml version="1.0" encoding="utf-8"?>
+<propfind xmlns="DAV:"><prop><resourcetype/><getcontentlength/><getlastmodified/></prop></propfind>`
+
+// davMultistatus is the response to a PROPFIND request.
+type davMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"DAV: href"`
+		Propstat []struct {
+			Prop struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"DAV: collection"`
+				} `xml:"DAV: resourcetype"`
+				ContentLength int64  `xml:"DAV: getcontentlength"`
+				LastModified  string `xml:"DAV: getlastmodified"`
+			} `xml:"DAV: prop"`
+			Status string `xml:"DAV: status"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+// openDAV returns a filesystem for a WebDAV root. A username can be given in
+// the URL, with the password either in the URL or in HASHTREE_DAV_PASSWORD.
+// Any -http-header is sent with every request, e.g. for bearer tokens.
+func openDAV(root string) fs.FS {
+	u, err := url.Parse(root)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if u.Scheme == "davs" {
+		u.Scheme = "https"
+	} else {
+		u.Scheme = "http"
+	}
+
+	header := flagHTTPHeader.h.Clone()
+	if u.User != nil {
+		password, ok := u.User.Password()
+		if !ok {
+			password = os.Getenv("HASHTREE_DAV_PASSWORD")
+		}
+		auth := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+		header.Set("Authorization", "Basic "+auth)
+		u.User = nil
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	u.RawPath = ""
+	return davFS{u, header}
+}
+
+// url returns the URL of the file or directory at name.
+func (dfs davFS) url(name string, dir bool) string {
+	u := *dfs.base
+	if name != "." {
+		u.Path += "/" + name
+	}
+	if dir {
+		u.Path += "/"
+	}
+	return u.String()
+}
+
+func (dfs davFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	return httpFS{dfs.header}.Open(dfs.url(name, false))
+}
+
+func (dfs davFS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	infos, err := dfs.propfind(name, "0")
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	if len(infos) == 0 {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	fi := infos[0]
+	fi.name = path.Base(name)
+	return fi, nil
+}
+
+// ReadDir lists a directory, sorted by name.
+func (dfs davFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	infos, err := dfs.propfind(name, "1")
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	var entries []fs.DirEntry
+	for _, fi := range infos {
+		if !fi.self {
+			entries = append(entries, fs.FileInfoToDirEntry(fi))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// propfind requests the properties of name and, with depth "1", the files
+// and directories directly within it.
+func (dfs davFS) propfind(name, depth string) ([]davFileInfo, error) {
+	// Directories are requested with a trailing slash, as some servers
+	// redirect to it otherwise. The root is assumed to be a directory.
+	req, err := http.NewRequest("PROPFIND", dfs.url(name, depth == "1" || name == "."), strings.NewReader(davPropfind))
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range dfs.header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Depth", depth)
+	req.Header.Set("Content-Type", `application/xml; charset="utf-8"`)
+
+	iopsLimiter.wait(1)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, httpStatusError{resp.StatusCode, resp.Status}
+	}
+	var ms davMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, err
+	}
+
+	self := strings.TrimSuffix(req.URL.Path, "/")
+	var infos []davFileInfo
+	for _, r := range ms.Responses {
+		href, err := url.Parse(r.Href)
+		if err != nil {
+			return nil, err
+		}
+		p := strings.TrimSuffix(href.Path, "/")
+		for _, ps := range r.Propstat {
+			if !strings.Contains(ps.Status, " 200 ") {
+				continue
+			}
+			fi := davFileInfo{
+				name: path.Base(p),
+				size: ps.Prop.ContentLength,
+				dir:  ps.Prop.ResourceType.Collection != nil,
+				self: p == self,
+			}
+			fi.modTime, _ = http.ParseTime(ps.Prop.LastModified)
+			infos = append(infos, fi)
+			break
+		}
+	}
+	return infos, nil
+}
+
+// davFileInfo describes a file or directory from a PROPFIND response. self is
+// set for the directory being listed, which is included in the response.
+type davFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+	self    bool
+}
+
+func (fi davFileInfo) Name() string       { return fi.name }
+func (fi davFileInfo) Size() int64        { return fi.size }
+func (fi davFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi davFileInfo) IsDir() bool        { return fi.dir }
+func (fi davFileInfo) Sys() interface{}   { return nil }
+
+func (fi davFileInfo) Mode() fs.FileMode {
+	if fi.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
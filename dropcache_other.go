@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// Dropping files from the cache is only supported on Linux.
+func dropCache(f *os.File) error {
+	return errors.New("-drop-cache is only supported on Linux")
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+)
+
+// Reasons for the walker to include or skip a file, as reported by -dry-run.
+const (
+	decisionIncluded = "included"
+	decisionShard    = "excluded by -shard"
+	decisionOwner    = "excluded by -uid, -gid, or -owner"
+	decisionPathspec = "excluded by pathspec"
+)
+
+type dryRunCount struct {
+	files, bytes int64
+}
+
+// dryRunStats counts the files found by the walker in -dry-run mode, along
+// with their total size, by the decision made about each one.
+type dryRunStats struct {
+	decisions []string // in the order first seen
+	counts    map[string]*dryRunCount
+}
+
+func newDryRunStats() *dryRunStats {
+	return &dryRunStats{counts: make(map[string]*dryRunCount)}
+}
+
+func (s *dryRunStats) record(decision string, dirent fs.DirEntry) {
+	fi, err := dirent.Info()
+	if err != nil {
+		log.Fatal(err)
+	}
+	c := s.counts[decision]
+	if c == nil {
+		c = &dryRunCount{}
+		s.counts[decision] = c
+		s.decisions = append(s.decisions, decision)
+	}
+	c.files++
+	c.bytes += fi.Size()
+}
+
+// print reports the number and size of files which would be hashed in a
+// root, and with -v, a breakdown by decision.
+func (s *dryRunStats) print(w io.Writer, root string) {
+	included := s.counts[decisionIncluded]
+	if included == nil {
+		included = &dryRunCount{}
+	}
+	fmt.Fprintf(w, "%s: %d files, %s (%d bytes)\n", root, included.files, formatBytes(included.bytes), included.bytes)
+	if !*flagVerbose {
+		return
+	}
+	for _, d := range s.decisions {
+		c := s.counts[d]
+		fmt.Fprintf(w, "  %s: %d files, %s (%d bytes)\n", d, c.files, formatBytes(c.bytes), c.bytes)
+	}
+}
+
+// formatBytes formats a size in bytes for humans.
+func formatBytes(n int64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return fmt.Sprintf("%d bytes", n)
+	}
+	v, i := float64(n)/1024, 0
+	for v >= 1024 && i < len(units)-1 {
+		v /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %ciB", v, units[i])
+}
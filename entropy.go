@@ -0,0 +1,33 @@
+package main
+
+import "math"
+
+// byteCounts counts how often each byte value is written to it, for
+// -entropy.
+type byteCounts [256]int64
+
+func (c *byteCounts) Write(p []byte) (int, error) {
+	for _, b := range p {
+		c[b]++
+	}
+	return len(p), nil
+}
+
+// entropy returns the Shannon entropy of the bytes counted, in bits per
+// byte, from 0 (a single repeated byte, or nothing at all) to 8 (uniformly
+// random, as encrypted and well-compressed data are). It's rounded to four
+// decimal places, which is plenty to tell them apart.
+func (c *byteCounts) entropy() float64 {
+	var total int64
+	for _, n := range c {
+		total += n
+	}
+	var e float64
+	for _, n := range c {
+		if n > 0 {
+			p := float64(n) / float64(total)
+			e -= p * math.Log2(p)
+		}
+	}
+	return math.Round(e*1e4) / 1e4
+}
@@ -0,0 +1,13 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris && !windows
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris,!windows
+
+package main
+
+import (
+	"errors"
+	"io/fs"
+)
+
+func fileIDOf(osPath string, fi fs.FileInfo) (fileID, error) {
+	return fileID{}, errors.New("-follow-symlinks is not supported on this platform")
+}
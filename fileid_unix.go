@@ -0,0 +1,19 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"syscall"
+)
+
+// fileIDOf returns the device and inode of a file.
+func fileIDOf(osPath string, fi fs.FileInfo) (fileID, error) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileID{}, errors.New("no inode information")
+	}
+	return fileID{uint64(st.Dev), uint64(st.Ino)}, nil
+}
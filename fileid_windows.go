@@ -0,0 +1,29 @@
+package main
+
+import (
+	"io/fs"
+
+	"golang.org/x/sys/windows"
+)
+
+// fileIDOf returns the volume serial number and file index of a file, which
+// are the Windows equivalent of the device and inode.
+func fileIDOf(osPath string, fi fs.FileInfo) (fileID, error) {
+	p, err := windows.UTF16PtrFromString(osPath)
+	if err != nil {
+		return fileID{}, err
+	}
+	// FILE_FLAG_BACKUP_SEMANTICS is required to open directories.
+	h, err := windows.CreateFile(p, 0, windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE|windows.FILE_SHARE_DELETE,
+		nil, windows.OPEN_EXISTING, windows.FILE_FLAG_BACKUP_SEMANTICS, 0)
+	if err != nil {
+		return fileID{}, err
+	}
+	defer windows.CloseHandle(h)
+
+	var info windows.ByHandleFileInformation
+	if err := windows.GetFileInformationByHandle(h, &info); err != nil {
+		return fileID{}, err
+	}
+	return fileID{uint64(info.VolumeSerialNumber), uint64(info.FileIndexHigh)<<32 | uint64(info.FileIndexLow)}, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"strings"
+)
+
+// With -footer, text manifests end with a comment holding the SHA-256 of
+// everything before it, like "# hashtree footer sha256=<hex>", so that a
+// manifest which was cut short or corrupted can be told apart from a
+// complete one. Footers are checked whenever a text manifest is read.
+
+// footerPrinter writes the footer when the printer it wraps is closed.
+type footerPrinter struct {
+	hp hashPrinter
+	fw *footerWriter
+}
+
+// footerWriter hashes everything written through it, for the footer.
+type footerWriter struct {
+	w       io.Writer
+	h       hash.Hash
+	comment string
+}
+
+// footerComment returns the comment character for a footer in the given
+// output format.
+func footerComment(format string) string {
+	switch format {
+	case "hex", "base64", "tag":
+		return "#"
+	case "sfv":
+		return ";"
+	}
+	log.Fatal("-footer is only supported with hex, base64, tag, and sfv output")
+	return ""
+}
+
+func newFooterWriter(w io.Writer, comment string) *footerWriter {
+	return &footerWriter{w, sha256.New(), comment}
+}
+
+func (fw *footerWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	fw.h.Write(p[:n])
+	return n, err
+}
+
+func (fp footerPrinter) Print(r hashResult) {
+	fp.hp.Print(r)
+}
+
+func (fp footerPrinter) PrintWarning(w pathWarning) {
+	printWarning(fp.hp, w)
+}
+
+func (fp footerPrinter) Close() error {
+	if c, ok := fp.hp.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(fp.fw.w, "%s hashtree footer sha256=%x\n", fp.fw.comment, fp.fw.h.Sum(nil))
+	return err
+}
+
+// footerReader passes a text manifest through, checking its footer, if it
+// has one, and leaving it out. A manifest without a footer is an error with
+// -footer.
+type footerReader struct {
+	br    *bufio.Reader
+	h     hash.Hash
+	line  []byte // the rest of the line being read
+	found bool
+	err   error
+}
+
+func newFooterReader(br *bufio.Reader) *footerReader {
+	return &footerReader{br: br, h: sha256.New()}
+}
+
+// isFooter reports whether a line is a footer, in either comment style.
+func isFooter(line []byte) bool {
+	return bytes.HasPrefix(line, []byte("# hashtree footer ")) || bytes.HasPrefix(line, []byte("; hashtree footer "))
+}
+
+func (fr *footerReader) Read(p []byte) (int, error) {
+	for len(fr.line) == 0 {
+		if fr.err != nil {
+			return 0, fr.err
+		}
+		var line []byte
+		line, fr.err = fr.br.ReadBytes('\n')
+		if fr.err != nil && fr.err != io.EOF {
+			return 0, fr.err
+		}
+		switch {
+		case len(line) > 0 && fr.found:
+			fr.err = errors.New("manifest continues after its footer")
+		case isFooter(line):
+			fr.found = true
+			if err := fr.check(string(line)); err != nil {
+				fr.err = err
+			}
+		default:
+			fr.h.Write(line)
+			fr.line = line
+		}
+		if fr.err == io.EOF && !fr.found && *flagFooter {
+			fr.err = errors.New("manifest has no footer, so may be incomplete")
+		}
+	}
+	n := copy(p, fr.line)
+	fr.line = fr.line[n:]
+	return n, nil
+}
+
+// check compares the digest in a footer line with the manifest before it.
+func (fr *footerReader) check(line string) error {
+	fields := strings.Fields(line)
+	want := strings.TrimPrefix(fields[len(fields)-1], "sha256=")
+	if got := hex.EncodeToString(fr.h.Sum(nil)); got != want {
+		return errors.New("manifest doesn't match its footer, so it's corrupt or incomplete")
+	}
+	return nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Parts of the FUSE kernel protocol, from <linux/fuse.h>. Only what a
+// read-only filesystem needs is used.
+const (
+	fuseMajor    = 7
+	fuseMinor    = 31
+	fuseMinMinor = 12
+
+	// Kernels before 7.23 expect a shorter reply to INIT, without the fields
+	// from TimeGran on
+	fuseCompatInitMinor   = 23
+	fuseCompatInitOutSize = 24
+
+	fuseRootID = 1
+
+	fuseLookup      = 1
+	fuseForget      = 2
+	fuseGetattr     = 3
+	fuseOpen        = 14
+	fuseRead        = 15
+	fuseStatfs      = 17
+	fuseRelease     = 18
+	fuseFlush       = 25
+	fuseInit        = 26
+	fuseOpendir     = 27
+	fuseReaddir     = 28
+	fuseReleasedir  = 29
+	fuseAccess      = 34
+	fuseInterrupt   = 36
+	fuseDestroy     = 38
+	fuseBatchForget = 42
+
+	fuseAsyncRead = 1 << 0
+
+	// Requests are read into buffers big enough for the largest write,
+	// although writes are never made
+	fuseMaxWrite = 128 * 1024
+	fuseBufSize  = fuseMaxWrite + 4096
+)
+
+type fuseInHeader struct {
+	Len, Opcode          uint32
+	Unique, NodeID       uint64
+	UID, GID, PID        uint32
+	TotalExtlen, Padding uint16
+}
+
+type fuseOutHeader struct {
+	Len    uint32
+	Error  int32
+	Unique uint64
+}
+
+type fuseInitIn struct {
+	Major, Minor, MaxReadahead, Flags uint32
+}
+
+type fuseInitOut struct {
+	Major, Minor, MaxReadahead, Flags  uint32
+	MaxBackground, CongestionThreshold uint16
+	MaxWrite, TimeGran                 uint32
+	MaxPages, MapAlignment             uint16
+	Flags2                             uint32
+	Unused                             [7]uint32
+}
+
+type fuseAttr struct {
+	Ino, Size, Blocks, Atime, Mtime, Ctime                                uint64
+	Atimensec, Mtimensec, Ctimensec, Mode, Nlink, UID, GID, Rdev, Blksize uint32
+	Flags                                                                 uint32
+}
+
+type fuseEntryOut struct {
+	NodeID, Generation, EntryValid, AttrValid uint64
+	EntryValidNsec, AttrValidNsec             uint32
+	Attr                                      fuseAttr
+}
+
+type fuseAttrOut struct {
+	AttrValid            uint64
+	AttrValidNsec, Dummy uint32
+	Attr                 fuseAttr
+}
+
+type fuseOpenIn struct {
+	Flags, OpenFlags uint32
+}
+
+type fuseOpenOut struct {
+	Fh                 uint64
+	OpenFlags, Padding uint32
+}
+
+type fuseReadIn struct {
+	Fh, Offset      uint64
+	Size, ReadFlags uint32
+	LockOwner       uint64
+	Flags, Padding  uint32
+}
+
+type fuseReleaseIn struct {
+	Fh                  uint64
+	Flags, ReleaseFlags uint32
+	LockOwner           uint64
+}
+
+type fuseAccessIn struct {
+	Mask, Padding uint32
+}
+
+type fuseKstatfs struct {
+	Blocks, Bfree, Bavail, Files, Ffree uint64
+	Bsize, Namelen, Frsize, Padding     uint32
+	Spare                               [6]uint32
+}
+
+type fuseDirent struct {
+	Ino, Off      uint64
+	Namelen, Type uint32
+}
+
+// fuseBytes returns the bytes of a protocol struct, which are in the
+// machine's byte order, as the kernel expects.
+func fuseBytes(p unsafe.Pointer, size uintptr) []byte {
+	return (*[1 << 20]byte)(p)[:size:size]
+}
+
+// fuseRequest is a request from the kernel.
+type fuseRequest struct {
+	fuseInHeader
+	body []byte
+}
+
+// fuseConn is a connection to the kernel for a mounted filesystem.
+type fuseConn struct {
+	fd         int
+	mountpoint string
+	helper     string // the fusermount which mounted it, if it wasn't mounted directly
+}
+
+// fuseMount mounts a read-only FUSE filesystem. That needs root, or
+// CAP_SYS_ADMIN, so otherwise the setuid fusermount helper is used.
+func fuseMount(mountpoint string) (*fuseConn, error) {
+	fd, err := unix.Open("/dev/fuse", unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err == nil {
+		opts := fmt.Sprintf("fd=%d,rootmode=40000,user_id=%d,group_id=%d,default_permissions", fd, os.Getuid(), os.Getgid())
+		err = unix.Mount("hashtree", mountpoint, "fuse.hashtree", unix.MS_RDONLY|unix.MS_NOSUID|unix.MS_NODEV, opts)
+		if err == nil {
+			return &fuseConn{fd: fd, mountpoint: mountpoint}, nil
+		}
+		unix.Close(fd)
+	}
+	debugf("can't mount directly (%v), trying fusermount", err)
+	for _, name := range []string{"fusermount3", "fusermount"} {
+		if helper, lookErr := exec.LookPath(name); lookErr == nil {
+			return fuseMountHelper(helper, mountpoint)
+		}
+	}
+	return nil, fmt.Errorf("mounting %s: %w (and fusermount wasn't found)", mountpoint, err)
+}
+
+// fuseMountHelper mounts with fusermount, which passes back the /dev/fuse
+// file descriptor over a socket.
+func fuseMountHelper(helper, mountpoint string) (*fuseConn, error) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(fds[0])
+	theirs := os.NewFile(uintptr(fds[1]), "fusermount socket")
+	c := exec.Command(helper, "-o", "ro,nosuid,nodev,default_permissions,fsname=hashtree,subtype=hashtree", "--", mountpoint)
+	c.Env = append(os.Environ(), "_FUSE_COMMFD=3")
+	c.ExtraFiles = []*os.File{theirs}
+	c.Stderr = os.Stderr
+	err = c.Start()
+	theirs.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	oob := make([]byte, unix.CmsgSpace(4))
+	_, oobn, _, _, recvErr := unix.Recvmsg(fds[0], make([]byte, 1), oob, 0)
+	if err := c.Wait(); err != nil {
+		return nil, fmt.Errorf("%s: %w", helper, err)
+	}
+	if recvErr != nil {
+		return nil, fmt.Errorf("%s: %w", helper, recvErr)
+	}
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(msgs) == 0 {
+		return nil, fmt.Errorf("%s didn't pass back a connection", helper)
+	}
+	passed, err := unix.ParseUnixRights(&msgs[0])
+	if err != nil || len(passed) != 1 {
+		return nil, fmt.Errorf("%s didn't pass back a connection", helper)
+	}
+	unix.CloseOnExec(passed[0])
+	return &fuseConn{fd: passed[0], mountpoint: mountpoint, helper: helper}, nil
+}
+
+// unmount unmounts the filesystem, lazily, so that it's detached even while
+// it's in use. The kernel then ends the connection.
+func (c *fuseConn) unmount() error {
+	if c.helper != "" {
+		return exec.Command(c.helper, "-u", "-z", c.mountpoint).Run()
+	}
+	return unix.Unmount(c.mountpoint, unix.MNT_DETACH)
+}
+
+// read reads the next request. It returns nil, nil once the filesystem has
+// been unmounted.
+func (c *fuseConn) read(buf []byte) (*fuseRequest, error) {
+	for {
+		n, err := unix.Read(c.fd, buf)
+		switch {
+		case err == unix.EINTR || err == unix.EAGAIN || err == unix.ENOENT:
+			// ENOENT is a request which was interrupted before it was read
+			continue
+		case err == unix.ENODEV:
+			return nil, nil
+		case err != nil:
+			return nil, err
+		case n < int(unsafe.Sizeof(fuseInHeader{})):
+			return nil, errors.New("short FUSE request")
+		}
+		req := &fuseRequest{fuseInHeader: *(*fuseInHeader)(unsafe.Pointer(&buf[0]))}
+		req.body = append([]byte(nil), buf[unsafe.Sizeof(fuseInHeader{}):n]...)
+		return req, nil
+	}
+}
+
+// reply answers a request, with an error, or with the given data.
+func (c *fuseConn) reply(req *fuseRequest, errno unix.Errno, data []byte) {
+	out := fuseOutHeader{Unique: req.Unique, Error: -int32(errno)}
+	if errno != 0 {
+		data = nil
+	}
+	out.Len = uint32(unsafe.Sizeof(out)) + uint32(len(data))
+	msg := append(fuseBytes(unsafe.Pointer(&out), unsafe.Sizeof(out)), data...)
+	if _, err := unix.Write(c.fd, msg); err != nil && err != unix.ENOENT {
+		// ENOENT is a request which was interrupted while it was handled
+		debugf("FUSE reply to request %d: %v", req.Unique, err)
+	}
+}
+
+func (c *fuseConn) close() {
+	unix.Close(c.fd)
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Decisions made by gate.
+const (
+	gateAccepted = "ACCEPTED"
+	gateRejected = "REJECTED"
+	gateUnknown  = "UNKNOWN"
+)
+
+// checkGate validates the options for gate, which are only allowed with it.
+func checkGate(cmd string) {
+	if cmd != "gate" {
+		for _, name := range []string{"allow-hashes", "deny-hashes", "accept-dir", "reject-dir", "settle"} {
+			if flagWasSet(name) {
+				log.Fatalf("-%s can only be used with gate", name)
+			}
+		}
+		return
+	}
+	switch {
+	case *flagAllowHashes == "" && *flagDenyHashes == "":
+		log.Fatal("gate requires -allow-hashes or -deny-hashes")
+	case *flagCheck != "":
+		log.Fatal("-check cannot be used with gate")
+	case *flagKnownHashes != "":
+		log.Fatal("-known-hashes cannot be used with gate; use -allow-hashes")
+	case *flagPathCase != "none" || *flagNormalizePaths != "none":
+		log.Fatal("-path-case and -normalize-paths cannot be used with gate")
+	case *flagSettle < 0:
+		log.Fatal("-settle must not be negative")
+	}
+}
+
+// gate watches an incoming directory, and hashes each new file once it has
+// stopped changing for -settle. Files whose hash is in the -deny-hashes set
+// are rejected, and files whose hash is in the -allow-hashes set (or isn't
+// denied, if there is no allow set) are accepted. Other files are left where
+// they are. Accepted and rejected files are moved to -accept-dir and
+// -reject-dir, if they're given.
+//
+// The gate is both the source of tasks and the printer for their results.
+type gate struct {
+	w     io.Writer
+	json  bool
+	root  string
+	fs    fs.FS
+	skip  map[string]bool // directories not to look in
+	allow map[string]bool
+	deny  map[string]bool
+
+	mu    sync.Mutex
+	files map[string]*gateFile
+}
+
+// gateFile is a file seen in the incoming directory.
+type gateFile struct {
+	size  int64
+	mtime time.Time
+	since time.Time // when the size and mtime were first seen
+	state int
+}
+
+// States of a gateFile.
+const (
+	gateSettling = iota
+	gateHashing
+	gateDone
+)
+
+func newGate(incoming string, w io.Writer) *gate {
+	g := &gate{
+		w:     w,
+		json:  strings.HasPrefix(*flagFmt, "json"),
+		root:  resolveRoot(incoming),
+		skip:  make(map[string]bool),
+		files: make(map[string]*gateFile),
+	}
+	g.fs = openRoot(g.root)
+	if *flagAllowHashes != "" {
+		g.allow = loadHashSet(*flagAllowHashes)
+	}
+	if *flagDenyHashes != "" {
+		g.deny = loadHashSet(*flagDenyHashes)
+	}
+
+	// Don't pick up files again once they're moved, if the accept or reject
+	// directory is inside the incoming directory.
+	base, err := filepath.Abs(incoming)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, dir := range []string{*flagAcceptDir, *flagRejectDir} {
+		if dir == "" {
+			continue
+		}
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rel, err := filepath.Rel(base, abs)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if rel == "." {
+			log.Fatalf("%s is the incoming directory", dir)
+		}
+		g.skip[filepath.ToSlash(rel)] = true
+	}
+	return g
+}
+
+// feed scans the incoming directory forever, queueing files for hashing as
+// they settle.
+func (g *gate) feed(tasks chan<- hashTask) {
+	interval := *flagSettle / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	for {
+		for _, p := range g.scan() {
+			tasks <- hashTask{root: g.root, path: p, fs: g.fs}
+		}
+		time.Sleep(interval)
+	}
+}
+
+// scan looks for new and changed files, and returns the files which are ready
+// to be hashed.
+func (g *gate) scan() []string {
+	seen := make(map[string]fs.FileInfo)
+	err := fs.WalkDir(g.fs, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == "." {
+				return err
+			}
+			debugf("%s: %v", p, err)
+			return nil
+		}
+		if d.IsDir() && g.skip[p] {
+			return fs.SkipDir
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		if fi, err := d.Info(); err == nil {
+			seen[p] = fi
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	now := time.Now()
+	var ready []string
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for p := range g.files {
+		if seen[p] == nil {
+			delete(g.files, p)
+		}
+	}
+	for p, fi := range seen {
+		f := g.files[p]
+		if f == nil || f.size != fi.Size() || !f.mtime.Equal(fi.ModTime()) {
+			g.files[p] = &gateFile{size: fi.Size(), mtime: fi.ModTime(), since: now}
+		} else if f.state == gateSettling && now.Sub(f.since) >= *flagSettle {
+			f.state = gateHashing
+			ready = append(ready, p)
+		}
+	}
+	return ready
+}
+
+// hashed marks a file as done, and reports whether it's unchanged since it
+// was queued. A file which changed while it was being hashed will settle and
+// be hashed again.
+func (g *gate) hashed(p string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	f := g.files[p]
+	if f == nil {
+		return false
+	}
+	fi, err := fs.Stat(g.fs, p)
+	if err != nil {
+		delete(g.files, p)
+		return false
+	}
+	if fi.Size() != f.size || !fi.ModTime().Equal(f.mtime) {
+		g.files[p] = &gateFile{size: fi.Size(), mtime: fi.ModTime(), since: time.Now()}
+		return false
+	}
+	f.state = gateDone
+	return true
+}
+
+func (g *gate) Print(r hashResult) {
+	if !g.hashed(r.path) {
+		return
+	}
+	a := alert{Path: r.path, Hash: hex.EncodeToString(r.hash)}
+	var dir string
+	switch {
+	case g.deny[string(r.hash)]:
+		a.Status, dir = gateRejected, *flagRejectDir
+	case g.allow == nil || g.allow[string(r.hash)]:
+		a.Status, dir = gateAccepted, *flagAcceptDir
+	default:
+		a.Status = gateUnknown
+	}
+	if dir != "" {
+		dest, err := g.move(r.path, dir)
+		if err != nil {
+			a.Error = err.Error()
+		} else {
+			a.MovedTo = dest
+		}
+	}
+	g.report(a)
+}
+
+func (g *gate) PrintError(r hashResult) {
+	if errors.Is(r.err, fs.ErrNotExist) || !g.hashed(r.path) {
+		return
+	}
+	g.report(alert{Path: r.path, Status: statusFailed, Error: r.err.Error()})
+}
+
+func (g *gate) report(a alert) {
+	a.Time = time.Now().UTC()
+	if a.Status != gateAccepted {
+		notifyMismatch(a)
+	}
+	printAlert(g.w, g.json, a)
+}
+
+// move moves a file from the incoming directory to the same path under dir.
+// Existing files are never replaced.
+func (g *gate) move(p, dir string) (string, error) {
+	src := hashTask{root: g.root, path: p}.osPath()
+	dest := filepath.Join(dir, filepath.FromSlash(p))
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return "", err
+	}
+	if _, err := os.Lstat(dest); err == nil {
+		return "", fmt.Errorf("%s already exists", dest)
+	}
+	if err := os.Rename(src, dest); err != nil {
+		return "", err
+	}
+	return dest, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"strings"
+)
+
+// hashRule is a -hash-for rule, which selects the hash function for the
+// files whose paths match a glob.
+type hashRule struct {
+	glob []string // segments, as for :(glob) pathspecs
+	base bool     // if the glob has no slashes, and matches the file's name
+	algo string
+}
+
+var hashRules []hashRule
+
+// checkHashFor validates and parses -hash-for.
+func checkHashFor(cmd string) {
+	if len(*flagHashFor) == 0 {
+		return
+	}
+	if cmd != "" {
+		log.Fatal("-hash-for cannot be used with subcommands")
+	}
+	switch *flagFmt {
+	case "sfv", "binary":
+		log.Fatalf("-hash-for cannot be used with -fmt %s, which has one hash function for every file", *flagFmt)
+	}
+	for _, rule := range *flagHashFor {
+		r, err := parseHashRule(rule)
+		if err != nil {
+			log.Fatalf("-hash-for %v", err)
+		}
+		if *flagFmt == "tag" {
+			if _, ok := bsdTags[r.algo]; !ok {
+				log.Fatalf("-hash-for %q: no BSD-style name for %s", rule, r.algo)
+			}
+		}
+		hashRules = append(hashRules, r)
+	}
+}
+
+// parseHashRule parses a glob=algo rule, as given to -hash-for, or recorded
+// in a manifest's -header.
+func parseHashRule(rule string) (hashRule, error) {
+	i := strings.LastIndexByte(rule, '=')
+	if i <= 0 || i == len(rule)-1 {
+		return hashRule{}, fmt.Errorf("%q: expected glob=algo", rule)
+	}
+	glob, algo := strings.Trim(rule[:i], "/"), rule[i+1:]
+	r := hashRule{base: !strings.Contains(glob, "/"), algo: algo}
+	for _, seg := range strings.Split(glob, "/") {
+		if seg == "" || seg == "." {
+			continue
+		}
+		if _, err := path.Match(seg, ""); err != nil {
+			return hashRule{}, fmt.Errorf("%q: %v", rule, err)
+		}
+		r.glob = append(r.glob, seg)
+	}
+	if len(r.glob) == 0 {
+		return hashRule{}, fmt.Errorf("%q: empty glob", rule)
+	}
+	return r, nil
+}
+
+// ruleAlgo returns the hash algorithm selected for a file by the first
+// -hash-for rule which matches it, or "" if none do.
+func ruleAlgo(p string) string {
+	return matchHashRules(hashRules, p)
+}
+
+// matchHashRules returns the algorithm of the first rule which matches a
+// path, or "" if none do.
+func matchHashRules(rules []hashRule, p string) string {
+	if rules == nil {
+		return ""
+	}
+	segs := strings.Split(p, "/")
+	for _, r := range rules {
+		if r.base && globSegments(r.glob, segs[len(segs)-1:]) || globSegments(r.glob, segs) {
+			return r.algo
+		}
+	}
+	return ""
+}
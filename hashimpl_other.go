@@ -0,0 +1,30 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+)
+
+// reexec runs exe with the same arguments in the given environment, and
+// exits with its status. The process can't be replaced, so this one waits
+// for it, leaving interrupts for it to handle.
+func reexec(exe string, env []string) {
+	c := exec.Command(exe, os.Args[1:]...)
+	c.Env = env
+	c.Stdin, c.Stdout, c.Stderr = os.Stdin, os.Stdout, os.Stderr
+	signal.Ignore(os.Interrupt)
+	err := c.Run()
+	var ee *exec.ExitError
+	if errors.As(err, &ee) {
+		os.Exit(ee.ExitCode())
+	} else if err != nil {
+		log.Fatalf("-hash-impl: %v", err)
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,17 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package main
+
+import (
+	"log"
+	"os"
+	"syscall"
+)
+
+// reexec replaces the process with exe, run with the same arguments in the
+// given environment.
+func reexec(exe string, env []string) {
+	err := syscall.Exec(exe, os.Args, env)
+	log.Fatalf("-hash-impl: %v", err)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// registeredHashes holds the hash functions added with registerHash.
+var registeredHashes = make(map[string]hashFactory)
+
+// registerHash adds a hash function which can be selected with -hash. It's
+// meant to be called from an init function in a separate file added to the
+// build, so that proprietary or niche hash functions can be supported
+// without changing hashtree itself. Registered hash functions can't be
+// keyed, and can't replace the built-in ones.
+func registerHash(name string, hf hashFactory) {
+	if _, ok := registeredHashes[name]; ok {
+		panic("hash function " + name + " registered twice")
+	}
+	registeredHashes[name] = hf
+}
+
+// hashFinisher is implemented by hashes which can fail to produce a digest,
+// such as external commands. Finish is called before Sum.
+type hashFinisher interface {
+	Finish() error
+}
+
+// sumHash returns the digest of h, or an error if h failed.
+func sumHash(h hash.Hash) ([]byte, error) {
+	if f, ok := h.(hashFinisher); ok {
+		if err := f.Finish(); err != nil {
+			return nil, err
+		}
+	}
+	return h.Sum(nil), nil
+}
+
+// execHashFactory returns a hashFactory for -hash exec:<command>. The
+// command is run using the shell for each file, with the file's contents on
+// standard input, and must print the digest in hex on standard output. Only
+// the first word of the output is used, so the output of tools like
+// "b3sum" or "xxhsum" can be used as is.
+func execHashFactory(command string) hashFactory {
+	return func() hash.Hash {
+		return &execHash{command: command}
+	}
+}
+
+// execHash is a hash.Hash which pipes its input to an external command. The
+// command is started on the first write, and waited for by Finish or Sum.
+type execHash struct {
+	command string
+
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout bytes.Buffer
+	sum    []byte
+	err    error
+}
+
+func (h *execHash) start() {
+	h.cmd = shellCommand(h.command)
+	h.cmd.Stdout = &h.stdout
+	h.cmd.Stderr = os.Stderr
+	if h.stdin, h.err = h.cmd.StdinPipe(); h.err == nil {
+		h.err = h.cmd.Start()
+	}
+}
+
+func (h *execHash) Write(p []byte) (int, error) {
+	if h.cmd == nil {
+		h.start()
+	}
+	if h.err != nil {
+		return 0, h.err
+	}
+	n, err := h.stdin.Write(p)
+	if err != nil {
+		// The command most likely exited early, which is a better reason
+		h.stdin.Close()
+		if werr := h.cmd.Wait(); werr != nil {
+			err = werr
+		}
+		h.err = fmt.Errorf("hash command: %w", err)
+	}
+	return n, h.err
+}
+
+func (h *execHash) Finish() error {
+	if h.sum != nil || h.err != nil {
+		return h.err
+	}
+	if h.cmd == nil {
+		h.start()
+		if h.err != nil {
+			return h.err
+		}
+	}
+	h.stdin.Close()
+	if err := h.cmd.Wait(); err != nil {
+		h.err = fmt.Errorf("hash command: %w", err)
+		return h.err
+	}
+	fields := strings.Fields(h.stdout.String())
+	if len(fields) == 0 {
+		h.err = errors.New("hash command printed no digest")
+		return h.err
+	}
+	if h.sum, h.err = hex.DecodeString(fields[0]); h.err != nil {
+		h.err = fmt.Errorf("hash command printed an invalid digest %q", fields[0])
+	}
+	return h.err
+}
+
+// Sum returns the command's digest, or nothing if it failed; callers should
+// use sumHash to find out why.
+func (h *execHash) Sum(b []byte) []byte {
+	h.Finish()
+	return append(b, h.sum...)
+}
+
+func (h *execHash) Reset() {
+	if h.cmd != nil && h.sum == nil && h.err == nil {
+		h.stdin.Close()
+		h.cmd.Process.Kill()
+		h.cmd.Wait()
+	}
+	*h = execHash{command: h.command}
+}
+
+// Size returns the length of the digest, which is only known once the
+// command has finished.
+func (h *execHash) Size() int { return len(h.sum) }
+
+func (h *execHash) BlockSize() int { return 1 }
@@ -1,56 +1,232 @@
 package main
 
 import (
+	"context"
 	"crypto/md5"
 	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/sha512"
-	"encoding/base64"
 	"encoding/hex"
-	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"hash"
+	"hash/adler32"
 	"hash/crc32"
 	"io"
 	"io/fs"
 	"log"
 	"os"
+	"path/filepath"
 	"runtime"
+	"runtime/trace"
+	"strings"
 	"sync"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/ripemd160"
 )
 
-var flagHash = flag.String("hash", "sha256", "hash function to use (crc32, md5, sha1, sha224, sha256, sha512)")
-var flagJobs = flag.Int("jobs", 0, "number of hash jobs to run (default 1 per CPU core)")
-var flagFmt = flag.String("fmt", "text", "output format (options: hex, base64, json, json-base64)")
+var flagHash = flag.String("hash", "sha256", "hash function to use (adler32, blake2b-256, blake2b-512, blake2s, crc32, md5, ripemd160, sha1, sha224, sha256, sha512, whirlpool), or exec:<command> to run a command which prints a hex digest of its input")
+var flagKey = flag.String("key", "", "hex-encoded key for keyed hashing (blake2 hashes only)")
+var flagHashFor = stringListFlag("hash-for", "hash files matching a glob with another hash function, as glob=algo (may be repeated; the first match wins)")
+var flagHashImpl = flag.String("hash-impl", "auto", "hash implementations to use: auto, which uses the CPU's hashing instructions where available, or generic, which never does")
+var flagJobs = flag.String("jobs", "", "number of hash jobs to run, or auto to adjust dynamically for best throughput (default 1 per CPU core)")
+var flagFmt = flag.String("fmt", "hex", "output format (options: hex, base64, json, json-base64, json-array, json-array-base64, by-hash, tag, sfv, binary)")
+var flagOut = outputSpecsFlag("out", "write output in the given format to a file, as format=path (may be repeated; path - is stdout)")
+var flagTag = flag.Bool("tag", false, "print BSD-style \"ALGO (path) = hash\" lines (same as -fmt tag)")
+var flagPretty = flag.Bool("pretty", false, "pretty-print JSON array output")
+var flagJSONPathB64 = flag.Bool("json-path-b64", false, "in JSON output, give the raw bytes of paths which aren't valid UTF-8 in a path_b64 key")
+var flagHeader = flag.Bool("header", false, "begin hex and base64 output with a comment recording the hash function, roots and time")
+var flagFooter = flag.Bool("footer", false, "end text output with a comment holding the SHA-256 of the output before it; in check mode, require the manifest to have one")
+var flagRetries = flag.Int("retries", 0, "number of times to retry a file after a read error")
+var flagRetryDelay = flag.Duration("retry-delay", time.Second, "delay between retries")
+var flagVerifyWrite = flag.Bool("verify-write", false, "re-read each file after hashing it, and fail it if the hash differs")
+var flagDropCache = flag.Bool("drop-cache", false, "with -verify-write, drop each file from the page cache before re-reading it (Linux only)")
+var flagSkipLocked = flag.Bool("skip-locked", false, "skip files which are locked by another process, with a warning, rather than failing them")
+var flagWaitLocked = flag.Duration("wait-locked", 0, "wait up to this long for files which are locked by another process to be unlocked")
+var flagLimitRate = byteSizeFlag("limit-rate", 0, "maximum total read rate in bytes per second, with optional K/M/G/T suffix (default unlimited)")
+var flagLimitIOPS = flag.Int("limit-iops", 0, "maximum total file opens and reads per second (default unlimited)")
+var flagChunks = byteSizeFlag("chunks", 0, "also hash each file in chunks of this size, with optional K/M/G/T suffix (JSON and -stream output only)")
+var flagNice = flag.Int("nice", 0, "lower the CPU priority of hash jobs by this niceness (0-19)")
+var flagIonice = flag.String("ionice", "", "I/O scheduling class for hash jobs (idle, best-effort[:level]); Linux only")
+var flagShard = flag.String("shard", "", "only hash files in shard i of n (given as i/n), partitioned by a hash of their path")
+var flagDigestCovers = flag.String("digest-covers", "", "make each file's digest also cover its path, and optionally mode and mtime (path[,mode][,mtime])")
+var flagWalkBatch = flag.Int("walk-batch", 0, "read directories in batches of this many entries, to bound memory on huge directories (default whole directories, sorted)")
+var flagDryRun = flag.Bool("dry-run", false, "walk the tree without hashing, and report the number and size of files which would be hashed")
+var flagVerbose = flag.Bool("v", false, "verbose output")
+var flagPprof = flag.String("pprof", "", "serve net/http/pprof profiles on this address (e.g. localhost:6060)")
+var flagTrace = flag.String("trace", "", "write a runtime execution trace to this file")
+var flagXattr = flag.String("xattr", "", "store hashes in extended attributes (write), or verify files against them (verify)")
+var flagPathCase = flag.String("path-case", "none", "normalize the case of output paths (none, lower, upper)")
+var flagNormalizePaths = flag.String("normalize-paths", "none", "Unicode normalization form for output paths (nfc, nfd, none)")
+var flagADS = flag.Bool("ads", false, "also hash NTFS alternate data streams, as file:stream (Windows only)")
+var flagCheck = flag.String("check", "", "verify files against a manifest, instead of printing hashes")
+var flagQuiet = flag.Bool("quiet", false, "in check mode, don't print OK for files which verify")
+var flagStatus = flag.Bool("status", false, "in check mode, print nothing, and report the outcome only in the exit status")
+var flagIgnoreMissing = flag.Bool("ignore-missing", false, "in check mode, don't fail or report status for missing files")
+var flagStrict = flag.Bool("strict", false, "in check mode, also report files which are not listed in the manifest")
+var flagCASLink = flag.String("cas-link", "copy", "how export-cas places files in the store (copy, hardlink, reflink)")
+var flagOutput = flag.String("o", "", "file to write the manifest to (merge and cat only; default stdout)")
+var flagConflict = flag.String("conflict", "error", "how merge resolves differing hashes for the same path (error, newest)")
+var flagOnMismatchExec = flag.String("on-mismatch-exec", "", "in check, watch, and gate modes, shell command to run for each file which fails verification or isn't accepted")
+var flagWebhook = flag.String("webhook", "", "in check, watch, and gate modes, URL to POST to for each file which fails verification or isn't accepted")
+var flagCycle = flag.Duration("cycle", 7*24*time.Hour, "how long watch takes to re-verify every file once")
+var flagAllowHashes = flag.String("allow-hashes", "", "file of hashes (NSRL RDS, digest list, or manifest) which gate accepts")
+var flagDenyHashes = flag.String("deny-hashes", "", "file of hashes (NSRL RDS, digest list, or manifest) which gate rejects")
+var flagAcceptDir = flag.String("accept-dir", "", "directory gate moves accepted files to")
+var flagRejectDir = flag.String("reject-dir", "", "directory gate moves rejected files to")
+var flagSettle = flag.Duration("settle", 30*time.Second, "how long a file's size and mtime must be unchanged before gate hashes it")
+var flagKnownHashes = flag.String("known-hashes", "", "file of known hashes (NSRL RDS, digest list, or manifest) to leave out of the output")
+var flagKnownAction = flag.String("known-action", "suppress", "what to do with files in -known-hashes (suppress, or flag them in JSON output)")
+var flagFollowSymlinks = flag.Bool("follow-symlinks", false, "follow symlinks, hashing each file only once")
+var flagArchives = flag.Bool("archives", false, "hash each file in zip, tar, 7z, and rar archives, instead of the archive itself")
+var flagSort = flag.Bool("sort", false, "sort output by path")
+var flagCanonical = flag.Bool("canonical", false, "write a manifest which is byte-for-byte the same for identical trees on any platform (implies -sort)")
+var flagSortMem = byteSizeFlag("sort-mem", 256<<20, "memory to use for -sort before spilling to temporary files, with optional K/M/G/T suffix")
+var flagGCPercent = flag.Int("gc-percent", 100, "garbage collection target, as for GOGC, or -1 to collect only as needed for -memory-limit")
+var flagMemoryLimit = byteSizeFlag("memory-limit", 0, "soft limit on the heap, with optional K/M/G/T suffix, which makes garbage collection more frequent as it's approached (also lowers the default -sort-mem to a quarter of it)")
+var flagBallast = byteSizeFlag("ballast", 0, "allocate an untouched heap ballast of this size, with optional K/M/G/T suffix, so that garbage collection runs less often on small heaps")
+var flagClones = flag.Bool("clones", false, "reuse the hash of files whose extents are all shared with an already hashed file, such as reflinked copies (Linux only)")
+var flagJournal = flag.String("journal", "", "record each file in this journal as it's hashed, so an interrupted run can be resumed")
+var flagTombstones = flag.String("tombstones", "", "also report each file in this previous manifest which wasn't found, as a deleted record with its last hash (JSON output or -stream only)")
+var flagResume = flag.String("resume", "", "resume an interrupted run from its -journal, only hashing files which weren't completed or have changed")
+var flagOCIFiles = flag.String("oci-files", "", "in oci-verify, also check uncompressed layers against their diff IDs, and write the hash of each file in them to this file (- for stdout)")
+var flagURLs = flag.String("urls", "", "also hash the bodies of the HTTP(S) URLs listed in this file (- for stdin), one per line, each optionally followed by tab-separated headers")
+var flagHTTPHeader = httpHeadersFlag("http-header", "header to send with every -urls request, as \"Name: value\" (may be repeated)")
+var flagTar = flag.String("tar", "", "also hash each file in a tar stream read from this file (- for stdin), optionally gzip or zstd compressed")
+var flagTimings = flag.Bool("timings", false, "record the size of each file, the time taken to hash it, and the worker which hashed it (JSON and -stream output only)")
+var flagLabelRoots = flag.Bool("label-roots", false, "prefix each path with a label for its root, which is the path given on the command line unless -root-label is used")
+var flagRootLabel = stringListFlag("root-label", "label for the paths under each root, in order (may be repeated; implies -label-roots)")
+var flagMIME = flag.Bool("mime", false, "detect the media type of each file from its first bytes (JSON and -stream output only)")
+var flagEntropy = flag.Bool("entropy", false, "compute the Shannon entropy of each file, in bits per byte (JSON and -stream output only)")
+var flagStat = flag.Bool("stat", false, "record the size and modification time of each file, for -assume-unchanged-within (JSON and -stream output only)")
+var flagAssumeUnchanged = flag.Duration("assume-unchanged-within", 0, "in check mode, don't read files whose size matches the manifest's, and whose modification time is within this long of it")
+var flagChainLog = flag.String("chain-log", "", "append every result to this tamper-evident log, where each record includes the digest of the one before it")
+var flagPublish = flag.String("publish", "", "also publish each result to this kafka://broker/topic or nats://host/subject")
+var flagEncryptTo = stringListFlag("encrypt-to", "encrypt output manifests to this age recipient, or the recipients in this file (may be repeated)")
+var flagIdentity = stringListFlag("identity", "decrypt manifests with the age identities in this file (may be repeated)")
+var flagPassphraseEnv = flag.String("passphrase-env", "", "encrypt output manifests and decrypt manifests with the passphrase in this environment variable")
+var flagTUI = flag.Bool("tui", false, "show a full-screen display of each job's progress, throughput, and errors on the terminal")
+var flagSmallFiles = byteSizeFlag("small-files", 64<<10, "read files up to this size whole, with optional K/M/G/T suffix, to hash them with fewer reads (0 to disable)")
+var flagIO = flag.String("io", "std", "how files are read: std, or uring to batch reads with io_uring (Linux only)")
+var flagCollisions = flag.Bool("collisions", false, "warn about paths which would collide on a case-insensitive filesystem, or one which normalizes Unicode")
+var flagSample = flag.String("sample", "", "in check mode, verify only a random sample of this many files, or this percentage of them, like 5%")
+var flagSampleBytes = byteSizeFlag("sample-bytes", 0, "in check mode, verify only a random sample of files totalling this size, with optional K/M/G/T suffix")
+var flagSampleSeed = flag.Int64("sample-seed", 0, "seed for choosing the files to verify with -sample or -sample-bytes (default random)")
+var flagLogLevel = flag.String("log-level", "info", "lowest level of message to log: debug, info, warn, or error")
+var flagLogFormat = flag.String("log-format", "text", "format of log messages: text, or json for one JSON object per line")
+var flagStats = flag.String("stats", "", "write a report of the number and size of files hashed, by root, top-level directory, and extension, to this file")
+var flagStatsFormat = flag.String("stats-format", "text", "format of the -stats report: text or json")
+var flagProvenance = flag.String("provenance", "", "write a JSON record of the run, with the host, version, flags, roots, times, counts, and tree digest, to this file, or \"trailer\" to end JSON lines output with it")
+var flagMaxErrors = flag.Int("max-errors", 0, "abort the run once this many files couldn't be read, instead of at the first error (or never, in check mode and with -stream)")
+var flagSidecar = flag.String("sidecar", "", "write a SHA256SUMS-style file into each directory (write), or verify files against them (verify)")
+var flagUID = stringListFlag("uid", "only hash files owned by this user ID (may be repeated)")
+var flagGID = stringListFlag("gid", "only hash files whose group is this group ID or name (may be repeated)")
+var flagOwner = stringListFlag("owner", "only hash files owned by this user name (may be repeated)")
+var flagSnapshot = flag.String("snapshot", "", "read each root from a snapshot taken for the run (vss, btrfs, zfs, or exec:<command>)")
+var flagStream = flag.String("stream", "", "stream results as protobuf messages to a socket (unix:<path> or tcp:<host:port>) instead of stdout")
 
 type hashTask struct {
+	root string
 	path string
 	fs   fs.FS
+
+	// prefix is the label of the root path starts with, for -label-roots.
+	prefix string
 }
 
-type hashResult struct {
-	path string
-	hash []byte
+// osPath returns the path to the file in the native OS format.
+func (t hashTask) osPath() string {
+	return t.root + string(filepath.Separator) + filepath.FromSlash(strings.TrimPrefix(t.path, t.prefix))
 }
 
-type hashFactory func() hash.Hash
+type hashResult struct {
+	path    string
+	hash    []byte
+	size    int64
+	chunks  [][]byte
+	retries int
+	known   bool
+	status  string
+
+	// symlinkOf is the path a file was first seen at, if it was reached
+	// again through a symlink with -follow-symlinks.
+	symlinkOf string
+
+	// cloneOf is the path of a file with the same extents, whose hash was
+	// reused with -clones.
+	cloneOf string
 
-type hashPrinter interface {
-	Print(hashResult)
+	// mtime is the file's modification time from before it was hashed,
+	// for -stat.
+	mtime time.Time
+
+	// mime is the media type detected from the file's contents, for -mime.
+	mime string
+
+	// entropy is the Shannon entropy of the file's contents, for -entropy.
+	entropy *float64
+
+	// algo is the hash algorithm, if it isn't -hash, for results from
+	// manifests with more than one, or files selected by -hash-for.
+	algo string
+
+	// wasLocked is set if the file was locked by another process, and was
+	// hashed once it was unlocked, for -wait-locked.
+	wasLocked bool
+
+	// timing is how long the file took to hash, for -timings.
+	timing *resultTiming
+
+	// root is the root the file was found under, as in hashTask, for
+	// -stats.
+	root string
+
+	err error
 }
 
-type jsonResult struct {
-	Path string `json:"path"`
-	Hash string `json:"hash"`
+// resultTiming records how long a file took to hash, including any retries,
+// and which worker hashed it.
+type resultTiming struct {
+	Worker   int
+	Duration time.Duration
 }
 
-func hashByName(name string) hashFactory {
+type hashFactory func() hash.Hash
+
+func hashByName(name string, key []byte) hashFactory {
+	switch name {
+	case "blake2b-256":
+		return keyedHash(blake2b.New256, key)
+	case "blake2b-512":
+		return keyedHash(blake2b.New512, key)
+	case "blake2s", "blake2s-256":
+		return keyedHash(blake2s.New256, key)
+	}
+
+	if len(key) > 0 {
+		log.Fatal("-key is only supported with blake2 hash functions")
+	}
+
+	if strings.HasPrefix(name, "exec:") {
+		return execHashFactory(name[len("exec:"):])
+	}
+	if hf, ok := registeredHashes[name]; ok {
+		return hf
+	}
+
 	switch name {
+	case "adler32":
+		return func() hash.Hash { return adler32.New() }
 	case "crc32":
 		return func() hash.Hash { return crc32.New(crc32.IEEETable) }
 	case "md5":
 		return md5.New
+	case "ripemd160":
+		return ripemd160.New
 	case "sha1":
 		return sha1.New
 	case "sha224":
@@ -59,140 +235,958 @@ func hashByName(name string) hashFactory {
 		return sha256.New
 	case "sha512":
 		return sha512.New
+	case "whirlpool":
+		return newWhirlpool
 	default:
 		log.Fatal("hash function not supported")
 		return nil
 	}
 }
 
-func hasher(hf hashFactory, tasks <-chan hashTask, results chan<- hashResult) {
+// keyedHash turns a BLAKE2 constructor into a hashFactory. The constructor
+// only fails if the key is too long, so that is checked once up front.
+func keyedHash(newHash func([]byte) (hash.Hash, error), key []byte) hashFactory {
+	if _, err := newHash(key); err != nil {
+		log.Fatal(err)
+	}
+	return func() hash.Hash {
+		h, _ := newHash(key)
+		return h
+	}
+}
+
+// hasher hashes files from tasks until it is closed, or until a value is
+// received on quit. id identifies the worker, for -timings.
+func hasher(id int, hf hashFactory, tasks <-chan hashTask, results chan<- hashResult, quit <-chan struct{}) {
 	buf := make([]byte, 1024*1024)
 
-	for task := range tasks {
-		f, err := task.fs.Open(task.path)
-		if err != nil {
-			log.Fatal(err)
+	for {
+		var task hashTask
+		select {
+		case <-quit:
+			return
+		case t, ok := <-tasks:
+			if !ok {
+				return
+			}
+			task = t
 		}
 
-		h := hf()
-		io.CopyBuffer(h, f, buf)
-		results <- hashResult{task.path, h.Sum(nil)}
+		if unchangedEntries != nil && assumeUnchanged(task) {
+			results <- hashResult{path: task.path, status: statusUnchanged}
+			continue
+		}
+
+		var fi fs.FileInfo
+		var err error
+		if *flagXattr != "" || theJournal != nil || *flagStat || coverMode || coverMtime {
+			// Stat before hashing, so that the stored mtime can't be newer
+			// than the contents which were hashed.
+			if fi, err = fs.Stat(task.fs, task.path); err != nil {
+				results <- hashResult{path: task.path, err: err}
+				continue
+			}
+		}
+
+		taskHF := coverFile(hashFor(hf, task.path), task.path, fi)
+		if *flagArchives && archiveFormatFor(task.path) != nil {
+			trace.WithRegion(context.Background(), "hash", func() {
+				hashArchive(taskHF, task, buf, results)
+			})
+			continue
+		}
+
+		theTUI.begin(id, task.path)
+		var r hashResult
+		start := time.Now()
+		trace.WithRegion(context.Background(), "hash", func() {
+			r = hashUnlocked(taskHF, task, buf)
+		})
+		theTUI.end(id)
+		r.root, r.algo = task.root, algoFor(task.path)
+		if *flagTimings {
+			r.timing = &resultTiming{id, time.Since(start)}
+		}
+		if r.err == nil && *flagStat {
+			r.mtime = fi.ModTime()
+		}
+		if r.err == nil && *flagXattr != "" {
+			applyXattr(task, fi, &r)
+		}
+		if r.err == nil && casDir != "" {
+			r.err = exportCAS(taskHF, task, r.hash, buf)
+		}
+		if r.err == nil && theJournal != nil {
+			theJournal.record(task, fi, r)
+		}
+		results <- r
+	}
+}
 
-		f.Close()
+func hashWithRetries(hf hashFactory, task hashTask, buf []byte) hashResult {
+	for retries := 0; ; retries++ {
+		r := hashFile(hf, task, buf)
+		r.retries = retries
+		if r.err == nil || retries >= *flagRetries || !isRetryable(r.err) {
+			return r
+		}
+		time.Sleep(*flagRetryDelay)
 	}
 }
 
-// hexHashPrinter prints hashes in the classic "hexhash <spc><spc> filename" format.
-type hexHashPrinter struct{}
+func hashFile(hf hashFactory, task hashTask, buf []byte) hashResult {
+	r := hashResult{path: task.path}
 
-func (hp hexHashPrinter) Print(r hashResult) {
-	fmt.Printf("%s  %s\n", hex.EncodeToString(r.hash), r.path)
+	iopsLimiter.wait(1)
+	f, err := task.fs.Open(task.path)
+	if err != nil {
+		r.err = checkLocked(task.path, nil, err)
+		return r
+	}
+	defer f.Close()
+	if r.err = checkLocked(task.path, f, nil); r.err != nil {
+		return r
+	}
+
+	var key string
+	if clones != nil {
+		if osf, ok := f.(*os.File); ok {
+			key = extentKey(osf)
+		}
+		if key != "" && mixedHashes != nil {
+			// Hashes with different algorithms can't be reused
+			key += "\x00" + algoFor(task.path)
+		}
+		if c, ok := clones.get(key); ok && key != "" {
+			c.cloneOf, c.path = c.path, task.path
+			return c
+		}
+	}
+
+	var ok bool
+	if r, ok = hashSmallFile(hf, f, buf); !ok {
+		r = hashReader(hf, fileReader(f), buf)
+	}
+	r.path = task.path
+	// A file locked while it was read may have been changed part way through
+	r.err = checkLocked(task.path, f, r.err)
+	if r.err == nil && *flagVerifyWrite {
+		r.err = verifyRead(hf, task, buf, r)
+	}
+	if key != "" && r.err == nil {
+		clones.put(key, r)
+	}
+	return r
 }
 
-// base64HashPrinter prints hashes in "base64hash <spc><spc> filename" format, using standard Base64 with padding
-type base64HashPrinter struct{}
+// hashReader hashes everything read from rd, applying any limits on reads.
+func hashReader(hf hashFactory, rd io.Reader, buf []byte) hashResult {
+	if byteLimiter != nil || iopsLimiter != nil || readMeter != nil {
+		rd = meteredReader{rd}
+	}
+	return hashCopy(hf, rd, buf)
+}
 
-func (hp base64HashPrinter) Print(r hashResult) {
-	fmt.Printf("%s  %s\n", base64.StdEncoding.EncodeToString(r.hash), r.path)
+// hashCopy hashes everything read from rd, which has any limits on reads
+// already applied.
+func hashCopy(hf hashFactory, rd io.Reader, buf []byte) hashResult {
+	var r hashResult
+	h := hf()
+	var w io.Writer = h
+	var ch *chunkHasher
+	if *flagChunks > 0 {
+		ch = &chunkHasher{hf: hf, size: int64(*flagChunks)}
+		w = io.MultiWriter(h, ch)
+	}
+	var sniff *sniffer
+	if *flagMIME {
+		sniff = &sniffer{}
+		w = io.MultiWriter(w, sniff)
+	}
+	var counts *byteCounts
+	if *flagEntropy {
+		counts = &byteCounts{}
+		w = io.MultiWriter(w, counts)
+	}
+
+	r.size, r.err = io.CopyBuffer(w, rd, buf)
+	if r.err != nil {
+		return r
+	}
+	if sniff != nil {
+		r.mime = detectMIME(sniff.buf)
+	}
+	if counts != nil {
+		e := counts.entropy()
+		r.entropy = &e
+	}
+	r.hash, r.err = sumHash(h)
+	releaseHash(h)
+	if r.err != nil {
+		return r
+	}
+	if ch != nil {
+		r.chunks, r.err = ch.Sums()
+	}
+	return r
 }
 
-// jsonBase64HashPrinter prints hashes as JSON lines with keys "hash" and
-// "path", with "hash" containing a hex hash in the same format as
-// hexHashPrinter.
-type jsonHexHashPrinter struct {
-	enc *json.Encoder
+// chunkHasher is a writer which hashes its input in fixed-size chunks, for
+// -chunks.
+type chunkHasher struct {
+	hf   hashFactory
+	size int64
+
+	cur  hash.Hash
+	n    int64 // bytes written to cur
+	sums [][]byte
 }
 
-func (hp jsonHexHashPrinter) Print(r hashResult) {
-	hp.enc.Encode(jsonResult{r.path, hex.EncodeToString(r.hash)})
+func (ch *chunkHasher) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		if ch.cur == nil {
+			ch.cur = ch.hf()
+			ch.n = 0
+		}
+		k := ch.size - ch.n
+		if k > int64(len(p)) {
+			k = int64(len(p))
+		}
+		if _, err := ch.cur.Write(p[:k]); err != nil {
+			return 0, err
+		}
+		ch.n += k
+		p = p[k:]
+		if ch.n == ch.size {
+			if err := ch.finishChunk(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return written, nil
 }
 
-// jsonBase64HashPrinter prints hashes as JSON lines with keys "hash" and
-// "path", with "hash" containing a Base64 hash in the same format as
-// base64HashPrinter.
-type jsonBase64HashPrinter struct {
-	enc *json.Encoder
+// Sums returns the digests of each chunk, including a final partial chunk.
+func (ch *chunkHasher) Sums() ([][]byte, error) {
+	if ch.cur != nil {
+		if err := ch.finishChunk(); err != nil {
+			return nil, err
+		}
+	}
+	return ch.sums, nil
 }
 
-func (hp jsonBase64HashPrinter) Print(r hashResult) {
-	hp.enc.Encode(jsonResult{r.path, base64.StdEncoding.EncodeToString(r.hash)})
+func (ch *chunkHasher) finishChunk() error {
+	sum, err := sumHash(ch.cur)
+	releaseHash(ch.cur)
+	if err != nil {
+		return err
+	}
+	ch.sums = append(ch.sums, sum)
+	ch.cur = nil
+	return nil
+}
+
+// isRetryable reports whether an error might go away if the file is
+// re-opened. Missing files and permission errors won't.
+func isRetryable(err error) bool {
+	return !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, fs.ErrPermission) && !errors.Is(err, errLocked)
+}
+
+// walkRoot walks the tree at rootPath and queues each file for hashing, with
+// its path prefixed by prefix (see rootPrefixes). In
+// check mode, files which are absent from the manifest are reported as extra
+// instead. In -dry-run mode, files are only counted in stats. Directories
+// which can't be read are reported like files which can't be read, and the
+// rest of the tree is still walked.
+func walkRoot(rootPath, prefix string, tasks chan<- hashTask, results chan<- hashResult, cp *checkPrinter, stats *dryRunStats) {
+	root := resolveRoot(snapshotPath(rootPath))
+	dir := openRoot(root)
+	opened := openedRoot{root, prefix, dir}
+	var sw *symlinkWalker
+	if *flagFollowSymlinks {
+		sw = newSymlinkWalker(root, dir)
+	}
+
+	// fail reports an error for a path, which is only logged in -dry-run mode
+	fail := func(p string, err error) {
+		var pe *fs.PathError
+		if p == "." {
+			p = rootPath
+			if errors.As(err, &pe) {
+				err = &fs.PathError{Op: pe.Op, Path: rootPath, Err: pe.Err}
+			}
+		} else {
+			p = prefix + p
+		}
+		if stats != nil {
+			errorf("%v", err)
+			return
+		}
+		results <- hashResult{path: p, err: err}
+	}
+
+	// send queues a task, unless it was completed by a run being resumed
+	send := func(task hashTask) {
+		if theJournal != nil {
+			if r, ok := theJournal.completed(task); ok {
+				r.root = task.root
+				results <- r
+				return
+			}
+		}
+		tasks <- task
+	}
+
+	var walkFn fs.WalkDirFunc
+	walkFn = func(p string, dirent fs.DirEntry, err error) error {
+		if err != nil {
+			// The directory's contents are skipped, if it was readable
+			fail(p, err)
+			return nil
+		}
+		if dirent.IsDir() {
+			if p != "." && !walkPathspecs(prefix+p) {
+				return fs.SkipDir
+			}
+			if sw != nil && !sw.enterDir(p) {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if isSidecar(dirent.Name()) {
+			return nil
+		}
+		if sw != nil && dirent.Type()&fs.ModeSymlink != 0 {
+			sw.links = append(sw.links, p)
+			return nil
+		}
+		if !inShard(p) {
+			if stats != nil {
+				stats.record(decisionShard, dirent)
+			}
+			return nil
+		}
+		if !inPathspecs(prefix + p) {
+			if stats != nil {
+				stats.record(decisionPathspec, dirent)
+			}
+			return nil
+		}
+		if ok, err := ownerFilter.matches(dirent); err != nil {
+			fail(p, err)
+			return nil
+		} else if !ok {
+			if stats != nil {
+				stats.record(decisionOwner, dirent)
+			}
+			return nil
+		}
+		symlinkOf := ""
+		if sw != nil {
+			symlinkOf = sw.visitFile(p)
+		}
+		if stats != nil {
+			if symlinkOf == "" {
+				stats.record(decisionIncluded, dirent)
+			}
+			return nil
+		}
+		task := opened.task(p)
+		if cp != nil && cp.isExtra(task.path) {
+			results <- hashResult{path: task.path, status: statusExtra}
+			return nil
+		}
+		if symlinkOf != "" {
+			results <- hashResult{path: task.path, symlinkOf: prefix + symlinkOf}
+			return nil
+		}
+		send(task)
+
+		if *flagADS {
+			streams, err := listStreams(task.osPath())
+			if err != nil {
+				fail(p, err)
+			}
+			for _, s := range streams {
+				send(opened.task(p + ":" + s))
+			}
+		}
+		return nil
+	}
+	walkDir(dir, ".", walkFn)
+	if sw == nil {
+		return
+	}
+
+	sw.following = true
+	for i := 0; i < len(sw.links); i++ {
+		p := sw.links[i]
+		fi, err := fs.Stat(dir, p)
+		if err != nil {
+			// A dangling symlink is reported like any other unreadable file
+			if inShard(p) || stats != nil {
+				fail(p, err)
+			}
+			continue
+		}
+		if fi.IsDir() {
+			walkDir(dir, p, walkFn)
+		} else {
+			walkFn(p, fs.FileInfoToDirEntry(fi), nil)
+		}
+	}
 }
 
 func main() {
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stdout, "Usage: %s [opts] <paths...>\n", os.Args[0])
+		fmt.Fprintf(os.Stdout, "Usage: %s [opts] <paths...> [-- pathspecs...]\n", os.Args[0])
+		fmt.Fprintf(os.Stdout, "       %s -urls <file> [opts] [paths...]\n", os.Args[0])
+		fmt.Fprintf(os.Stdout, "       %s -tar <file> [opts] [paths...]\n", os.Args[0])
+		fmt.Fprintf(os.Stdout, "       %s sum [opts] [files...]\n", os.Args[0])
+		fmt.Fprintf(os.Stdout, "       %s export-cas [opts] <path> <casdir>\n", os.Args[0])
+		fmt.Fprintf(os.Stdout, "       %s merge [opts] <manifests...>\n", os.Args[0])
+		fmt.Fprintf(os.Stdout, "       %s cat [opts] <manifest>\n", os.Args[0])
+		fmt.Fprintf(os.Stdout, "       %s lookup [opts] <manifest> [digests...]\n", os.Args[0])
+		fmt.Fprintf(os.Stdout, "       %s oci-verify [opts] <image-layout>\n", os.Args[0])
+		fmt.Fprintf(os.Stdout, "       %s verify-chain [opts] <chain-log> [digest]\n", os.Args[0])
+		fmt.Fprintf(os.Stdout, "       %s prove [opts] <manifest> [path]\n", os.Args[0])
+		fmt.Fprintf(os.Stdout, "       %s prove-verify [opts] <proof> [root]\n", os.Args[0])
+		fmt.Fprintf(os.Stdout, "       %s watch [opts] <manifest> <path>\n", os.Args[0])
+		fmt.Fprintf(os.Stdout, "       %s gate [opts] <incoming-dir>\n", os.Args[0])
+		fmt.Fprintf(os.Stdout, "       %s bench [opts]\n", os.Args[0])
+		fmt.Fprintf(os.Stdout, "       %s mount [opts] <manifest> <srcdir> <mountpoint>\n", os.Args[0])
 		flag.PrintDefaults()
 	}
 
-	flag.Parse()
+	// Subcommands are given before any options, and share the same set of
+	// options as the main command.
+	cmd, args := "", os.Args[1:]
+	if len(args) > 0 {
+		switch args[0] {
+		case "sum", "export-cas", "merge", "cat", "lookup", "oci-verify", "verify-chain", "prove", "prove-verify", "watch", "gate", "bench", "mount":
+			cmd, args = args[0], args[1:]
+		}
+	}
+	flag.CommandLine.Parse(args)
+	checkLogging()
+	checkHashImpl(cmd)
+	checkMemory()
+	checkEncryption()
+
+	roots, specs := splitPathspecs(flag.Args())
+	manifest := *flagCheck
+	var sumFiles []string
+	switch cmd {
+	case "sum":
+		sumFiles, roots = roots, nil
+		if len(sumFiles) == 0 {
+			sumFiles = []string{"-"}
+		}
+	case "export-cas":
+		if len(roots) != 2 {
+			flag.Usage()
+			os.Exit(1)
+		}
+		casDir, roots = roots[1], roots[:1]
+		checkCASLink()
+	case "merge":
+		if len(roots) == 0 {
+			flag.Usage()
+			os.Exit(1)
+		}
+		runMerge(roots)
+		return
+	case "cat":
+		if len(roots) != 1 {
+			flag.Usage()
+			os.Exit(1)
+		}
+		runCat(roots[0])
+		return
+	case "lookup":
+		if len(roots) == 0 {
+			flag.Usage()
+			os.Exit(1)
+		}
+		runLookup(roots[0], roots[1:])
+		return
+	case "oci-verify":
+		if len(roots) != 1 {
+			flag.Usage()
+			os.Exit(1)
+		}
+		runOCIVerify(roots[0])
+		return
+	case "verify-chain":
+		if len(roots) != 1 && len(roots) != 2 {
+			flag.Usage()
+			os.Exit(1)
+		}
+		head := ""
+		if len(roots) == 2 {
+			head = roots[1]
+		}
+		runVerifyChain(roots[0], head)
+		return
+	case "prove", "prove-verify":
+		if len(roots) != 1 && len(roots) != 2 {
+			flag.Usage()
+			os.Exit(1)
+		}
+		arg := ""
+		if len(roots) == 2 {
+			arg = roots[1]
+		}
+		if cmd == "prove" {
+			runProve(roots[0], arg)
+		} else {
+			runProveVerify(roots[0], arg)
+		}
+		return
+	case "bench":
+		if len(roots) != 0 {
+			flag.Usage()
+			os.Exit(1)
+		}
+		runBench()
+		return
+	case "mount":
+		if len(roots) != 3 {
+			flag.Usage()
+			os.Exit(1)
+		}
+		runMount(roots[0], roots[1], roots[2])
+		return
+	case "watch":
+		if len(roots) != 2 {
+			flag.Usage()
+			os.Exit(1)
+		}
+		manifest, roots = roots[0], roots[1:]
+	case "gate":
+		if len(roots) != 1 {
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
 
-	if len(flag.Args()) == 0 {
+	if len(roots) == 0 && (*flagURLs == "" && *flagTar == "" || cmd != "") && cmd != "sum" {
 		flag.Usage()
 		os.Exit(1)
 	}
+	if *flagCheck != "" && *flagTar != "" && len(roots) != 0 {
+		log.Fatal("check mode with -tar cannot be given a path")
+	} else if *flagCheck != "" && *flagTar == "" && len(roots) != 1 && !*flagLabelRoots && len(*flagRootLabel) == 0 {
+		log.Fatal("check mode requires exactly one path, unless -label-roots is used")
+	}
+	prefixes := rootPrefixes(roots)
+	if len(prefixes) > 0 && prefixes[0] != "" && cmd != "" {
+		log.Fatal("-label-roots cannot be used with subcommands")
+	}
 
-	jobs := *flagJobs
-	if jobs == 0 {
-		jobs = runtime.NumCPU()
+	if *flagTag {
+		if flagWasSet("fmt") && *flagFmt != "tag" {
+			log.Fatal("-tag cannot be used with -fmt")
+		}
+		*flagFmt = "tag"
+	}
+	checkCanonical(cmd)
+	checkXattrMode()
+	checkPathCase()
+	checkNormalizePaths()
+	checkPriority()
+	checkShard()
+	checkPathspecs(cmd, specs)
+	checkDigestCovers(cmd)
+	checkSum(cmd)
+	checkSample()
+	if *flagChunks > 0 {
+		checkJSONOutput("-chunks")
+	}
+	if *flagTimings {
+		checkJSONOutput("-timings")
+	}
+	if *flagStat {
+		checkJSONOutput("-stat")
+	}
+	if *flagMIME {
+		checkJSONOutput("-mime")
+	}
+	if *flagJSONPathB64 {
+		checkJSONOutput("-json-path-b64")
+	}
+	if *flagEntropy {
+		checkJSONOutput("-entropy")
+	}
+	if flagWasSet("assume-unchanged-within") && *flagCheck == "" {
+		log.Fatal("-assume-unchanged-within can only be used in check mode")
+	}
+	checkKnownAction()
+	checkSFV()
+	checkClones()
+	checkTUI()
+	if *flagStats != "" && (*flagCheck != "" || cmd != "" || *flagDryRun) {
+		log.Fatal("-stats cannot be used with check mode, -dry-run, or subcommands")
+	}
+	checkIO()
+	checkGate(cmd)
+	checkSnapshot(cmd)
+	checkDAV(roots, cmd)
+	if *flagCollisions && (*flagCheck != "" || cmd != "" || *flagXattr == "verify" || *flagDryRun) {
+		log.Fatal("-collisions cannot be used with check mode, -xattr verify, -dry-run, or subcommands")
+	}
+	if *flagTUI && (cmd != "" || *flagDryRun) {
+		log.Fatal("-tui cannot be used with -dry-run or subcommands")
+	}
+	if (*flagJournal != "" || *flagResume != "") && (*flagCheck != "" || cmd == "watch" || cmd == "gate") {
+		log.Fatal("-journal and -resume cannot be used in check mode, watch, or gate")
+	}
+	if *flagArchives && (*flagCheck != "" || cmd != "" || *flagXattr != "") {
+		log.Fatal("-archives cannot be used with check mode, -xattr, or subcommands")
+	}
+	if *flagURLs != "" && (*flagCheck != "" || cmd != "" || *flagXattr != "" || *flagJournal != "" || *flagResume != "" || *flagArchives || *flagDryRun) {
+		log.Fatal("-urls cannot be used with check mode, subcommands, -xattr, -journal, -resume, -archives, or -dry-run")
+	}
+	if *flagTar != "" && (cmd != "" || *flagXattr != "" || *flagJournal != "" || *flagResume != "" || *flagArchives || *flagDryRun) {
+		log.Fatal("-tar cannot be used with subcommands, -xattr, -journal, -resume, -archives, or -dry-run")
+	}
+	if *flagMaxErrors < 0 {
+		log.Fatal("-max-errors must not be negative")
+	}
+	if *flagWalkBatch < 0 {
+		log.Fatal("-walk-batch must not be negative")
+	}
+	if *flagDropCache && !*flagVerifyWrite {
+		log.Fatal("-drop-cache requires -verify-write")
+	}
+	if *flagDropCache && runtime.GOOS != "linux" {
+		log.Fatal("-drop-cache is only supported on Linux")
+	}
+	if *flagADS && runtime.GOOS != "windows" {
+		log.Fatal("-ads is only supported on Windows")
+	}
+	takeSnapshots(roots)
+	checkStats(roots, prefixes)
+	checkProvenance(cmd, roots)
+	checkSidecar(cmd, roots, prefixes)
+	checkTombstones(cmd)
+	checkOwners(cmd)
+	checkLocks(cmd)
+	checkHashFor(cmd)
+
+	if *flagDryRun {
+		for _, rootPath := range roots {
+			stats := newDryRunStats()
+			walkRoot(rootPath, "", nil, nil, nil, stats)
+			stats.print(os.Stdout, rootPath)
+		}
+		releaseSnapshots()
+		return
+	}
+
+	stopProfiling := startProfiling()
+	defer stopProfiling()
+
+	byteLimiter = newRateLimiter(int64(*flagLimitRate))
+	iopsLimiter = newRateLimiter(int64(*flagLimitIOPS))
+
+	jobs, autoJobs := parseJobs()
+	if autoJobs || *flagTUI {
+		// Set before any worker starts reading
+		readMeter = &ioMeter{}
 	}
 
 	// Set up task queues
 	tasks := make(chan hashTask, jobs*2)
 	results := make(chan hashResult, jobs*2)
 
+	// Read the manifest first, since it may determine the hash function
+	var entries []manifestEntry
+	if manifest != "" {
+		format := "auto"
+		if flagWasSet("fmt") {
+			format = *flagFmt
+		}
+		var header *manifestHeader
+		var err error
+		entries, header, err = readManifest(manifest, format)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if header != nil {
+			debugf("%s: generated %s from %s", manifest, header.generated, strings.Join(header.roots, ", "))
+		}
+		if header != nil && header.covers != *flagDigestCovers {
+			if flagWasSet("digest-covers") {
+				log.Fatalf("%s: the manifest's digests cover %q, not %q", manifest, header.covers, *flagDigestCovers)
+			}
+			*flagDigestCovers = header.covers
+			checkDigestCovers(cmd)
+		}
+		if !flagWasSet("hash") {
+			if algo := detectAlgorithm(entries); algo != "" {
+				*flagHash = algo
+			}
+		}
+		setEntryAlgorithms(manifest, entries)
+		entries = filterPathspecs(filterShard(entries))
+		entries = filterSample(entries, openRoots(roots, prefixes))
+		if flagWasSet("assume-unchanged-within") {
+			loadUnchangedEntries(entries)
+		}
+	} else if *flagSidecar == "verify" {
+		entries = filterPathspecs(filterShard(loadSidecars(roots, prefixes)))
+	}
+
 	// Get hash function
-	hb := hashByName(*flagHash)
+	key, err := hex.DecodeString(*flagKey)
+	if err != nil {
+		log.Fatal("invalid -key: ", err)
+	}
+	hb := poolHashes(hashByName(*flagHash, key))
+	loadMixedHashes(key)
+	loadKnownHashes()
+	openJournal()
+	if *flagTUI {
+		startTUI()
+	}
 
 	// Launch workers
-	var wgHasher sync.WaitGroup
-	for i := 0; i < jobs; i++ {
+	pool := newWorkerPool(func(id int, quit <-chan struct{}) {
+		if lowPriority() {
+			// The thread is discarded when the worker exits, so its
+			// lowered priority won't leak to other goroutines.
+			runtime.LockOSThread()
+			if err := lowerThreadPriority(); err != nil {
+				log.Fatal("setting priority: ", err)
+			}
+		}
+		hasher(id, hb, tasks, results, quit)
+	})
+	pool.resize(jobs)
+
+	autoscaleDone := make(chan struct{})
+	var wgAutoscale sync.WaitGroup
+	if autoJobs {
+		wgAutoscale.Add(1)
 		go func() {
-			defer wgHasher.Done()
-			hasher(hb, tasks, results)
+			defer wgAutoscale.Done()
+			pool.autoscale(autoscaleDone)
 		}()
 	}
-	wgHasher.Add(jobs)
 
 	// Initialize and launch the hash printer
 	var hp hashPrinter
-	switch *flagFmt {
-	case "hex":
-		hp = &hexHashPrinter{}
-	case "base64":
-		hp = &base64HashPrinter{}
-	case "json", "json-hex":
-		hp = &jsonHexHashPrinter{json.NewEncoder(os.Stdout)}
-	case "json-base64":
-		hp = &jsonBase64HashPrinter{json.NewEncoder(os.Stdout)}
+	var cp *checkPrinter
+	var g *gate
+	headerRoots = roots
+	switch {
+	case cmd == "watch":
+		hp = newWatchPrinter(entries, os.Stdout)
+	case cmd == "gate":
+		g = newGate(roots[0], os.Stdout)
+		hp = g
+	case *flagCheck != "" || *flagSidecar == "verify":
+		cp = newCheckPrinter(entries)
+		hp = cp
+	case *flagStream != "":
+		hp = newStreamHashPrinter(*flagStream)
+	case *flagXattr == "verify":
+		hp = &xattrVerifyPrinter{}
+	case len(*flagOut) > 0:
+		hp = newMultiHashPrinter(*flagOut)
+	case recipients != nil:
+		// Encrypted output has to be finished when the printer is closed
+		hp = newMultiHashPrinter(outputSpecs{*flagFmt + "=-"})
+	default:
+		hp = newHashPrinter(*flagFmt, os.Stdout)
+	}
+	if *flagSort && cmd != "watch" && cmd != "gate" && cp == nil {
+		hp = newSortingPrinter(hp)
+	}
+	if *flagChainLog != "" {
+		hp = newChainPrinter(hp, *flagChainLog, roots)
+	}
+	if *flagPublish != "" {
+		hp = newPublishPrinter(hp, *flagPublish)
+	}
+
+	var cd *collisionDetector
+	if *flagCollisions {
+		cd = newCollisionDetector()
 	}
 
 	var wgPrinter sync.WaitGroup
 	go func() {
 		defer wgPrinter.Done()
+		var limit errorLimit
+		print := func(r hashResult) {
+			if *flagSkipLocked && errors.Is(r.err, errLocked) {
+				// Skipped files are neither results nor errors
+				theTombstones.record(displayPath(r.path))
+				printWarning(hp, pathWarning{kind: "locked", path: displayPath(r.path)})
+				return
+			}
+			theStats.record(r)
+			theSidecars.record(r)
+			theTombstones.record(displayPath(r.path))
+			if cd != nil {
+				if w, ok := cd.add(r.path); ok {
+					w.path, w.other = displayPath(w.path), displayPath(w.other)
+					printWarning(hp, w)
+				}
+			}
+			if r.err == nil && knownHashes[string(r.hash)] {
+				if *flagKnownAction == "suppress" {
+					return
+				}
+				r.known = true
+			}
+			theTUI.result(r)
+			if *flagCanonical {
+				// The number of retries varies from run to run
+				r.retries = 0
+			}
+			r.path = displayPath(r.path)
+			if r.symlinkOf != "" {
+				r.symlinkOf = displayPath(r.symlinkOf)
+			}
+			if r.cloneOf != "" {
+				r.cloneOf = displayPath(r.cloneOf)
+			}
+			theProvenance.record(r)
+			trace.WithRegion(context.Background(), "print", func() {
+				if r.err == nil {
+					hp.Print(r)
+					return
+				}
+				if ep, ok := hp.(errorPrinter); ok {
+					ep.PrintError(r)
+				}
+				if !recordsErrors(hp) {
+					// Formats which can't record errors stop at the
+					// first one, unless -max-errors allows more.
+					if *flagMaxErrors > 0 {
+						errorf("%v", r.err)
+					} else {
+						flushPrinters(hp)
+						log.Fatal(r.err)
+					}
+				}
+			})
+			if limit.record(r) {
+				limit.abort(hp, cp)
+			}
+		}
+
+		var ar *aliasResolver
+		if *flagFollowSymlinks {
+			ar = newAliasResolver()
+		}
 		for r := range results {
-			hp.Print(r)
+			if ar == nil {
+				print(r)
+				continue
+			}
+			for _, r := range ar.resolve(r) {
+				print(r)
+			}
+		}
+		if ar != nil {
+			for _, r := range ar.unresolved() {
+				print(r)
+			}
+		}
+		theTombstones.print(hp)
+		theTUI.stop()
+		theStats.write()
+		theProvenance.write()
+		theSidecars.write()
+		if c, ok := hp.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				if *flagStatus {
+					os.Exit(1)
+				}
+				log.Fatal(err)
+			}
+		}
+		if !recordsErrors(hp) && limit.errors > 0 {
+			log.Fatalf("%d files could not be read", limit.errors)
 		}
 	}()
 	wgPrinter.Add(1)
 
-	// Start walking the filesystem and generating paths
-	for _, rootPath := range flag.Args() {
-		dir := os.DirFS(rootPath)
-		fs.WalkDir(dir, ".", func(p string, dirent fs.DirEntry, err error) error {
-			if err != nil {
-				log.Fatal(err)
-			}
-			if dirent.IsDir() {
-				return nil
-			}
-			tasks <- hashTask{p, dir}
-			return nil
-		})
+	// Start walking the filesystem and generating paths. Check mode only
+	// needs to look at the files in the manifest, unless it's also looking
+	// for extra files. Watch mode does the same, but never finishes, and
+	// neither does gate.
+	if cmd == "watch" {
+		feedWatch(roots[0], entries, tasks)
+	} else if g != nil {
+		g.feed(tasks)
+	} else if cmd == "sum" {
+		feedSum(sumFiles, tasks)
+	} else if cp != nil && !*flagStrict && *flagTar == "" {
+		cp.tasks(entries, openRoots(roots, prefixes), tasks, results)
+	} else {
+		for i, rootPath := range roots {
+			trace.WithRegion(context.Background(), "walk", func() {
+				walkRoot(rootPath, prefixes[i], tasks, results, cp, nil)
+			})
+		}
+		if *flagURLs != "" {
+			feedURLs(*flagURLs, tasks)
+		}
+		if *flagTar != "" {
+			hashTarStream(*flagTar, hb, results, cp)
+		}
 	}
 
 	// Wait for all workers to exit
+	close(autoscaleDone)
+	wgAutoscale.Wait()
 	close(tasks)
-	wgHasher.Wait()
+	pool.wait()
+	releaseSnapshots()
+	if theJournal != nil {
+		if err := theJournal.Close(); err != nil {
+			log.Fatal(err)
+		}
+	}
 	close(results)
 	wgPrinter.Wait()
 }
+
+// flagWasSet reports whether the named flag was given on the command line.
+func flagWasSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// checkJSONOutput checks that every output is in a JSON format (or -stream),
+// for options which add information only those formats can carry.
+func checkJSONOutput(option string) {
+	if *flagStream != "" {
+		return
+	}
+	for _, f := range outputFormats() {
+		if !strings.HasPrefix(f, "json") {
+			log.Fatalf("%s requires a JSON output format or -stream", option)
+		}
+	}
+}
+
+// outputFormats returns the format of each output, from -out or -fmt.
+func outputFormats() []string {
+	if formats := flagOut.formats(); len(formats) > 0 {
+		return formats
+	}
+	return []string{*flagFmt}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"time"
+)
+
+// webhookClient is used to deliver -webhook notifications.
+var webhookClient = &http.Client{Timeout: 30 * time.Second}
+
+// notifyMismatch runs the -on-mismatch-exec command and posts to the -webhook
+// URL, if either is set, for a file which failed verification. The alert is
+// passed to both as a JSON payload. Failures to notify are logged, but don't
+// stop verification.
+func notifyMismatch(a alert) {
+	if *flagOnMismatchExec == "" && *flagWebhook == "" {
+		return
+	}
+	if a.Time.IsZero() {
+		a.Time = time.Now().UTC()
+	}
+	payload, err := json.Marshal(a)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *flagOnMismatchExec != "" {
+		if err := runMismatchExec(a, payload); err != nil {
+			errorf("-on-mismatch-exec for %s: %v", a.Path, err)
+		}
+	}
+	if *flagWebhook != "" {
+		if err := postWebhook(payload); err != nil {
+			errorf("-webhook for %s: %v", a.Path, err)
+		}
+	}
+}
+
+// runMismatchExec runs the -on-mismatch-exec command using the shell, with
+// the payload on standard input and the path and status in the environment
+// as HASHTREE_PATH and HASHTREE_STATUS.
+func runMismatchExec(a alert, payload []byte) error {
+	cmd := shellCommand(*flagOnMismatchExec)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), "HASHTREE_PATH="+a.Path, "HASHTREE_STATUS="+a.Status)
+	return cmd.Run()
+}
+
+// shellCommand returns a command which runs a command line using the shell.
+func shellCommand(command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/C", command)
+	}
+	return exec.Command("/bin/sh", "-c", command)
+}
+
+func postWebhook(payload []byte) error {
+	resp, err := webhookClient.Post(*flagWebhook, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("server returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// httpHeaders is a flag.Value which collects repeated "Name: value" HTTP
+// headers.
+type httpHeaders struct {
+	h http.Header
+}
+
+func httpHeadersFlag(name string, usage string) *httpHeaders {
+	h := &httpHeaders{http.Header{}}
+	flag.Var(h, name, usage)
+	return h
+}
+
+func (h *httpHeaders) String() string {
+	if h == nil {
+		return ""
+	}
+	var s []string
+	for name, values := range h.h {
+		for _, v := range values {
+			s = append(s, name+": "+v)
+		}
+	}
+	return strings.Join(s, ", ")
+}
+
+func (h *httpHeaders) Set(s string) error {
+	return addHTTPHeader(h.h, s)
+}
+
+// addHTTPHeader adds a header given as "Name: value" to h.
+func addHTTPHeader(h http.Header, s string) error {
+	i := strings.IndexByte(s, ':')
+	if i <= 0 {
+		return fmt.Errorf("invalid header %q: must be of the form Name: value", s)
+	}
+	h.Add(strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+1:]))
+	return nil
+}
+
+// isURL reports whether s is an HTTP or HTTPS URL.
+func isURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// feedURLs queues each URL listed in the file name (or standard input, for
+// "-") for hashing. Each line is a URL, optionally followed by tab-separated
+// "Name: value" headers to send with it, in addition to any -http-header.
+// Blank lines and lines starting with # are ignored.
+func feedURLs(name string, tasks chan<- hashTask) {
+	var r io.Reader = os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		fields := strings.Split(text, "\t")
+		u := fields[0]
+		if !isURL(u) {
+			log.Fatalf("%s:%d: not an HTTP or HTTPS URL: %s", name, line, u)
+		}
+		header := flagHTTPHeader.h.Clone()
+		for _, f := range fields[1:] {
+			if err := addHTTPHeader(header, f); err != nil {
+				log.Fatalf("%s:%d: %v", name, line, err)
+			}
+		}
+		if !inShard(u) {
+			continue
+		}
+		tasks <- hashTask{path: u, fs: httpFS{header}}
+	}
+	if err := sc.Err(); err != nil {
+		log.Fatalf("%s: %v", name, err)
+	}
+}
+
+// httpFS is an fs.FS which fetches URLs, given as the names to open, with a
+// GET request carrying the given headers.
+type httpFS struct {
+	header http.Header
+}
+
+func (hfs httpFS) Open(name string) (fs.File, error) {
+	f := &httpFile{url: name, header: hfs.header}
+	if err := f.get(0); err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return f, nil
+}
+
+// httpFile is the body of a response to a GET request. If reading it fails
+// partway through, it's resumed with a Range request, up to -retries times,
+// as long as the server gave a validator to make sure that the rest of the
+// body comes from the same version of the resource.
+type httpFile struct {
+	url    string
+	header http.Header
+
+	body      io.ReadCloser
+	size      int64 // -1 if unknown
+	modTime   time.Time
+	offset    int64
+	validator string // ETag or Last-Modified, for If-Range
+	resumes   int
+}
+
+// get requests the body of the resource, starting at offset.
+func (f *httpFile) get(offset int64) error {
+	req, err := http.NewRequest("GET", f.url, nil)
+	if err != nil {
+		return err
+	}
+	for name, values := range f.header {
+		req.Header[name] = values
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", f.validator)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	switch {
+	case offset == 0 && resp.StatusCode == http.StatusOK:
+		f.size = resp.ContentLength
+		f.modTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+		// Weak ETags can't be used with If-Range
+		if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			f.validator = etag
+		} else {
+			f.validator = resp.Header.Get("Last-Modified")
+		}
+	case offset > 0 && resp.StatusCode == http.StatusPartialContent:
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			resp.Body.Close()
+			return fmt.Errorf("server resumed at the wrong offset (Content-Range: %s)", resp.Header.Get("Content-Range"))
+		}
+	case offset > 0 && resp.StatusCode == http.StatusOK:
+		resp.Body.Close()
+		return errors.New("resource changed while it was being read")
+	default:
+		resp.Body.Close()
+		return httpStatusError{resp.StatusCode, resp.Status}
+	}
+	f.body = resp.Body
+	return nil
+}
+
+func (f *httpFile) Read(p []byte) (int, error) {
+	for {
+		n, err := f.body.Read(p)
+		f.offset += int64(n)
+		if err == nil || err == io.EOF || !f.resume(err) {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// resume re-requests the rest of the body after a read error, and reports
+// whether it succeeded.
+func (f *httpFile) resume(err error) bool {
+	if f.validator == "" {
+		return false
+	}
+	f.body.Close()
+	for f.resumes < *flagRetries {
+		f.resumes++
+		debugf("%s: %v; resuming at byte %d", f.url, err, f.offset)
+		time.Sleep(*flagRetryDelay)
+		if err = f.get(f.offset); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *httpFile) Close() error {
+	return f.body.Close()
+}
+
+func (f *httpFile) Stat() (fs.FileInfo, error) {
+	return httpFileInfo{f}, nil
+}
+
+// httpFileInfo describes an httpFile, from the headers of its response.
+type httpFileInfo struct {
+	f *httpFile
+}
+
+func (fi httpFileInfo) Name() string       { return fi.f.url }
+func (fi httpFileInfo) Size() int64        { return fi.f.size }
+func (fi httpFileInfo) Mode() fs.FileMode  { return 0444 }
+func (fi httpFileInfo) ModTime() time.Time { return fi.f.modTime }
+func (fi httpFileInfo) IsDir() bool        { return false }
+func (fi httpFileInfo) Sys() interface{}   { return nil }
+
+// httpStatusError is an unsuccessful HTTP response. Not found and access
+// denied responses match the equivalent fs errors, so they aren't retried.
+type httpStatusError struct {
+	code   int
+	status string
+}
+
+func (e httpStatusError) Error() string {
+	return "HTTP " + e.status
+}
+
+func (e httpStatusError) Is(target error) bool {
+	switch e.code {
+	case http.StatusNotFound, http.StatusGone:
+		return target == fs.ErrNotExist
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return target == fs.ErrPermission
+	}
+	return false
+}
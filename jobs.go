@@ -0,0 +1,142 @@
+package main
+
+import (
+	"log"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// parseJobs interprets -jobs, returning the initial number of workers and
+// whether the pool should be scaled automatically.
+func parseJobs() (int, bool) {
+	switch *flagJobs {
+	case "", "0":
+		return runtime.NumCPU(), false
+	case "auto":
+		return runtime.NumCPU(), true
+	}
+	n, err := strconv.Atoi(*flagJobs)
+	if err != nil || n < 0 {
+		log.Fatal("-jobs must be a number or auto")
+	}
+	return n, false
+}
+
+// workerPool runs a resizable set of workers. Each worker is given an ID,
+// counting up from 1, which is never reused.
+type workerPool struct {
+	run func(id int, quit <-chan struct{})
+
+	wg     sync.WaitGroup
+	quit   chan struct{}
+	size   int
+	lastID int
+}
+
+func newWorkerPool(run func(id int, quit <-chan struct{})) *workerPool {
+	return &workerPool{run: run, quit: make(chan struct{})}
+}
+
+// resize starts or stops workers until there are n of them. A stopped
+// worker finishes the task it's working on before exiting.
+func (p *workerPool) resize(n int) {
+	for ; p.size < n; p.size++ {
+		p.lastID++
+		p.wg.Add(1)
+		go func(id int) {
+			defer p.wg.Done()
+			p.run(id, p.quit)
+		}(p.lastID)
+	}
+	for ; p.size > n; p.size-- {
+		p.quit <- struct{}{}
+	}
+}
+
+// wait waits for all workers to exit.
+func (p *workerPool) wait() {
+	p.wg.Wait()
+}
+
+// ioMeter accumulates the number of bytes read by all workers, and the time
+// they spent waiting for reads, for -jobs auto.
+type ioMeter struct {
+	bytes     int64 // accessed atomically
+	readNanos int64 // accessed atomically
+}
+
+// readMeter is non-nil when -jobs auto or -tui is in use.
+var readMeter *ioMeter
+
+func (m *ioMeter) record(n int, d time.Duration) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.bytes, int64(n))
+	atomic.AddInt64(&m.readNanos, int64(d))
+}
+
+// Parameters for autoscale.
+const (
+	autoscaleInterval  = 2 * time.Second
+	autoscaleThreshold = 0.05 // minimum relative change in throughput treated as significant
+)
+
+// autoscale adjusts the size of the pool to maximize read throughput until
+// done is closed. It's a simple hill climb: the pool keeps growing (or
+// shrinking) for as long as that improves throughput, and changes direction
+// when it makes things worse. When throughput has plateaued, workers which
+// are mostly waiting on hashing rather than I/O are shed, as they're only
+// competing for CPU.
+func (p *workerPool) autoscale(done <-chan struct{}) {
+	maxJobs := 8 * runtime.NumCPU()
+
+	ticker := time.NewTicker(autoscaleInterval)
+	defer ticker.Stop()
+
+	var lastBytes, lastNanos int64
+	var lastRate float64
+	direction := 1
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		bytes := atomic.LoadInt64(&readMeter.bytes)
+		nanos := atomic.LoadInt64(&readMeter.readNanos)
+		rate := float64(bytes-lastBytes) / autoscaleInterval.Seconds()
+		ioWait := float64(nanos-lastNanos) / float64(int64(p.size)*int64(autoscaleInterval))
+		lastBytes, lastNanos = bytes, nanos
+
+		step := p.size / 4
+		if step < 1 {
+			step = 1
+		}
+		n := p.size
+		switch {
+		case rate > lastRate*(1+autoscaleThreshold):
+			n += direction * step
+		case rate < lastRate*(1-autoscaleThreshold):
+			direction = -direction
+			n += direction * step
+		case ioWait < 0.5 && n > runtime.NumCPU():
+			n -= step
+		}
+		lastRate = rate
+
+		if n < 1 {
+			n = 1
+		} else if n > maxJobs {
+			n = maxJobs
+		}
+		if n != p.size {
+			debugf("jobs: %d -> %d (%s/s, %.0f%% I/O wait)", p.size, n, formatBytes(int64(rate)), ioWait*100)
+		}
+		p.resize(n)
+	}
+}
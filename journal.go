@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// journal records each file as it's hashed, for -journal and -resume, so
+// that an interrupted run can be resumed without hashing those files again.
+// It's a JSON header line naming the hash function, followed by a JSON line
+// for each file. A partly written last line, from a run which was killed,
+// is ignored and overwritten.
+type journal struct {
+	mu       sync.Mutex
+	f        *os.File
+	w        *bufio.Writer
+	lastSync time.Time
+
+	done map[journalKey]journalEntry // files completed by earlier runs
+}
+
+type journalKey struct {
+	root, path string
+}
+
+type journalHeader struct {
+	Journal int    `json:"journal"`
+	Hash    string `json:"hash"`
+}
+
+type journalEntry struct {
+	Root   string   `json:"root"`
+	Path   string   `json:"path"`
+	Hash   []byte   `json:"hash"`
+	Size   int64    `json:"size"`
+	MTime  int64    `json:"mtime"`
+	Chunks [][]byte `json:"chunks,omitempty"`
+	Algo   string   `json:"algo,omitempty"` // if it isn't -hash, with -hash-for
+}
+
+// journalSyncInterval is how often the journal is flushed to disk.
+const journalSyncInterval = time.Second
+
+// theJournal is the journal for -journal or -resume, or nil.
+var theJournal *journal
+
+func openJournal() {
+	switch {
+	case *flagJournal != "" && *flagResume != "":
+		log.Fatal("-journal and -resume cannot be used together")
+	case *flagJournal != "":
+		f, err := os.Create(*flagJournal)
+		if err != nil {
+			log.Fatal(err)
+		}
+		theJournal = &journal{f: f, w: bufio.NewWriter(f)}
+		theJournal.writeLine(journalHeader{1, *flagHash})
+	case *flagResume != "":
+		f, err := os.OpenFile(*flagResume, os.O_RDWR, 0)
+		if err != nil {
+			log.Fatal(err)
+		}
+		j := &journal{f: f, done: make(map[journalKey]journalEntry)}
+		end, err := j.load()
+		if err != nil {
+			log.Fatalf("%s: %v", *flagResume, err)
+		}
+		// Drop any partial last line before appending
+		if err := f.Truncate(end); err != nil {
+			log.Fatal(err)
+		}
+		if _, err := f.Seek(end, io.SeekStart); err != nil {
+			log.Fatal(err)
+		}
+		j.w = bufio.NewWriter(f)
+		debugf("%s: resuming after %d files", *flagResume, len(j.done))
+		theJournal = j
+	}
+}
+
+// load reads the files completed by earlier runs, and returns the offset
+// after the last complete line.
+func (j *journal) load() (int64, error) {
+	br := bufio.NewReader(j.f)
+	var end int64
+	for n := 0; ; n++ {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			return end, nil
+		} else if err != nil {
+			return 0, err
+		}
+
+		if n == 0 {
+			var h journalHeader
+			if err := json.Unmarshal(line, &h); err != nil || h.Journal != 1 {
+				return 0, fmt.Errorf("not a hashtree journal")
+			}
+			if h.Hash != *flagHash {
+				return 0, fmt.Errorf("journal has %s hashes, but -hash is %s", h.Hash, *flagHash)
+			}
+		} else {
+			var e journalEntry
+			if err := json.Unmarshal(line, &e); err != nil {
+				if _, err := br.Peek(1); err == io.EOF {
+					// The last line was cut short
+					return end, nil
+				}
+				return 0, fmt.Errorf("line %d: %w", n+1, err)
+			}
+			j.done[journalKey{e.Root, e.Path}] = e
+		}
+		end += int64(len(line))
+	}
+}
+
+// completed returns the result for a file which was hashed by an earlier
+// run, if it hasn't changed since, and was hashed with the same algorithm
+// as it would be now.
+func (j *journal) completed(task hashTask) (hashResult, bool) {
+	if j.done == nil {
+		return hashResult{}, false
+	}
+	e, ok := j.done[journalKey{task.root, task.path}]
+	if !ok {
+		return hashResult{}, false
+	}
+	fi, err := fs.Stat(task.fs, task.path)
+	if err != nil || fi.Size() != e.Size || fi.ModTime().UnixNano() != e.MTime {
+		return hashResult{}, false
+	}
+	if e.Algo != algoFor(task.path) {
+		return hashResult{}, false
+	}
+	return hashResult{path: task.path, hash: e.Hash, size: e.Size, chunks: e.Chunks, algo: e.Algo}, true
+}
+
+// record adds a hashed file to the journal. fi is the file's metadata from
+// before it was hashed.
+func (j *journal) record(task hashTask, fi fs.FileInfo, r hashResult) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.writeLine(journalEntry{task.root, task.path, r.hash, r.size, fi.ModTime().UnixNano(), r.chunks, r.algo})
+	if time.Since(j.lastSync) >= journalSyncInterval {
+		j.sync()
+	}
+}
+
+func (j *journal) writeLine(v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Fatal(err)
+	}
+	j.w.Write(append(b, '\n'))
+}
+
+func (j *journal) sync() {
+	if err := j.w.Flush(); err != nil {
+		log.Fatal("writing journal: ", err)
+	}
+	if err := j.f.Sync(); err != nil {
+		log.Fatal("writing journal: ", err)
+	}
+	j.lastSync = time.Now()
+}
+
+func (j *journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.sync()
+	return j.f.Close()
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"io"
+	"log"
+	"strings"
+)
+
+// knownHashes is the set of hashes loaded with -known-hashes.
+var knownHashes map[string]bool
+
+// nsrlColumns maps hash names to the columns holding them in an NSRL RDS
+// (NSRLFile.txt) file.
+var nsrlColumns = map[string]string{
+	"crc32":  "CRC32",
+	"md5":    "MD5",
+	"sha1":   "SHA-1",
+	"sha256": "SHA-256",
+}
+
+func checkKnownAction() {
+	switch *flagKnownAction {
+	case "suppress":
+	case "flag":
+		checkJSONOutput("-known-action flag")
+	default:
+		log.Fatal("-known-action must be suppress or flag")
+	}
+}
+
+// loadKnownHashes reads the -known-hashes file.
+func loadKnownHashes() {
+	if *flagKnownHashes != "" {
+		knownHashes = loadHashSet(*flagKnownHashes)
+	}
+}
+
+// loadHashSet reads a set of hashes from a file, which may be an NSRL RDS
+// file, a list of digests with one per line, or a manifest in any format.
+func loadHashSet(name string) map[string]bool {
+	f, err := openManifest(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+
+	set := make(map[string]bool)
+	format := ""
+	if b, _ := br.Peek(len(`"SHA-1"`)); string(b) != `"SHA-1"` {
+		// JSON manifests may have no spaces either, so are ruled out first
+		if format, err = detectFormat(br); err != nil {
+			log.Fatalf("%s: %v", name, err)
+		}
+	}
+	if format == "" {
+		err = readNSRL(br, set)
+	} else if first := firstLine(br); format == "auto-text" && first != "" && !strings.ContainsAny(first, " \t") {
+		err = readDigestList(br, set)
+	} else {
+		var entries []manifestEntry
+		entries, _, err = readManifest(name, "auto")
+		for _, e := range entries {
+			set[string(e.hash)] = true
+		}
+	}
+	if err != nil {
+		log.Fatalf("%s: %v", name, err)
+	}
+	debugf("%s: loaded %d hashes", name, len(set))
+	return set
+}
+
+// readNSRL reads the column for -hash from an NSRL RDS file.
+func readNSRL(r io.Reader, set map[string]bool) error {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+	cr.ReuseRecord = true
+
+	header, err := cr.Read()
+	if err != nil {
+		return err
+	}
+	col := -1
+	for i, name := range header {
+		if name == nsrlColumns[*flagHash] {
+			col = i
+		}
+	}
+	if col < 0 {
+		log.Fatalf("NSRL file has no %s hashes", *flagHash)
+	}
+
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if col >= len(rec) {
+			continue
+		}
+		h, err := decodeDigest(rec[col])
+		if err != nil {
+			return err
+		}
+		set[string(h)] = true
+	}
+}
+
+// readDigestList reads a list of hex or Base64 digests, one per line.
+func readDigestList(r io.Reader, set map[string]bool) error {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		h, err := decodeDigest(line)
+		if err != nil {
+			return err
+		}
+		set[string(h)] = true
+	}
+	return sc.Err()
+}
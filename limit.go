@@ -0,0 +1,99 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// byteSize is a flag.Value for sizes with an optional K, M, G, or T suffix
+// (powers of 1024), like curl's --limit-rate.
+type byteSize int64
+
+func byteSizeFlag(name string, value int64, usage string) *byteSize {
+	b := byteSize(value)
+	flag.Var(&b, name, usage)
+	return &b
+}
+
+func (b *byteSize) String() string {
+	n, suffix := int64(*b), ""
+	for _, s := range []string{"K", "M", "G", "T"} {
+		if n == 0 || n%1024 != 0 {
+			break
+		}
+		n, suffix = n/1024, s
+	}
+	return strconv.FormatInt(n, 10) + suffix
+}
+
+func (b *byteSize) Set(s string) error {
+	num, mult := s, int64(1)
+	if len(s) > 0 {
+		if i := strings.IndexByte("KMGT", strings.ToUpper(s)[len(s)-1]); i >= 0 {
+			num, mult = s[:len(s)-1], 1<<(10*(i+1))
+		}
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q", s)
+	}
+	*b = byteSize(n * mult)
+	return nil
+}
+
+// rateLimiter limits the rate at which some quantity (bytes, operations) is
+// consumed across all workers. Each caller reserves a slot in time for the
+// amount it consumes, and sleeps until that slot arrives.
+type rateLimiter struct {
+	mu   sync.Mutex
+	rate float64 // units per second
+	next time.Time
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: float64(rate)}
+}
+
+// wait blocks until n units may be consumed. A nil limiter never blocks.
+func (l *rateLimiter) wait(n int) {
+	if l == nil || n == 0 {
+		return
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(float64(n) / l.rate * float64(time.Second)))
+	l.mu.Unlock()
+
+	time.Sleep(delay)
+}
+
+// Limiters for -limit-rate and -limit-iops, or nil if not set.
+var byteLimiter, iopsLimiter *rateLimiter
+
+// meteredReader applies byteLimiter and iopsLimiter to reads from a file,
+// and records them in readMeter. Each read counts as one I/O operation.
+type meteredReader struct {
+	r io.Reader
+}
+
+func (m meteredReader) Read(p []byte) (int, error) {
+	iopsLimiter.wait(1)
+	start := time.Now()
+	n, err := m.r.Read(p)
+	readMeter.record(n, time.Since(start))
+	byteLimiter.wait(n)
+	return n, err
+}
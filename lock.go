@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"time"
+)
+
+// errLocked is the error for a file which is locked by another process, with
+// -skip-locked or -wait-locked. On Windows, that's a file which another
+// process has opened without sharing it for reading, or has locked a range
+// of. On Unix, only advisory locks which can be queried are seen: POSIX
+// record locks, which on the BSDs and macOS include flock() locks.
+var errLocked = errors.New("locked by another process")
+
+// lockAware reports whether files are checked for locks.
+func lockAware() bool {
+	return *flagSkipLocked || *flagWaitLocked > 0
+}
+
+// checkLocks validates -skip-locked and -wait-locked.
+func checkLocks(cmd string) {
+	if *flagWaitLocked < 0 {
+		log.Fatal("-wait-locked must not be negative")
+	}
+	if !lockAware() {
+		return
+	}
+	if !locksSupported {
+		log.Fatal("-skip-locked and -wait-locked are not supported on this platform")
+	}
+	if *flagSkipLocked && (*flagCheck != "" || cmd == "watch" || cmd == "gate") {
+		log.Fatal("-skip-locked cannot be used with check mode, watch, or gate")
+	}
+}
+
+// lockedError returns the error for a locked file.
+func lockedError(path string) error {
+	return &fs.PathError{Op: "read", Path: path, Err: errLocked}
+}
+
+// hashUnlocked hashes a file, waiting up to -wait-locked for it to be
+// unlocked if it's locked by another process. Files which were hashed after
+// waiting are marked as such.
+func hashUnlocked(hf hashFactory, task hashTask, buf []byte) hashResult {
+	deadline := time.Now().Add(*flagWaitLocked)
+	delay, wasLocked := 10*time.Millisecond, false
+	for {
+		r := hashWithRetries(hf, task, buf)
+		if !errors.Is(r.err, errLocked) {
+			r.wasLocked = wasLocked
+			return r
+		}
+		wasLocked = true
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return r
+		}
+		if delay > remaining {
+			delay = remaining
+		}
+		debugf("%s is locked, waiting %v", task.path, delay)
+		time.Sleep(delay)
+		if delay < time.Second {
+			delay *= 2
+		}
+	}
+}
+
+// checkLocked returns errLocked for a file which is locked, or whose open
+// or read failed because it's locked, and otherwise err.
+func checkLocked(path string, f fs.File, err error) error {
+	if !lockAware() {
+		return err
+	}
+	if err != nil && isLockError(err) || err == nil && f != nil && fileLocked(f) {
+		return lockedError(path)
+	}
+	return err
+}
@@ -0,0 +1,16 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris && !windows
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris,!windows
+
+package main
+
+import "io/fs"
+
+const locksSupported = false
+
+func fileLocked(f fs.File) bool {
+	return false
+}
+
+func isLockError(err error) bool {
+	return false
+}
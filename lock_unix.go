@@ -0,0 +1,32 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package main
+
+import (
+	"io/fs"
+
+	"golang.org/x/sys/unix"
+)
+
+const locksSupported = true
+
+// fileLocked reports whether another process holds a write lock on any part
+// of the file, which a writer would take.
+func fileLocked(f fs.File) bool {
+	fd, ok := f.(interface{ Fd() uintptr })
+	if !ok {
+		return false
+	}
+	lk := unix.Flock_t{Type: unix.F_RDLCK, Whence: 0}
+	if err := unix.FcntlFlock(fd.Fd(), unix.F_GETLK, &lk); err != nil {
+		return false
+	}
+	return lk.Type != unix.F_UNLCK
+}
+
+// isLockError reports whether an error is because of a lock. Unix locks are
+// advisory, so opening and reading are never refused.
+func isLockError(err error) bool {
+	return false
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+
+	"golang.org/x/sys/windows"
+)
+
+const locksSupported = true
+
+// fileLocked reports whether a file which could be opened is locked. On
+// Windows, locks are enforced, so that's only found by opening or reading.
+func fileLocked(f fs.File) bool {
+	return false
+}
+
+// isLockError reports whether another process has opened a file without
+// sharing it, or has locked the range being read.
+func isLockError(err error) bool {
+	return errors.Is(err, windows.ERROR_SHARING_VIOLATION) || errors.Is(err, windows.ERROR_LOCK_VIOLATION)
+}
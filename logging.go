@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log levels, for -log-level.
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarn
+	levelError
+	levelFatal
+)
+
+var levelNames = []string{"debug", "info", "warn", "error", "fatal"}
+
+// logLevel is the lowest level of message which is logged, from -log-level.
+var logLevel = levelInfo
+
+// logOutput is where log messages are written. -tui replaces it while the
+// display is showing.
+var (
+	logMu     sync.Mutex
+	logOutput io.Writer = os.Stderr
+)
+
+// logRecord is a log message with -log-format json.
+type logRecord struct {
+	Time  string `json:"time"`
+	Level string `json:"level"`
+	Msg   string `json:"msg"`
+}
+
+// checkLogging validates -log-level and -log-format, and sets up the log
+// package to write through logMessage. -v is the same as -log-level debug.
+func checkLogging() {
+	switch *flagLogFormat {
+	case "text", "json":
+	default:
+		log.Fatal("-log-format must be text or json")
+	}
+	level := *flagLogLevel
+	if *flagVerbose && !flagWasSet("log-level") {
+		level = "debug"
+	}
+	logLevel = -1
+	for l, name := range levelNames[:levelFatal] {
+		if level == name {
+			logLevel = l
+		}
+	}
+	if logLevel < 0 {
+		log.Fatal("-log-level must be debug, info, warn, or error")
+	}
+
+	// Everything else logs through the helpers below, so only fatal
+	// errors are left to the log package.
+	log.SetFlags(0)
+	log.SetOutput(fatalLog{})
+}
+
+type fatalLog struct{}
+
+func (fatalLog) Write(p []byte) (int, error) {
+	logMessage(levelFatal, strings.TrimSuffix(string(p), "\n"))
+	// log.Fatal exits without running deferred calls, so snapshots have to
+	// be cleaned up here.
+	releaseSnapshots()
+	return len(p), nil
+}
+
+func debugf(format string, v ...interface{}) { logf(levelDebug, format, v...) }
+func infof(format string, v ...interface{})  { logf(levelInfo, format, v...) }
+func warnf(format string, v ...interface{})  { logf(levelWarn, format, v...) }
+func errorf(format string, v ...interface{}) { logf(levelError, format, v...) }
+
+func logf(level int, format string, v ...interface{}) {
+	if level >= logLevel {
+		logMessage(level, fmt.Sprintf(format, v...))
+	}
+}
+
+// logMessage writes a message to logOutput in the -log-format. Text
+// messages look the same as the log package's, with warnings marked as such.
+func logMessage(level int, msg string) {
+	now := time.Now()
+	var line []byte
+	if *flagLogFormat == "json" {
+		line, _ = json.Marshal(logRecord{now.UTC().Format(time.RFC3339Nano), levelNames[level], msg})
+		line = append(line, '\n')
+	} else {
+		if level == levelWarn {
+			msg = "warning: " + msg
+		}
+		line = []byte(now.Format("2006/01/02 15:04:05 ") + msg + "\n")
+	}
+
+	logMu.Lock()
+	defer logMu.Unlock()
+	logOutput.Write(line)
+}
+
+// setLogOutput changes where log messages are written.
+func setLogOutput(w io.Writer) {
+	logMu.Lock()
+	logOutput = w
+	logMu.Unlock()
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// runLookup implements the lookup subcommand, which indexes a manifest by
+// hash and prints the paths of the files with each of the given digests. If
+// no digests are given, or a digest is "-", digests are read from standard
+// input, one per line. Exits with an error if no digest was found.
+func runLookup(manifest string, digests []string) {
+	entries, _, err := readManifest(manifest, "auto")
+	if err != nil {
+		log.Fatalf("%s: %v", manifest, err)
+	}
+	index := make(map[string][]string)
+	for _, e := range entries {
+		index[string(e.hash)] = append(index[string(e.hash)], e.path)
+	}
+
+	bw := bufio.NewWriter(os.Stdout)
+	defer bw.Flush()
+	found := false
+	lookup := func(digest string) {
+		h, err := decodeDigest(digest)
+		if err != nil {
+			log.Fatalf("invalid digest %q: %v", digest, err)
+		}
+		for _, p := range index[string(h)] {
+			fmt.Fprintf(bw, "%s  %s\n", digest, p)
+			found = true
+		}
+	}
+
+	if len(digests) == 0 {
+		digests = []string{"-"}
+	}
+	for _, digest := range digests {
+		if digest != "-" {
+			lookup(digest)
+			continue
+		}
+		sc := bufio.NewScanner(os.Stdin)
+		for sc.Scan() {
+			if d := strings.TrimSpace(sc.Text()); d != "" {
+				lookup(d)
+			}
+			// Answer each query as it arrives when used interactively
+			bw.Flush()
+		}
+		if err := sc.Err(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if !found {
+		bw.Flush()
+		os.Exit(1)
+	}
+}
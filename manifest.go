@@ -0,0 +1,541 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// manifestEntry is a single file listed in a manifest.
+type manifestEntry struct {
+	path string
+	hash []byte
+	algo string // hash algorithm, if the manifest says
+
+	// The file's size and mtime, if the manifest was written with -stat
+	size  int64
+	mtime time.Time
+}
+
+// bsdTags maps hash names to the names used for them in BSD-style
+// "TAG (path) = hash" lines, as printed by "sha256sum --tag" and friends.
+var bsdTags = map[string]string{
+	"adler32":     "ADLER32",
+	"blake2b-256": "BLAKE2b-256",
+	"blake2b-512": "BLAKE2b",
+	"blake2s":     "BLAKE2s",
+	"crc32":       "CRC32",
+	"md5":         "MD5",
+	"ripemd160":   "RMD160",
+	"sha1":        "SHA1",
+	"sha224":      "SHA224",
+	"sha256":      "SHA256",
+	"sha512":      "SHA512",
+	"whirlpool":   "WHIRLPOOL",
+}
+
+// hashByTag returns the hash name for a BSD-style tag, or "" if unknown.
+func hashByTag(tag string) string {
+	for name, t := range bsdTags {
+		if t == tag {
+			return name
+		}
+	}
+	return ""
+}
+
+// manifestHeader is the provenance recorded at the start of a text manifest
+// by -header.
+type manifestHeader struct {
+	algo      string
+	hashFor   []hashRule // the -hash-for rules, which take precedence over algo
+	covers    string     // the -digest-covers the manifest was written with
+	roots     []string
+	generated string
+}
+
+// headerRoots are the roots recorded in the -header.
+var headerRoots []string
+
+// writeHeader writes the -header comment to the start of a text manifest, if
+// it's enabled. comment is the manifest format's comment character.
+func writeHeader(w io.Writer, comment string) {
+	if !*flagHeader {
+		return
+	}
+	fields := []string{"hashtree", "v1"}
+	if *flagHash != "" {
+		fields = append(fields, "algo="+*flagHash)
+	}
+	for _, rule := range *flagHashFor {
+		fields = append(fields, "hash-for="+quoteHeaderValue(rule))
+	}
+	if *flagDigestCovers != "" {
+		fields = append(fields, "covers="+*flagDigestCovers)
+	}
+	for _, root := range absRoots(headerRoots) {
+		fields = append(fields, "root="+quoteHeaderValue(root))
+	}
+	fields = append(fields, "generated="+time.Now().UTC().Format(time.RFC3339))
+	fmt.Fprintf(w, "%s %s\n", comment, strings.Join(fields, " "))
+}
+
+// absRoots returns the absolute path of each root, where it can be found.
+func absRoots(roots []string) []string {
+	var abs []string
+	for _, root := range roots {
+		if a, err := filepath.Abs(root); err == nil {
+			root = a
+		}
+		abs = append(abs, root)
+	}
+	return abs
+}
+
+// quoteHeaderValue quotes a header value if it can't be written bare.
+func quoteHeaderValue(v string) string {
+	if v == "" || strings.ContainsAny(v, " \"") || strconv.Quote(v) != `"`+v+`"` {
+		return strconv.Quote(v)
+	}
+	return v
+}
+
+// parseHeader parses a "# hashtree v1 key=value..." header line (which
+// starts with ";" instead in SFV files). Unknown keys are ignored, so that
+// later versions can add to the header.
+func parseHeader(text string) (*manifestHeader, error) {
+	rest := text[len("# hashtree "):]
+	h := &manifestHeader{}
+	for first := true; ; first = false {
+		rest = strings.TrimLeft(rest, " ")
+		if rest == "" {
+			return h, nil
+		}
+		i := strings.IndexAny(rest, "= ")
+		if i < 0 {
+			i = len(rest)
+		}
+		key := rest[:i]
+		rest = rest[i:]
+		if first {
+			if key != "v1" {
+				return nil, fmt.Errorf("unsupported header version %q", key)
+			}
+			continue
+		}
+		if !strings.HasPrefix(rest, "=") {
+			continue
+		}
+		rest = rest[1:]
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			quoted, err := strconv.QuotedPrefix(rest)
+			if err != nil {
+				return nil, fmt.Errorf("malformed header: %w", err)
+			}
+			value, _ = strconv.Unquote(quoted)
+			rest = rest[len(quoted):]
+		} else {
+			i := strings.IndexByte(rest, ' ')
+			if i < 0 {
+				i = len(rest)
+			}
+			value, rest = rest[:i], rest[i:]
+		}
+
+		switch key {
+		case "algo":
+			h.algo = value
+		case "hash-for":
+			rule, err := parseHashRule(value)
+			if err != nil {
+				return nil, fmt.Errorf("malformed header: %w", err)
+			}
+			h.hashFor = append(h.hashFor, rule)
+		case "root":
+			h.roots = append(h.roots, value)
+		case "covers":
+			h.covers = value
+		case "generated":
+			h.generated = value
+		}
+	}
+}
+
+// readManifest reads a manifest which was written in the given output
+// format, along with its header if it has one. If format is "auto", the
+// format is detected from the manifest, and both hex and Base64 hashes are
+// accepted.
+func readManifest(name, format string) ([]manifestEntry, *manifestHeader, error) {
+	f, err := openManifest(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+
+	if format == "auto" {
+		format, err = detectFormat(br)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	var entries []manifestEntry
+	var header *manifestHeader
+	switch format {
+	case "auto-text":
+		entries, header, err = readTextManifest(newFooterReader(br), decodeDigest)
+	case "hex":
+		entries, header, err = readTextManifest(newFooterReader(br), hex.DecodeString)
+	case "base64":
+		entries, header, err = readTextManifest(newFooterReader(br), base64.StdEncoding.DecodeString)
+	case "binary":
+		entries, err = readBinaryManifest(br)
+	case "sfv":
+		entries, header, err = readSFVManifest(newFooterReader(br))
+	case "auto-json":
+		entries, err = readJSONManifest(br, decodeDigest)
+	case "json", "json-hex", "json-array", "by-hash":
+		entries, err = readJSONManifest(br, hex.DecodeString)
+	case "json-base64", "json-array-base64":
+		entries, err = readJSONManifest(br, base64.StdEncoding.DecodeString)
+	default:
+		err = fmt.Errorf("cannot read manifests in %s format", format)
+	}
+	if err == nil && *flagFooter && (format == "binary" || strings.Contains(format, "json")) {
+		err = fmt.Errorf("%s manifests don't have footers", format)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if header != nil {
+		for i := range entries {
+			if entries[i].algo == "" {
+				entries[i].algo = matchHashRules(header.hashFor, entries[i].path)
+			}
+			if entries[i].algo == "" {
+				entries[i].algo = header.algo
+			}
+		}
+	}
+	return entries, header, nil
+}
+
+// detectFormat looks at the start of a manifest to tell whether it's a binary
+// manifest, an SFV file, or in one of the JSON formats or the other
+// line-based text formats.
+func detectFormat(br *bufio.Reader) (string, error) {
+	if b, err := br.Peek(len(zstdMagic)); err == nil && string(b) == zstdMagic {
+		return "binary", nil
+	}
+	for n := 1; ; n++ {
+		b, err := br.Peek(n)
+		if err == io.EOF && len(b) == n-1 {
+			// An empty manifest can be read as any format.
+			return "auto-text", nil
+		} else if err != nil && err != io.EOF {
+			return "", err
+		}
+		switch b[n-1] {
+		case ' ', '\t', '\r', '\n':
+			continue
+		case '[', '{':
+			return "auto-json", nil
+		default:
+			if line := firstLine(br); strings.HasPrefix(line, ";") || isSFVLine(line) {
+				return "sfv", nil
+			}
+			return "auto-text", nil
+		}
+	}
+}
+
+// firstLine returns the first line which isn't blank or a comment, without
+// consuming anything. Only the buffered data is checked.
+func firstLine(br *bufio.Reader) string {
+	br.Peek(br.Size())
+	b, _ := br.Peek(br.Buffered())
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && line[0] != '#' {
+			return line
+		}
+	}
+	return ""
+}
+
+// decodeDigest decodes a hash which may be in either hex or Base64. Base64
+// hashes of all the supported lengths end in padding, so are never mistaken
+// for hex.
+func decodeDigest(s string) ([]byte, error) {
+	if h, err := hex.DecodeString(s); err == nil {
+		return h, nil
+	}
+	return base64.StdEncoding.DecodeString(s)
+}
+
+// readTextManifest reads lines in the "hash <spc><spc> filename" format, or
+// in the BSD-style "TAG (filename) = hash" format. Blank lines and lines
+// starting with "#" are ignored, except for a -header before the first entry.
+func readTextManifest(r io.Reader, decode func(string) ([]byte, error)) ([]manifestEntry, *manifestHeader, error) {
+	var entries []manifestEntry
+	var header *manifestHeader
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSuffix(sc.Text(), "\r")
+		if header == nil && len(entries) == 0 && strings.HasPrefix(text, "# hashtree ") {
+			var err error
+			if header, err = parseHeader(text); err != nil {
+				return nil, nil, fmt.Errorf("manifest line %d: %w", line, err)
+			}
+			continue
+		}
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		escaped := text[0] == '\\'
+		if escaped {
+			text = text[1:]
+		}
+
+		var e manifestEntry
+		var digest string
+		if i, j := strings.Index(text, " ("), strings.LastIndex(text, ") = "); i > 0 && j > i && !strings.Contains(text[:i], " ") {
+			// BSD-style line
+			e.algo = hashByTag(text[:i])
+			e.path, digest = text[i+2:j], text[j+4:]
+		} else if i := strings.IndexByte(text, ' '); i >= 0 && i+1 < len(text) && (text[i+1] == ' ' || text[i+1] == '*') {
+			// A space, then a space or the binary mode marker of
+			// "sha256sum -b"
+			digest, e.path = text[:i], text[i+2:]
+		} else {
+			return nil, nil, fmt.Errorf("manifest line %d: malformed line", line)
+		}
+
+		if escaped {
+			e.path = unescapePath(e.path)
+		}
+
+		h, err := decode(digest)
+		if err != nil {
+			return nil, nil, fmt.Errorf("manifest line %d: %w", line, err)
+		}
+		e.hash = h
+		entries = append(entries, e)
+	}
+	return entries, header, sc.Err()
+}
+
+// readJSONManifest reads either JSON lines or a JSON array of objects in the
+// jsonResult format.
+func readJSONManifest(br *bufio.Reader, decode func(string) ([]byte, error)) ([]manifestEntry, error) {
+	var entries []manifestEntry
+	add := func(jr jsonResult) error {
+		if jr.Warning != "" || jr.Provenance != nil || jr.Deleted {
+			return nil
+		}
+		h, err := decode(jr.Hash)
+		if err != nil {
+			return fmt.Errorf("manifest entry %q: %w", jr.Path, err)
+		}
+		if jr.Paths != nil {
+			// A group of files with the same hash, from -fmt by-hash
+			for _, p := range jr.Paths {
+				entries = append(entries, manifestEntry{path: p, hash: h, algo: jr.Algo})
+			}
+			return nil
+		}
+		e := manifestEntry{path: jr.Path, hash: h, algo: jr.Algo}
+		if jr.PathB64 != "" {
+			p, err := base64.StdEncoding.DecodeString(jr.PathB64)
+			if err != nil {
+				return fmt.Errorf("manifest entry %q: invalid path_b64: %w", jr.Path, err)
+			}
+			e.path = string(p)
+		}
+		if jr.Size != nil && jr.MTime != "" {
+			if e.mtime, err = time.Parse(time.RFC3339Nano, jr.MTime); err != nil {
+				return fmt.Errorf("manifest entry %q: %w", jr.Path, err)
+			}
+			e.size = *jr.Size
+		}
+		entries = append(entries, e)
+		return nil
+	}
+
+	dec := json.NewDecoder(br)
+	if b, err := peekNonSpace(br); err == nil && b == '[' {
+		var results []jsonResult
+		if err := dec.Decode(&results); err != nil {
+			return nil, err
+		}
+		for _, jr := range results {
+			if err := add(jr); err != nil {
+				return nil, err
+			}
+		}
+		return entries, nil
+	}
+
+	for {
+		var jr jsonResult
+		if err := dec.Decode(&jr); err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if err := add(jr); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// peekNonSpace returns the first non-whitespace byte in br without consuming
+// anything.
+func peekNonSpace(br *bufio.Reader) (byte, error) {
+	for n := 1; ; n++ {
+		b, err := br.Peek(n)
+		if err != nil {
+			return 0, err
+		}
+		switch b[n-1] {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		return b[n-1], nil
+	}
+}
+
+// detectAlgorithm guesses the hash algorithm used in a manifest, from the
+// algorithms named in BSD-style lines if there are any, or from the length of
+// the hashes otherwise. Where several algorithms have the same length, the
+// most commonly used one is assumed. It returns "" if the manifest is empty
+// or the hashes are inconsistent.
+func detectAlgorithm(entries []manifestEntry) string {
+	algo := ""
+	for i, e := range entries {
+		a := e.algo
+		if a == "" {
+			a = algorithmByLength(len(e.hash))
+		}
+		if i > 0 && a != algo {
+			return ""
+		}
+		algo = a
+	}
+	return algo
+}
+
+func algorithmByLength(n int) string {
+	switch n {
+	case 4:
+		return "crc32"
+	case 16:
+		return "md5"
+	case 20:
+		return "sha1"
+	case 28:
+		return "sha224"
+	case 32:
+		return "sha256"
+	case 64:
+		return "sha512"
+	default:
+		return ""
+	}
+}
+
+// entryAlgos maps the paths in a manifest which use a different hash
+// algorithm from -hash to their algorithm, so that manifests can be migrated
+// from one algorithm to another gradually. mixedHashes has the hash function
+// for each of them, and for each -hash-for rule. Both are nil if every file
+// uses -hash.
+var (
+	entryAlgos  map[string]string
+	mixedHashes map[string]hashFactory
+)
+
+// setEntryAlgorithms works out which hash algorithm each entry in a manifest
+// uses, and records those which don't use -hash in entryAlgos. The
+// algorithm given in the manifest is used if there is one. Otherwise, it's
+// the one selected by -hash-for, or -hash if that was given explicitly, or
+// guessed from the hash's length.
+func setEntryAlgorithms(manifest string, entries []manifestEntry) {
+	counts := make(map[string]int)
+	for _, e := range entries {
+		algo := e.algo
+		if algo == "" {
+			algo = ruleAlgo(e.path)
+		}
+		if algo == "" && !flagWasSet("hash") {
+			algo = algorithmByLength(len(e.hash))
+		}
+		if algo == "" || algo == *flagHash {
+			continue
+		}
+		if entryAlgos == nil {
+			entryAlgos = make(map[string]string)
+		}
+		if mixedHashes == nil {
+			mixedHashes = make(map[string]hashFactory)
+		}
+		entryAlgos[e.path] = algo
+		counts[algo]++
+	}
+
+	debugf("%s: using %s hashes", manifest, *flagHash)
+	for algo, n := range counts {
+		debugf("%s: using %s hashes for %d files", manifest, algo, n)
+		mixedHashes[algo] = nil // set by loadMixedHashes
+	}
+
+	// From here on, the manifest decides which algorithm each file uses
+	hashRules = nil
+}
+
+// loadMixedHashes sets up the hash functions in mixedHashes.
+func loadMixedHashes(key []byte) {
+	for _, r := range hashRules {
+		if r.algo == *flagHash {
+			continue
+		}
+		if mixedHashes == nil {
+			mixedHashes = make(map[string]hashFactory)
+		}
+		mixedHashes[r.algo] = nil
+	}
+	for algo := range mixedHashes {
+		mixedHashes[algo] = poolHashes(hashByName(algo, key))
+	}
+}
+
+// hashFor returns the hash function to use for a file: the one for its
+// algorithm, or hf if it uses -hash.
+func hashFor(hf hashFactory, path string) hashFactory {
+	if algo := algoFor(path); algo != "" {
+		return mixedHashes[algo]
+	}
+	return hf
+}
+
+// algoFor returns the hash algorithm for a file, from entryAlgos or
+// -hash-for, or "" if it uses -hash.
+func algoFor(path string) string {
+	if algo, ok := entryAlgos[path]; ok {
+		return algo
+	}
+	if algo := ruleAlgo(path); algo != *flagHash {
+		return algo
+	}
+	return ""
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+)
+
+// errorLimit counts the files which were hashed and the files which couldn't
+// be, for -max-errors.
+type errorLimit struct {
+	files, errors int
+	last          error
+}
+
+// record counts a result, and reports whether it takes the number of errors
+// to -max-errors.
+func (l *errorLimit) record(r hashResult) bool {
+	if r.status != "" {
+		return false
+	}
+	if r.err == nil {
+		l.files++
+		return false
+	}
+	l.errors++
+	l.last = r.err
+	return *flagMaxErrors > 0 && l.errors >= *flagMaxErrors
+}
+
+// abort ends the run, with a summary of what was done. The output so far is
+// written, except in check mode, where the files which weren't checked would
+// be reported as missing.
+func (l *errorLimit) abort(hp hashPrinter, cp *checkPrinter) {
+	theTUI.stop()
+	theStats.write()
+	theProvenance.write()
+	summary := fmt.Sprintf("%d files hashed", l.files)
+	if cp != nil {
+		summary = cp.summary()
+	} else if c, ok := hp.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			errorf("%v", err)
+		}
+	}
+	log.Fatalf("aborting after %d errors (-max-errors): %s; the last error was: %v", l.errors, summary, l.last)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"hash"
+	"log"
+	"runtime"
+	"runtime/debug"
+	"sync"
+)
+
+// minGCPercent is the lowest GC target -memory-limit sets, so that a heap
+// which is already at the limit doesn't make the collector run constantly.
+const minGCPercent = 10
+
+// ballast is a large allocation which is never touched, for -ballast. It
+// counts towards the heap which the collector paces itself against, but
+// the kernel never backs it with memory.
+var ballast []byte
+
+// checkMemory applies -gc-percent, -ballast and -memory-limit.
+func checkMemory() {
+	if flagWasSet("gc-percent") {
+		if *flagGCPercent < -1 {
+			log.Fatal("-gc-percent must be -1 (off), or at least 0")
+		}
+		debug.SetGCPercent(*flagGCPercent)
+	}
+	if *flagBallast > 0 {
+		ballast = make([]byte, *flagBallast)
+	}
+	if *flagMemoryLimit > 0 {
+		if !flagWasSet("sort-mem") && *flagSortMem > *flagMemoryLimit/4 {
+			*flagSortMem = *flagMemoryLimit / 4
+		}
+		startGCTuner(int64(*flagMemoryLimit))
+	}
+}
+
+// gcTuner lowers the GC target as the live heap grows towards
+// -memory-limit, so that the heap's peak, which is the live heap plus the
+// target percentage of it, stays under the limit. It's retuned after each
+// collection, and never raises the target above -gc-percent (or GOGC).
+type gcTuner struct {
+	limit   int64
+	base    int // the target without a limit; negative if collection is off
+	percent int
+}
+
+// gcSentinel is garbage as soon as it's allocated, so its finalizer runs
+// after each collection.
+type gcSentinel struct {
+	t *gcTuner
+}
+
+func startGCTuner(limit int64) {
+	base := debug.SetGCPercent(100)
+	debug.SetGCPercent(base)
+	t := &gcTuner{limit: limit, base: base, percent: base}
+	// Tune once now, since with collection off there may never be a
+	// collection to tune after
+	t.tune()
+	runtime.SetFinalizer(&gcSentinel{t}, finishGCCycle)
+}
+
+func finishGCCycle(s *gcSentinel) {
+	s.t.tune()
+	runtime.SetFinalizer(&gcSentinel{s.t}, finishGCCycle)
+}
+
+func (t *gcTuner) tune() {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	live := int64(ms.HeapAlloc)
+	if live <= 0 {
+		return
+	}
+
+	// The ballast is part of the heap the target applies to, but isn't
+	// really using memory, so the limit is raised to match
+	headroom := t.limit + int64(len(ballast)) - live
+	percent := minGCPercent
+	if headroom > 0 {
+		percent = int(headroom * 100 / live)
+	}
+	if t.base >= 0 && percent > t.base {
+		percent = t.base
+	}
+	if percent < minGCPercent {
+		percent = minGCPercent
+	}
+	if percent != t.percent {
+		debugf("GC target is now %d%% of the %s live heap", percent, formatBytes(live))
+		t.percent = percent
+		debug.SetGCPercent(percent)
+	}
+}
+
+// pooledHash is a hash which is returned to its pool once its result has
+// been taken, by releaseHash. Files are hashed with a new hash each, and a
+// large run would otherwise allocate millions of them.
+type pooledHash struct {
+	hash.Hash
+	pool *sync.Pool
+}
+
+// poolHashes returns a hashFactory which reuses hashes released with
+// releaseHash. Hashes which are finished explicitly, such as those of -hash
+// exec:, are never reused.
+func poolHashes(hf hashFactory) hashFactory {
+	if _, ok := hf().(hashFinisher); ok {
+		return hf
+	}
+	pool := &sync.Pool{}
+	pool.New = func() interface{} {
+		return &pooledHash{hf(), pool}
+	}
+	return func() hash.Hash {
+		return pool.Get().(*pooledHash)
+	}
+}
+
+// releaseHash returns a hash to its pool, if it came from one. It mustn't
+// be used again.
+func releaseHash(h hash.Hash) {
+	if ph, ok := h.(*pooledHash); ok {
+		ph.Reset()
+		ph.pool.Put(ph)
+	}
+}
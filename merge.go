@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+// runMerge implements the merge subcommand, which combines manifests (in the
+// -fmt format) from several runs into one, sorted by path. Paths which appear
+// in more than one manifest with different hashes are resolved according to
+// -conflict.
+func runMerge(manifests []string) {
+	switch *flagConflict {
+	case "error", "newest":
+	default:
+		log.Fatal("-conflict must be error or newest")
+	}
+
+	type mergedEntry struct {
+		hash   []byte
+		algo   string
+		source string
+		mtime  time.Time
+	}
+	merged := make(map[string]mergedEntry)
+	algos := make(map[string]bool)
+
+	for _, name := range manifests {
+		fi, err := os.Stat(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		entries, header, err := readManifest(name, "auto")
+		if err != nil {
+			log.Fatalf("%s: %v", name, err)
+		}
+		algo := detectAlgorithm(entries)
+		algos[algo] = true
+		if header != nil {
+			headerRoots = append(headerRoots, header.roots...)
+		}
+
+		for _, e := range entries {
+			prev, ok := merged[e.path]
+			if ok && string(prev.hash) != string(e.hash) {
+				if *flagConflict == "error" {
+					log.Fatalf("%s: hash conflict between %s and %s", e.path, prev.source, name)
+				}
+				if !fi.ModTime().After(prev.mtime) {
+					continue
+				}
+			}
+			entryAlgo := algo
+			if e.algo != "" {
+				entryAlgo = e.algo
+			}
+			merged[e.path] = mergedEntry{e.hash, entryAlgo, name, fi.ModTime()}
+		}
+	}
+
+	paths := make([]string, 0, len(merged))
+	for p := range merged {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	out := *flagOutput
+	if out == "" {
+		out = "-"
+	}
+	w, err := createOutput(out)
+	if err != nil {
+		log.Fatal(err)
+	}
+	bw := bufio.NewWriter(w)
+
+	// Record the inputs' hash function in the -header, if they agree
+	if !flagWasSet("hash") {
+		*flagHash = ""
+		if len(algos) == 1 {
+			for algo := range algos {
+				*flagHash = algo
+			}
+		}
+	}
+	hp := newHashPrinter(*flagFmt, bw)
+	for _, p := range paths {
+		hp.Print(hashResult{path: p, hash: merged[p].hash, algo: merged[p].algo})
+	}
+	if c, ok := hp.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		log.Fatal(fmt.Errorf("writing merged manifest: %w", err))
+	}
+	if err := w.Close(); err != nil {
+		log.Fatal(fmt.Errorf("writing merged manifest: %w", err))
+	}
+}
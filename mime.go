@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// sniffLen is how much of each file is kept to detect its type, as for
+// http.DetectContentType.
+const sniffLen = 512
+
+// sniffer keeps the first bytes written to it, for -mime.
+type sniffer struct {
+	buf []byte
+}
+
+func (s *sniffer) Write(p []byte) (int, error) {
+	if n := sniffLen - len(s.buf); n > 0 {
+		if n > len(p) {
+			n = len(p)
+		}
+		s.buf = append(s.buf, p[:n]...)
+	}
+	return len(p), nil
+}
+
+// magicTypes are signatures of common file types which
+// http.DetectContentType doesn't know, as it only covers types a browser
+// needs to handle.
+var magicTypes = []struct {
+	offset int
+	magic  string
+	mime   string
+}{
+	{0, "\x7fELF", "application/x-executable"},
+	{0, "MZ", "application/vnd.microsoft.portable-executable"},
+	{0, "\xfe\xed\xfa\xce", "application/x-mach-binary"},
+	{0, "\xfe\xed\xfa\xcf", "application/x-mach-binary"},
+	{0, "\xce\xfa\xed\xfe", "application/x-mach-binary"},
+	{0, "\xcf\xfa\xed\xfe", "application/x-mach-binary"},
+	{0, "\x28\xb5\x2f\xfd", "application/zstd"},
+	{0, "\xfd7zXZ\x00", "application/x-xz"},
+	{0, "BZh", "application/x-bzip2"},
+	{0, "7z\xbc\xaf\x27\x1c", "application/x-7z-compressed"},
+	{0, "SQLite format 3\x00", "application/vnd.sqlite3"},
+	{0, "age-encryption.org/v1\n", "application/x-age-encrypted"},
+	{257, "ustar", "application/x-tar"},
+}
+
+// detectMIME returns the media type of a file from its first bytes.
+func detectMIME(data []byte) string {
+	if len(data) == 0 {
+		// As file(1) reports it
+		return "inode/x-empty"
+	}
+	mime := http.DetectContentType(data)
+	if mime != "application/octet-stream" {
+		return mime
+	}
+	for _, m := range magicTypes {
+		if len(data) >= m.offset+len(m.magic) && bytes.HasPrefix(data[m.offset:], []byte(m.magic)) {
+			return m.mime
+		}
+	}
+	return mime
+}
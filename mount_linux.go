@@ -0,0 +1,502 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// The mount subcommand serves a read-only view of a directory through FUSE,
+// with only the files listed in a manifest. Each file is hashed when it's
+// opened, and can only be opened if it matches the manifest. Reads fail if
+// the file has changed since then, as far as its inode, size, and times
+// show. Files which have been verified, and haven't changed since, aren't
+// hashed again.
+
+// mountTTL is how long the kernel may cache names and attributes.
+const mountTTL = time.Second
+
+// mountNode is a file or directory in the view.
+type mountNode struct {
+	id       uint64
+	parent   uint64
+	path     string // relative to the source directory
+	dir      bool
+	children map[string]*mountNode
+	names    []string // of the children, sorted
+
+	hash []byte
+	hf   hashFactory
+}
+
+// mountStamp identifies a file's contents, as of when it was verified.
+type mountStamp struct {
+	dev, ino     uint64
+	size         int64
+	mtime, ctime unix.Timespec
+}
+
+// mountHandle is a file which was opened, and verified.
+type mountHandle struct {
+	node  *mountNode
+	f     *os.File
+	stamp mountStamp
+}
+
+// mountTree is the view of a manifest's files.
+type mountTree struct {
+	src   string
+	nodes []*mountNode // by ID, from 1, which is the root
+	start time.Time
+
+	mu       sync.Mutex
+	verified map[uint64]mountStamp // by node ID
+	handles  map[uint64]*mountHandle
+	nextFh   uint64
+}
+
+// runMount implements the mount subcommand, which serves src at mountpoint
+// until it's unmounted, or interrupted.
+func runMount(manifest, src, mountpoint string) {
+	if fi, err := os.Stat(src); err != nil {
+		log.Fatal(err)
+	} else if !fi.IsDir() {
+		log.Fatalf("%s is not a directory", src)
+	}
+	t := newMountTree(manifest, src)
+
+	c, err := fuseMount(mountpoint)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer c.close()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		infof("unmounting %s", mountpoint)
+		if err := c.unmount(); err != nil {
+			errorf("unmounting %s: %v", mountpoint, err)
+		}
+	}()
+
+	files := 0
+	for _, n := range t.nodes {
+		if !n.dir {
+			files++
+		}
+	}
+	infof("serving the %d files in %s from %s at %s", files, manifest, src, mountpoint)
+	if err := t.serve(c); err != nil {
+		c.unmount()
+		log.Fatal(err)
+	}
+}
+
+func newMountTree(manifest, src string) *mountTree {
+	entries, header, err := readManifest(manifest, "auto")
+	if err != nil {
+		log.Fatalf("%s: %v", manifest, err)
+	}
+	if *flagDigestCovers != "" || header != nil && header.covers != "" {
+		log.Fatal("mount can't verify manifests made with -digest-covers")
+	}
+	key, err := hex.DecodeString(*flagKey)
+	if err != nil {
+		log.Fatal("invalid -key: ", err)
+	}
+
+	t := &mountTree{
+		src:      src,
+		start:    time.Now(),
+		verified: make(map[uint64]mountStamp),
+		handles:  make(map[uint64]*mountHandle),
+	}
+	root := t.add(nil, "", true)
+	hashes := make(map[string]hashFactory)
+entries:
+	for _, e := range entries {
+		if e.path == "" || strings.HasPrefix(e.path, "/") || strings.Contains("/"+e.path+"/", "/../") {
+			warnf("%s: not a relative path, so it isn't mounted", e.path)
+			continue
+		}
+		algo := e.algo
+		if algo == "" {
+			algo = *flagHash
+		}
+		if hashes[algo] == nil {
+			hashes[algo] = hashByName(algo, key)
+		}
+
+		dir, names := root, strings.Split(e.path, "/")
+		for _, name := range names[:len(names)-1] {
+			if name == "" || name == "." {
+				continue
+			}
+			child := dir.children[name]
+			if child == nil {
+				child = t.add(dir, name, true)
+			} else if !child.dir {
+				warnf("%s: inside another file, so it isn't mounted", e.path)
+				continue entries
+			}
+			dir = child
+		}
+		name := names[len(names)-1]
+		if dir.children[name] != nil {
+			warnf("%s: listed more than once, or a directory of other files, so it isn't mounted", e.path)
+			continue
+		}
+		f := t.add(dir, name, false)
+		f.hash, f.hf = e.hash, hashes[algo]
+	}
+	for _, n := range t.nodes {
+		sort.Strings(n.names)
+	}
+	return t
+}
+
+// add adds a node to the view, as a child of parent, unless it's the root.
+func (t *mountTree) add(parent *mountNode, name string, dir bool) *mountNode {
+	n := &mountNode{id: uint64(len(t.nodes) + 1), parent: fuseRootID, dir: dir}
+	if dir {
+		n.children = make(map[string]*mountNode)
+	}
+	if parent != nil {
+		n.parent, n.path = parent.id, path.Join(parent.path, name)
+		parent.children[name] = n
+		parent.names = append(parent.names, name)
+	}
+	t.nodes = append(t.nodes, n)
+	return n
+}
+
+func (t *mountTree) node(id uint64) *mountNode {
+	if id < 1 || id > uint64(len(t.nodes)) {
+		return nil
+	}
+	return t.nodes[id-1]
+}
+
+// serve handles requests until the filesystem is unmounted. Opening and
+// reading files are handled concurrently, since opening a file hashes it.
+func (t *mountTree) serve(c *fuseConn) error {
+	buf := make([]byte, fuseBufSize)
+	for {
+		req, err := c.read(buf)
+		if err != nil || req == nil {
+			return err
+		}
+		switch req.Opcode {
+		case fuseOpen, fuseRead:
+			go t.handle(c, req)
+		case fuseDestroy:
+			c.reply(req, 0, nil)
+			return nil
+		default:
+			t.handle(c, req)
+		}
+	}
+}
+
+func (t *mountTree) handle(c *fuseConn, req *fuseRequest) {
+	n := t.node(req.NodeID)
+	if n == nil && req.Opcode != fuseInit && req.Opcode != fuseStatfs {
+		c.reply(req, unix.ENOENT, nil)
+		return
+	}
+	switch req.Opcode {
+	case fuseInit:
+		in := (*fuseInitIn)(unsafe.Pointer(&req.body[0]))
+		if in.Major < fuseMajor || in.Major == fuseMajor && in.Minor < fuseMinMinor {
+			log.Fatalf("the kernel's FUSE version, %d.%d, is too old", in.Major, in.Minor)
+		}
+		out := fuseInitOut{
+			Major:               fuseMajor,
+			Minor:               fuseMinor,
+			MaxReadahead:        in.MaxReadahead,
+			Flags:               in.Flags & fuseAsyncRead,
+			MaxBackground:       16,
+			CongestionThreshold: 12,
+			MaxWrite:            fuseMaxWrite,
+			TimeGran:            1,
+		}
+		size := unsafe.Sizeof(out)
+		if in.Major == fuseMajor && in.Minor < fuseMinor {
+			out.Minor = in.Minor
+			if in.Minor < fuseCompatInitMinor {
+				size = fuseCompatInitOutSize
+			}
+		}
+		c.reply(req, 0, fuseBytes(unsafe.Pointer(&out), size))
+
+	case fuseLookup:
+		name := string(req.body)
+		if i := strings.IndexByte(name, 0); i >= 0 {
+			name = name[:i]
+		}
+		child := n.children[name]
+		if child == nil {
+			c.reply(req, unix.ENOENT, nil)
+			return
+		}
+		attr, errno := t.attr(child)
+		if errno != 0 {
+			c.reply(req, errno, nil)
+			return
+		}
+		out := fuseEntryOut{NodeID: child.id, EntryValid: uint64(mountTTL / time.Second), AttrValid: uint64(mountTTL / time.Second), Attr: attr}
+		c.reply(req, 0, fuseBytes(unsafe.Pointer(&out), unsafe.Sizeof(out)))
+
+	case fuseGetattr:
+		attr, errno := t.attr(n)
+		if errno != 0 {
+			c.reply(req, errno, nil)
+			return
+		}
+		out := fuseAttrOut{AttrValid: uint64(mountTTL / time.Second), Attr: attr}
+		c.reply(req, 0, fuseBytes(unsafe.Pointer(&out), unsafe.Sizeof(out)))
+
+	case fuseOpendir:
+		if !n.dir {
+			c.reply(req, unix.ENOTDIR, nil)
+			return
+		}
+		var out fuseOpenOut
+		c.reply(req, 0, fuseBytes(unsafe.Pointer(&out), unsafe.Sizeof(out)))
+
+	case fuseReaddir:
+		in := (*fuseReadIn)(unsafe.Pointer(&req.body[0]))
+		c.reply(req, 0, t.readdir(n, in.Offset, int(in.Size)))
+
+	case fuseOpen:
+		in := (*fuseOpenIn)(unsafe.Pointer(&req.body[0]))
+		if n.dir {
+			c.reply(req, unix.EISDIR, nil)
+			return
+		} else if in.Flags&unix.O_ACCMODE != unix.O_RDONLY {
+			c.reply(req, unix.EROFS, nil)
+			return
+		}
+		fh, errno := t.open(n)
+		out := fuseOpenOut{Fh: fh}
+		c.reply(req, errno, fuseBytes(unsafe.Pointer(&out), unsafe.Sizeof(out)))
+
+	case fuseRead:
+		in := (*fuseReadIn)(unsafe.Pointer(&req.body[0]))
+		data, errno := t.read(in.Fh, int64(in.Offset), int(in.Size))
+		c.reply(req, errno, data)
+
+	case fuseRelease:
+		in := (*fuseReleaseIn)(unsafe.Pointer(&req.body[0]))
+		t.mu.Lock()
+		if h := t.handles[in.Fh]; h != nil {
+			h.f.Close()
+			delete(t.handles, in.Fh)
+		}
+		t.mu.Unlock()
+		c.reply(req, 0, nil)
+
+	case fuseReleasedir, fuseFlush:
+		c.reply(req, 0, nil)
+
+	case fuseAccess:
+		in := (*fuseAccessIn)(unsafe.Pointer(&req.body[0]))
+		if in.Mask&unix.W_OK != 0 {
+			c.reply(req, unix.EROFS, nil)
+		} else {
+			c.reply(req, 0, nil)
+		}
+
+	case fuseStatfs:
+		out := fuseKstatfs{Files: uint64(len(t.nodes)), Bsize: 4096, Namelen: 255, Frsize: 4096}
+		c.reply(req, 0, fuseBytes(unsafe.Pointer(&out), unsafe.Sizeof(out)))
+
+	case fuseForget, fuseBatchForget, fuseInterrupt:
+		// Nodes live as long as the mount, and these have no reply
+
+	default:
+		c.reply(req, unix.ENOSYS, nil)
+	}
+}
+
+// attr returns the attributes of a node. Files have the size and times of
+// the file in the source directory, and all are read-only.
+func (t *mountTree) attr(n *mountNode) (fuseAttr, unix.Errno) {
+	a := fuseAttr{Ino: n.id, UID: uint32(os.Getuid()), GID: uint32(os.Getgid()), Blksize: 4096}
+	if n.dir {
+		a.Mode, a.Nlink = unix.S_IFDIR|0555, 2
+		a.Mtime, a.Mtimensec = uint64(t.start.Unix()), uint32(t.start.Nanosecond())
+		a.Atime, a.Atimensec, a.Ctime, a.Ctimensec = a.Mtime, a.Mtimensec, a.Mtime, a.Mtimensec
+		return a, 0
+	}
+	var st unix.Stat_t
+	if err := unix.Stat(filepath.Join(t.src, n.path), &st); err != nil {
+		return a, errnoOf(err)
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFREG {
+		return a, unix.EIO
+	}
+	a.Mode, a.Nlink = unix.S_IFREG|0444, 1
+	a.Size, a.Blocks = uint64(st.Size), uint64(st.Blocks)
+	a.Atime, a.Atimensec = uint64(st.Atim.Sec), uint32(st.Atim.Nsec)
+	a.Mtime, a.Mtimensec = uint64(st.Mtim.Sec), uint32(st.Mtim.Nsec)
+	a.Ctime, a.Ctimensec = uint64(st.Ctim.Sec), uint32(st.Ctim.Nsec)
+	return a, 0
+}
+
+// readdir returns the entries of a directory from the given offset, as many
+// as fit in size bytes. Offsets count ".", "..", and then the children.
+func (t *mountTree) readdir(n *mountNode, offset uint64, size int) []byte {
+	var buf []byte
+	for i := offset; i < uint64(len(n.names))+2; i++ {
+		var name string
+		var id uint64
+		typ := uint32(unix.DT_DIR)
+		switch i {
+		case 0:
+			name, id = ".", n.id
+		case 1:
+			name, id = "..", n.parent
+		default:
+			name = n.names[i-2]
+			child := n.children[name]
+			id = child.id
+			if !child.dir {
+				typ = unix.DT_REG
+			}
+		}
+		d := fuseDirent{Ino: id, Off: i + 1, Namelen: uint32(len(name)), Type: typ}
+		entry := append(fuseBytes(unsafe.Pointer(&d), unsafe.Sizeof(d)), name...)
+		for len(entry)%8 != 0 {
+			entry = append(entry, 0)
+		}
+		if len(buf)+len(entry) > size {
+			break
+		}
+		buf = append(buf, entry...)
+	}
+	return buf
+}
+
+// open opens a file, and verifies it against the manifest, unless it was
+// verified before and hasn't changed since.
+func (t *mountTree) open(n *mountNode) (uint64, unix.Errno) {
+	f, err := os.Open(filepath.Join(t.src, n.path))
+	if err != nil {
+		status := statusFailed
+		if errors.Is(err, fs.ErrNotExist) {
+			status = statusMissing
+		}
+		t.reject(n, status, err)
+		return 0, errnoOf(err)
+	}
+	stamp, err := stampOf(f)
+	if err != nil {
+		f.Close()
+		return 0, errnoOf(err)
+	}
+
+	t.mu.Lock()
+	verified := t.verified[n.id] == stamp
+	t.mu.Unlock()
+	if !verified {
+		if err := t.verify(n, f, stamp); err != nil {
+			f.Close()
+			t.reject(n, statusFailed, err)
+			return 0, unix.EIO
+		}
+		debugf("%s: verified", n.path)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.verified[n.id] = stamp
+	t.nextFh++
+	t.handles[t.nextFh] = &mountHandle{node: n, f: f, stamp: stamp}
+	return t.nextFh, 0
+}
+
+// verify hashes a file, and compares its hash with the manifest's.
+func (t *mountTree) verify(n *mountNode, f *os.File, stamp mountStamp) error {
+	h := n.hf()
+	if _, err := io.CopyBuffer(h, f, make([]byte, 1024*1024)); err != nil {
+		return err
+	}
+	sum, err := sumHash(h)
+	if err != nil {
+		return err
+	}
+	if after, err := stampOf(f); err != nil {
+		return err
+	} else if after != stamp {
+		return errors.New("changed while it was being verified")
+	}
+	if string(sum) != string(n.hash) {
+		return errors.New("doesn't match the manifest")
+	}
+	return nil
+}
+
+// read reads from an open file, failing if it has changed since it was
+// verified.
+func (t *mountTree) read(fh uint64, offset int64, size int) ([]byte, unix.Errno) {
+	t.mu.Lock()
+	h := t.handles[fh]
+	t.mu.Unlock()
+	if h == nil {
+		return nil, unix.EBADF
+	}
+	buf := make([]byte, size)
+	n, err := h.f.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return nil, errnoOf(err)
+	}
+	if stamp, err := stampOf(h.f); err != nil {
+		return nil, errnoOf(err)
+	} else if stamp != h.stamp {
+		t.mu.Lock()
+		delete(t.verified, h.node.id)
+		t.mu.Unlock()
+		t.reject(h.node, statusModified, errors.New("changed since it was verified"))
+		return nil, unix.EIO
+	}
+	return buf[:n], 0
+}
+
+// reject reports a file which can't be opened or read.
+func (t *mountTree) reject(n *mountNode, status string, err error) {
+	warnf("%s: %s (%v)", n.path, status, err)
+	notifyMismatch(alert{Path: n.path, Status: status, Error: err.Error()})
+}
+
+func stampOf(f *os.File) (mountStamp, error) {
+	var st unix.Stat_t
+	if err := unix.Fstat(int(f.Fd()), &st); err != nil {
+		return mountStamp{}, err
+	}
+	return mountStamp{uint64(st.Dev), uint64(st.Ino), st.Size, st.Mtim, st.Ctim}, nil
+}
+
+// errnoOf returns the errno behind an error, or EIO.
+func errnoOf(err error) unix.Errno {
+	var errno unix.Errno
+	if errors.As(err, &errno) {
+		return errno
+	}
+	return unix.EIO
+}
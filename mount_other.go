@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "log"
+
+func runMount(manifest, src, mountpoint string) {
+	log.Fatal("mount is only supported on Linux")
+}
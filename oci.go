@@ -0,0 +1,431 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// ociDescriptor is a reference to a blob in an OCI image layout.
+type ociDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+type ociIndex struct {
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+type ociManifest struct {
+	Config ociDescriptor   `json:"config"`
+	Layers []ociDescriptor `json:"layers"`
+}
+
+type ociConfig struct {
+	RootFS struct {
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+}
+
+// dockerManifest is an entry in the manifest.json of a "docker save" archive.
+type dockerManifest struct {
+	Config string
+	Layers []string
+}
+
+// ociVerifier checks the blobs of an image layout against their digests,
+// printing the outcome for each in the same style as check mode.
+type ociVerifier struct {
+	dir      string
+	checked  map[string]bool
+	failures int
+
+	// files receives the hash of each file in each layer, with
+	// -oci-files.
+	files hashPrinter
+	hf    hashFactory
+}
+
+// runOCIVerify implements the oci-verify subcommand, which verifies an OCI
+// image layout, or an extracted "docker save" archive.
+func runOCIVerify(dir string) {
+	ov := &ociVerifier{dir: dir, checked: make(map[string]bool)}
+
+	var out io.WriteCloser
+	var bw *bufio.Writer
+	if *flagOCIFiles != "" {
+		var err error
+		if out, err = createOutput(*flagOCIFiles); err != nil {
+			log.Fatal(err)
+		}
+		bw = bufio.NewWriter(out)
+		key, err := hex.DecodeString(*flagKey)
+		if err != nil {
+			log.Fatal("invalid -key: ", err)
+		}
+		ov.hf = hashByName(*flagHash, key)
+		ov.files = newHashPrinter(*flagFmt, bw)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "index.json")); err == nil {
+		var idx ociIndex
+		if err := readJSONFile(filepath.Join(dir, "index.json"), &idx); err != nil {
+			log.Fatal(err)
+		}
+		for _, d := range idx.Manifests {
+			ov.verifyDescriptor(d)
+		}
+	} else if _, err := os.Stat(filepath.Join(dir, "manifest.json")); err == nil {
+		ov.verifyDockerArchive()
+	} else {
+		log.Fatalf("%s: no index.json or manifest.json; not an image layout", dir)
+	}
+
+	if ov.files != nil {
+		if c, ok := ov.files.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if err := bw.Flush(); err != nil {
+			log.Fatal(err)
+		}
+		if err := out.Close(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if ov.failures > 0 {
+		log.Fatalf("%d blobs did not verify", ov.failures)
+	}
+}
+
+func readJSONFile(name string, v interface{}) error {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+func (ov *ociVerifier) report(name, status, errMsg string) {
+	if status != statusOK {
+		ov.failures++
+	}
+	switch {
+	case *flagStatus, status == statusOK && *flagQuiet:
+	case errMsg != "":
+		fmt.Printf("%s: %s (%s)\n", name, status, errMsg)
+	default:
+		fmt.Printf("%s: %s\n", name, status)
+	}
+}
+
+// blobPath returns the path of the blob with a digest, relative to the
+// layout.
+func blobPath(digest string) (string, error) {
+	i := strings.IndexByte(digest, ':')
+	if i <= 0 || strings.ContainsAny(digest[i+1:], `/\.`) {
+		return "", fmt.Errorf("invalid digest %q", digest)
+	}
+	return filepath.Join("blobs", digest[:i], digest[i+1:]), nil
+}
+
+// newDigester returns a hash for an OCI digest, and the expected sum.
+func newDigester(digest string) (hash.Hash, []byte, error) {
+	i := strings.IndexByte(digest, ':')
+	if i <= 0 {
+		return nil, nil, fmt.Errorf("invalid digest %q", digest)
+	}
+	want, err := hex.DecodeString(digest[i+1:])
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid digest %q", digest)
+	}
+	switch digest[:i] {
+	case "sha256":
+		return sha256.New(), want, nil
+	case "sha512":
+		return sha512.New(), want, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported digest algorithm %q", digest[:i])
+	}
+}
+
+// verifyDescriptor checks the blob for a descriptor, and everything it
+// refers to.
+func (ov *ociVerifier) verifyDescriptor(d ociDescriptor) {
+	if ov.checked[d.Digest] {
+		return
+	}
+	ov.checked[d.Digest] = true
+
+	switch d.MediaType {
+	case "application/vnd.oci.image.index.v1+json",
+		"application/vnd.docker.distribution.manifest.list.v2+json":
+		var idx ociIndex
+		if ov.verifyJSONBlob(d, &idx) {
+			for _, m := range idx.Manifests {
+				ov.verifyDescriptor(m)
+			}
+		}
+	case "application/vnd.oci.image.manifest.v1+json",
+		"application/vnd.docker.distribution.manifest.v2+json":
+		var m ociManifest
+		if !ov.verifyJSONBlob(d, &m) {
+			return
+		}
+		var config ociConfig
+		configOK := ov.verifyJSONBlob(m.Config, &config)
+		for i, l := range m.Layers {
+			if ov.checked[l.Digest] {
+				continue
+			}
+			ov.checked[l.Digest] = true
+			diffID := ""
+			if configOK && i < len(config.RootFS.DiffIDs) {
+				diffID = config.RootFS.DiffIDs[i]
+			}
+			ov.verifyLayer(l, diffID)
+		}
+	default:
+		ov.verifyBlob(d, nil)
+	}
+}
+
+// verifyBlob checks a blob's size and digest, also copying it to w if it's
+// not nil. It returns whether the blob verified.
+func (ov *ociVerifier) verifyBlob(d ociDescriptor, w io.Writer) bool {
+	name, err := blobPath(d.Digest)
+	if err != nil {
+		ov.report(d.Digest, statusFailed, err.Error())
+		return false
+	}
+	h, want, err := newDigester(d.Digest)
+	if err != nil {
+		ov.report(name, statusFailed, err.Error())
+		return false
+	}
+
+	f, err := os.Open(filepath.Join(ov.dir, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		ov.report(name, statusMissing, "")
+		return false
+	} else if err != nil {
+		ov.report(name, statusFailed, err.Error())
+		return false
+	}
+	defer f.Close()
+
+	if w != nil {
+		h = multiHash{h, w}
+	}
+	n, err := io.Copy(h, f)
+	switch {
+	case err != nil:
+		ov.report(name, statusFailed, err.Error())
+	case n != d.Size:
+		ov.report(name, statusFailed, fmt.Sprintf("size is %d, expected %d", n, d.Size))
+	case string(h.Sum(nil)) != string(want):
+		ov.report(name, statusFailed, "")
+	default:
+		ov.report(name, statusOK, "")
+		return true
+	}
+	return false
+}
+
+// verifyJSONBlob checks a blob and decodes it as JSON into v. It returns
+// whether both succeeded.
+func (ov *ociVerifier) verifyJSONBlob(d ociDescriptor, v interface{}) bool {
+	var buf strings.Builder
+	if !ov.verifyBlob(d, &buf) {
+		return false
+	}
+	if err := json.Unmarshal([]byte(buf.String()), v); err != nil {
+		name, _ := blobPath(d.Digest)
+		ov.report(name+" (contents)", statusFailed, err.Error())
+		return false
+	}
+	return true
+}
+
+// verifyLayer checks a layer blob and, with -oci-files, its uncompressed
+// contents against the diff ID from the image config, and hashes each file
+// in it.
+func (ov *ociVerifier) verifyLayer(d ociDescriptor, diffID string) {
+	if !ov.verifyBlob(d, nil) || ov.files == nil {
+		return
+	}
+	name, _ := blobPath(d.Digest)
+	f, err := os.Open(filepath.Join(ov.dir, name))
+	if err != nil {
+		ov.report(name, statusFailed, err.Error())
+		return
+	}
+	defer f.Close()
+
+	var rd io.Reader = f
+	switch {
+	case strings.HasSuffix(d.MediaType, "+gzip") || strings.HasSuffix(d.MediaType, ".tar.gzip"):
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			ov.report(name+" (uncompressed)", statusFailed, err.Error())
+			return
+		}
+		defer zr.Close()
+		rd = zr
+	case strings.HasSuffix(d.MediaType, "+zstd"):
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			ov.report(name+" (uncompressed)", statusFailed, err.Error())
+			return
+		}
+		defer zr.Close()
+		rd = zr
+	}
+	ov.verifyTar(name, name+" (uncompressed)", rd, diffID)
+}
+
+// verifyTar hashes each file in an uncompressed layer, named "layer!path",
+// and checks the whole layer against its diff ID if there is one, reporting
+// the outcome under label.
+func (ov *ociVerifier) verifyTar(name, label string, rd io.Reader, diffID string) {
+	var h hash.Hash
+	var want []byte
+	if diffID != "" {
+		var err error
+		if h, want, err = newDigester(diffID); err != nil {
+			ov.report(label, statusFailed, err.Error())
+			return
+		}
+		rd = io.TeeReader(rd, h)
+	}
+
+	ar := &tarArchiveReader{tr: tar.NewReader(rd)}
+	buf := make([]byte, 1024*1024)
+	for {
+		member, mr, err := ar.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			ov.report(label, statusFailed, err.Error())
+			return
+		}
+		r := hashReader(ov.hf, mr, buf)
+		if r.err != nil {
+			ov.report(label, statusFailed, r.err.Error())
+			return
+		}
+		r.path = name + "!" + strings.TrimPrefix(member, "./")
+		ov.files.Print(r)
+	}
+	if h == nil {
+		return
+	}
+	// Include any padding after the end of the archive in the digest
+	if _, err := io.Copy(io.Discard, rd); err != nil {
+		ov.report(label, statusFailed, err.Error())
+	} else if string(h.Sum(nil)) != string(want) {
+		ov.report(label, statusFailed, "does not match diff ID "+diffID)
+	} else {
+		ov.report(label, statusOK, "")
+	}
+}
+
+// verifyDockerArchive checks the layout written by older versions of
+// "docker save", where only the config file is named by its digest, and
+// each layer is checked against its diff ID.
+func (ov *ociVerifier) verifyDockerArchive() {
+	var manifests []dockerManifest
+	if err := readJSONFile(filepath.Join(ov.dir, "manifest.json"), &manifests); err != nil {
+		log.Fatal(err)
+	}
+	for _, m := range manifests {
+		b, err := os.ReadFile(filepath.Join(ov.dir, m.Config))
+		if err != nil {
+			ov.report(m.Config, statusMissing, "")
+			continue
+		}
+		digest := "sha256:" + strings.TrimSuffix(filepath.Base(m.Config), ".json")
+		if sha256Hex(b) != digest[len("sha256:"):] {
+			ov.report(m.Config, statusFailed, "")
+			continue
+		}
+		ov.report(m.Config, statusOK, "")
+
+		var config ociConfig
+		if err := json.Unmarshal(b, &config); err != nil {
+			ov.report(m.Config+" (contents)", statusFailed, err.Error())
+			continue
+		}
+		for i, l := range m.Layers {
+			if ov.checked[l] {
+				continue
+			}
+			ov.checked[l] = true
+			if i >= len(config.RootFS.DiffIDs) {
+				ov.report(l, statusFailed, "no diff ID in config")
+				continue
+			}
+			ov.verifyDockerLayer(l, config.RootFS.DiffIDs[i])
+		}
+	}
+}
+
+func (ov *ociVerifier) verifyDockerLayer(name, diffID string) {
+	f, err := os.Open(filepath.Join(ov.dir, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		ov.report(name, statusMissing, "")
+		return
+	} else if err != nil {
+		ov.report(name, statusFailed, err.Error())
+		return
+	}
+	defer f.Close()
+
+	if ov.files != nil {
+		ov.verifyTar(name, name, f, diffID)
+		return
+	}
+	h, want, err := newDigester(diffID)
+	if err != nil {
+		ov.report(name, statusFailed, err.Error())
+		return
+	}
+	if _, err := io.Copy(h, f); err != nil {
+		ov.report(name, statusFailed, err.Error())
+	} else if string(h.Sum(nil)) != string(want) {
+		ov.report(name, statusFailed, "does not match diff ID "+diffID)
+	} else {
+		ov.report(name, statusOK, "")
+	}
+}
+
+// multiHash is a hash which also copies everything written to it to w.
+type multiHash struct {
+	hash.Hash
+	w io.Writer
+}
+
+func (m multiHash) Write(p []byte) (int, error) {
+	m.w.Write(p)
+	return m.Hash.Write(p)
+}
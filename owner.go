@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"os/user"
+	"strconv"
+)
+
+// ownerFilter is the set of owners and groups whose files are hashed, from
+// -uid, -owner, and -gid, or nil to hash every file.
+var ownerFilter *owners
+
+type owners struct {
+	uids map[uint32]bool // nil if only groups are given
+	gids map[uint32]bool // nil if only owners are given
+}
+
+// checkOwners validates -uid, -gid, and -owner, and sets up ownerFilter.
+func checkOwners(cmd string) {
+	if len(*flagUID) == 0 && len(*flagGID) == 0 && len(*flagOwner) == 0 {
+		return
+	}
+	switch {
+	case !ownersSupported:
+		log.Fatal("-uid, -gid, and -owner are not supported on this platform")
+	case *flagCheck != "" || *flagSidecar == "verify" || cmd == "watch" || cmd == "gate":
+		log.Fatal("-uid, -gid, and -owner cannot be used in check mode, watch, or gate")
+	}
+
+	ownerFilter = &owners{}
+	if len(*flagUID) > 0 || len(*flagOwner) > 0 {
+		ownerFilter.uids = make(map[uint32]bool)
+		for _, s := range *flagUID {
+			ownerFilter.uids[parseID("-uid", s, nil)] = true
+		}
+		for _, s := range *flagOwner {
+			ownerFilter.uids[parseID("-owner", s, func(name string) (string, error) {
+				u, err := user.Lookup(name)
+				if err != nil {
+					return "", err
+				}
+				return u.Uid, nil
+			})] = true
+		}
+	}
+	if len(*flagGID) > 0 {
+		ownerFilter.gids = make(map[uint32]bool)
+		for _, s := range *flagGID {
+			ownerFilter.gids[parseID("-gid", s, func(name string) (string, error) {
+				g, err := user.LookupGroup(name)
+				if err != nil {
+					return "", err
+				}
+				return g.Gid, nil
+			})] = true
+		}
+	}
+}
+
+// parseID parses a numeric user or group ID, or looks up a name with lookup,
+// if it's given.
+func parseID(option, s string, lookup func(string) (string, error)) uint32 {
+	id, err := strconv.ParseUint(s, 10, 32)
+	if err != nil && lookup != nil {
+		var idStr string
+		if idStr, err = lookup(s); err == nil {
+			id, err = strconv.ParseUint(idStr, 10, 32)
+		}
+	}
+	if err != nil {
+		log.Fatalf("%s %s: %v", option, s, err)
+	}
+	return uint32(id)
+}
+
+// matches reports whether a file is owned by one of the owners, and by one of
+// the groups, given.
+func (o *owners) matches(dirent fs.DirEntry) (bool, error) {
+	if o == nil {
+		return true, nil
+	}
+	fi, err := dirent.Info()
+	if err != nil {
+		return false, err
+	}
+	uid, gid, ok := fileOwner(fi)
+	if !ok {
+		return false, errors.New("no owner information")
+	}
+	return (o.uids == nil || o.uids[uid]) && (o.gids == nil || o.gids[gid]), nil
+}
@@ -0,0 +1,14 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package main
+
+import "io/fs"
+
+// Files have owner SIDs rather than user IDs on Windows, which -uid and -owner
+// don't support.
+const ownersSupported = false
+
+func fileOwner(fi fs.FileInfo) (uid, gid uint32, ok bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"log"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// checkPathCase validates -path-case.
+func checkPathCase() {
+	switch *flagPathCase {
+	case "", "none", "lower", "upper":
+	default:
+		log.Fatal("-path-case must be none, lower, or upper")
+	}
+}
+
+// checkNormalizePaths validates -normalize-paths.
+func checkNormalizePaths() {
+	switch *flagNormalizePaths {
+	case "", "none", "nfc", "nfd":
+	default:
+		log.Fatal("-normalize-paths must be nfc, nfd, or none")
+	}
+}
+
+// displayPath applies any requested normalization to a path before it is
+// output.
+func displayPath(p string) string {
+	switch *flagNormalizePaths {
+	case "nfc":
+		p = norm.NFC.String(p)
+	case "nfd":
+		p = norm.NFD.String(p)
+	}
+	switch *flagPathCase {
+	case "lower":
+		p = strings.ToLower(p)
+	case "upper":
+		p = strings.ToUpper(p)
+	}
+	return p
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"log"
+	"path"
+	"strings"
+)
+
+// Pathspecs, given after -- on the command line, limit which files are
+// hashed, in the style of git's pathspecs. Each is a pattern matched against
+// paths as they're printed, with the wildcards of path.Match, except that as
+// in git, * and ? also match slashes. With :(glob), the pattern is instead
+// matched segment by segment, and a ** segment matches any number of
+// segments, including none. A pattern which matches a directory matches
+// everything under it. Patterns starting with :! or :^ (or :(exclude))
+// exclude files instead. If only exclusions are given, every other file is
+// included.
+var includeSpecs, excludeSpecs []pathspec
+
+// pathspec is a parsed pathspec.
+type pathspec struct {
+	segs []string // slash-separated segments
+	glob bool     // for :(glob), matching segment by segment
+}
+
+// splitPathspecs splits the arguments into the roots, and the pathspecs
+// after --.
+func splitPathspecs(args []string) (roots, specs []string) {
+	for i, arg := range args {
+		if arg == "--" {
+			return args[:i], args[i+1:]
+		}
+	}
+	return args, nil
+}
+
+// checkPathspecs validates and parses the pathspecs.
+func checkPathspecs(cmd string, specs []string) {
+	if len(specs) == 0 {
+		return
+	}
+	if cmd != "" {
+		log.Fatal("pathspecs cannot be used with subcommands")
+	}
+	for _, spec := range specs {
+		pattern, exclude := spec, false
+		var ps pathspec
+		switch {
+		case strings.HasPrefix(pattern, ":!"), strings.HasPrefix(pattern, ":^"):
+			pattern, exclude = pattern[2:], true
+		case strings.HasPrefix(pattern, ":("):
+			i := strings.IndexByte(pattern, ')')
+			if i < 0 {
+				log.Fatalf("pathspec %q: missing ) after magic", spec)
+			}
+			for _, magic := range strings.Split(pattern[2:i], ",") {
+				switch magic {
+				case "exclude":
+					exclude = true
+				case "glob":
+					ps.glob = true
+				default:
+					log.Fatalf("pathspec %q: unsupported magic %q", spec, magic)
+				}
+			}
+			pattern = pattern[i+1:]
+		case strings.HasPrefix(pattern, ":"):
+			log.Fatalf("pathspec %q: unsupported magic", spec)
+		}
+
+		for _, seg := range strings.Split(strings.Trim(pattern, "/"), "/") {
+			if seg == "" || seg == "." {
+				continue
+			}
+			if _, err := path.Match(seg, ""); err != nil {
+				log.Fatalf("pathspec %q: %v", spec, err)
+			}
+			ps.segs = append(ps.segs, seg)
+		}
+		if exclude {
+			excludeSpecs = append(excludeSpecs, ps)
+		} else {
+			includeSpecs = append(includeSpecs, ps)
+		}
+	}
+}
+
+// globSegments reports whether a pattern matches a whole path, segment by
+// segment.
+func globSegments(pat, segs []string) bool {
+	if len(pat) == 0 {
+		return len(segs) == 0
+	}
+	if pat[0] == "**" {
+		for i := 0; i <= len(segs); i++ {
+			if globSegments(pat[1:], segs[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segs) == 0 {
+		return false
+	}
+	ok, _ := path.Match(pat[0], segs[0])
+	return ok && globSegments(pat[1:], segs[1:])
+}
+
+// globPath reports whether a pattern matches a whole path, with * and ?
+// matching slashes too, as in git's pathspecs. Slashes are swapped for NULs,
+// which can't be in paths, so that path.Match treats them like any other
+// character.
+func globPath(pat, segs []string) bool {
+	ok, _ := path.Match(strings.Join(pat, "\x00"), strings.Join(segs, "\x00"))
+	return ok
+}
+
+// matchPathspec reports whether a pathspec matches a path, or one of the
+// directories it's in.
+func matchPathspec(ps pathspec, segs []string) bool {
+	if len(ps.segs) == 0 {
+		return true
+	}
+	for i := 1; i <= len(segs); i++ {
+		if ps.glob && globSegments(ps.segs, segs[:i]) || !ps.glob && globPath(ps.segs, segs[:i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// mayMatchUnder reports whether a pathspec might match something under the
+// directory with the given path.
+func mayMatchUnder(ps pathspec, segs []string) bool {
+	if !ps.glob {
+		// Anything under the directory may match if it's under the part of
+		// the pattern before the first wildcard, and so might the
+		// directories leading to that part
+		pat, dir := strings.Join(ps.segs, "/"), strings.Join(segs, "/")+"/"
+		if i := strings.IndexAny(pat, "*?[\\"); i >= 0 {
+			pat = pat[:i]
+		}
+		return strings.HasPrefix(dir, pat) || strings.HasPrefix(pat, dir)
+	}
+	pat := ps.segs
+	for len(pat) > 0 && len(segs) > 0 {
+		if pat[0] == "**" {
+			return true
+		}
+		if ok, _ := path.Match(pat[0], segs[0]); !ok {
+			return false
+		}
+		pat, segs = pat[1:], segs[1:]
+	}
+	return true
+}
+
+// inPathspecs reports whether a file is selected by the pathspecs.
+func inPathspecs(p string) bool {
+	if includeSpecs == nil && excludeSpecs == nil {
+		return true
+	}
+	segs := strings.Split(p, "/")
+	for _, pat := range excludeSpecs {
+		if matchPathspec(pat, segs) {
+			return false
+		}
+	}
+	if includeSpecs == nil {
+		return true
+	}
+	for _, pat := range includeSpecs {
+		if matchPathspec(pat, segs) {
+			return true
+		}
+	}
+	return false
+}
+
+// walkPathspecs reports whether a directory needs to be walked, as it might
+// hold files selected by the pathspecs.
+func walkPathspecs(dir string) bool {
+	if includeSpecs == nil && excludeSpecs == nil {
+		return true
+	}
+	segs := strings.Split(dir, "/")
+	for _, pat := range excludeSpecs {
+		if matchPathspec(pat, segs) {
+			return false
+		}
+	}
+	if includeSpecs == nil {
+		return true
+	}
+	for _, pat := range includeSpecs {
+		if mayMatchUnder(pat, segs) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterPathspecs returns the manifest entries which are selected by the
+// pathspecs.
+func filterPathspecs(entries []manifestEntry) []manifestEntry {
+	if includeSpecs == nil && excludeSpecs == nil {
+		return entries
+	}
+	var filtered []manifestEntry
+	for _, e := range entries {
+		if inPathspecs(e.path) {
+			filtered = append(filtered, e)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+type hashPrinter interface {
+	Print(hashResult)
+}
+
+// errorPrinter is implemented by hash printers which can report per-file
+// errors to their consumer. For all other printers, errors are fatal,
+// unless -max-errors allows them.
+type errorPrinter interface {
+	PrintError(hashResult)
+}
+
+// wrappingPrinter is implemented by printers which pass results on to
+// another printer, such as -sort's. They may note errors themselves, but
+// whether errors are recorded in the output is up to the printer they wrap.
+type wrappingPrinter interface {
+	wrapped() hashPrinter
+}
+
+// recordsErrors reports whether a printer, or the innermost printer it
+// wraps, records errors in the output.
+func recordsErrors(hp hashPrinter) bool {
+	for {
+		wp, ok := hp.(wrappingPrinter)
+		if !ok {
+			break
+		}
+		hp = wp.wrapped()
+	}
+	_, ok := hp.(errorPrinter)
+	return ok
+}
+
+// flushPrinters writes out what a printer, and any printers it wraps, have
+// buffered, before a run ends early.
+func flushPrinters(hp hashPrinter) {
+	for hp != nil {
+		if f, ok := hp.(interface{ Flush() error }); ok {
+			if err := f.Flush(); err != nil {
+				errorf("%v", err)
+			}
+		}
+		wp, ok := hp.(wrappingPrinter)
+		if !ok {
+			break
+		}
+		hp = wp.wrapped()
+	}
+}
+
+type jsonResult struct {
+	Path      string   `json:"path"`
+	PathB64   string   `json:"path_b64,omitempty"` // with -json-path-b64
+	Hash      string   `json:"hash"`
+	Algo      string   `json:"algo,omitempty"`
+	Chunks    []string `json:"chunks,omitempty"`
+	Retries   int      `json:"retries,omitempty"`
+	Known     bool     `json:"known,omitempty"`
+	SymlinkOf string   `json:"symlink_of,omitempty"`
+	CloneOf   string   `json:"clone_of,omitempty"`
+	MIME      string   `json:"mime,omitempty"`
+	Entropy   *float64 `json:"entropy,omitempty"`
+	WasLocked bool     `json:"was_locked,omitempty"`
+
+	// With -stat
+	Size  *int64 `json:"size,omitempty"`
+	MTime string `json:"mtime,omitempty"`
+
+	// With -timings
+	Bytes      *int64   `json:"bytes,omitempty"`
+	DurationMS *float64 `json:"duration_ms,omitempty"`
+	Worker     int      `json:"worker,omitempty"`
+
+	// Set instead of the above on -collisions warnings, which aren't
+	// results
+	Warning      string `json:"warning,omitempty"`
+	CollidesWith string `json:"collides_with,omitempty"`
+
+	// Set on -tombstones records, with the file's last known hash
+	Deleted bool `json:"deleted,omitempty"`
+
+	// Set instead of path in -fmt by-hash output
+	Paths []string `json:"paths,omitempty"`
+
+	// Set instead of the above on the -provenance trailer
+	Provenance json.RawMessage `json:"provenance,omitempty"`
+}
+
+// jsonWarning is a -collisions warning in the JSON output formats.
+type jsonWarning struct {
+	Warning      string `json:"warning"`
+	Path         string `json:"path"`
+	CollidesWith string `json:"collides_with,omitempty"`
+}
+
+func newJSONWarning(w pathWarning) jsonWarning {
+	return jsonWarning{w.name(), w.path, w.other}
+}
+
+func newJSONResult(r hashResult, encode func([]byte) string) jsonResult {
+	algo := r.algo
+	if algo == "" {
+		algo = *flagHash
+	}
+	jr := jsonResult{Path: r.path, Hash: encode(r.hash), Algo: algo, Retries: r.retries, Known: r.known, SymlinkOf: r.symlinkOf, CloneOf: r.cloneOf, MIME: r.mime, Entropy: r.entropy, WasLocked: r.wasLocked}
+	if *flagJSONPathB64 && !utf8.ValidString(r.path) {
+		// JSON strings can only hold UTF-8, so the path is given as
+		// base64 too, with invalid bytes replaced in the path shown
+		jr.Path = strings.ToValidUTF8(r.path, "\uFFFD")
+		jr.PathB64 = base64.StdEncoding.EncodeToString([]byte(r.path))
+	}
+	if !r.mtime.IsZero() {
+		size := r.size
+		jr.Size, jr.MTime = &size, r.mtime.UTC().Format(time.RFC3339Nano)
+	}
+	if r.timing != nil {
+		size, ms := r.size, float64(r.timing.Duration)/float64(time.Millisecond)
+		jr.Bytes, jr.DurationMS, jr.Worker = &size, &ms, r.timing.Worker
+	}
+	for _, c := range r.chunks {
+		jr.Chunks = append(jr.Chunks, encode(c))
+	}
+	jr.Deleted = r.status == statusDeleted
+	return jr
+}
+
+// newHashPrinter returns a printer which writes results to w in the given
+// output format, ending with a footer with -footer.
+func newHashPrinter(format string, w io.Writer) hashPrinter {
+	if theProvenance != nil && theProvenance.trailer {
+		return provenanceTrailer{newFormatPrinter(format, w), w}
+	}
+	if *flagFooter {
+		fw := newFooterWriter(w, footerComment(format))
+		return footerPrinter{newFormatPrinter(format, fw), fw}
+	}
+	return newFormatPrinter(format, w)
+}
+
+func newFormatPrinter(format string, w io.Writer) hashPrinter {
+	switch format {
+	case "hex":
+		writeHeader(w, "#")
+		return &hexHashPrinter{w}
+	case "base64":
+		writeHeader(w, "#")
+		return &base64HashPrinter{w}
+	case "tag":
+		tag, ok := bsdTags[*flagHash]
+		if !ok {
+			log.Fatalf("no BSD-style name for %s", *flagHash)
+		}
+		writeHeader(w, "#")
+		return &tagHashPrinter{w, tag}
+	case "json", "json-hex":
+		return &jsonHexHashPrinter{json.NewEncoder(w)}
+	case "json-base64":
+		return &jsonBase64HashPrinter{json.NewEncoder(w)}
+	case "json-array":
+		return &jsonArrayHashPrinter{w: w, encode: hex.EncodeToString, pretty: *flagPretty}
+	case "json-array-base64":
+		return &jsonArrayHashPrinter{w: w, encode: base64.StdEncoding.EncodeToString, pretty: *flagPretty}
+	case "by-hash":
+		return &byHashPrinter{w: w, groups: make(map[string]*hashGroup)}
+	case "binary":
+		return newBinaryHashPrinter(w)
+	case "sfv":
+		if *flagHash != "crc32" {
+			log.Fatal("sfv output requires -hash crc32")
+		}
+		writeHeader(w, ";")
+		return &sfvHashPrinter{w}
+	default:
+		log.Fatal("output format not supported")
+		return nil
+	}
+}
+
+// outputSpecs is a flag.Value which collects repeated "format=path" options.
+type outputSpecs []string
+
+func outputSpecsFlag(name string, usage string) *outputSpecs {
+	var o outputSpecs
+	flag.Var(&o, name, usage)
+	return &o
+}
+
+func (o *outputSpecs) String() string {
+	return strings.Join(*o, " ")
+}
+
+func (o *outputSpecs) Set(s string) error {
+	if !strings.Contains(s, "=") {
+		return errors.New("must be of the form format=path")
+	}
+	*o = append(*o, s)
+	return nil
+}
+
+// formats returns the output format of each spec.
+func (o outputSpecs) formats() []string {
+	var formats []string
+	for _, spec := range o {
+		formats = append(formats, spec[:strings.IndexByte(spec, '=')])
+	}
+	return formats
+}
+
+// multiHashPrinter writes results to several outputs at once, each in its
+// own format, as given with -out.
+type multiHashPrinter struct {
+	printers []hashPrinter
+	closers  []func() error
+}
+
+func newMultiHashPrinter(specs outputSpecs) *multiHashPrinter {
+	mp := &multiHashPrinter{}
+	for _, spec := range specs {
+		i := strings.IndexByte(spec, '=')
+		format, path := spec[:i], spec[i+1:]
+
+		f, err := createOutput(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		bw := bufio.NewWriter(f)
+		hp := newHashPrinter(format, bw)
+
+		mp.printers = append(mp.printers, hp)
+		mp.closers = append(mp.closers, func() error {
+			if c, ok := hp.(io.Closer); ok {
+				if err := c.Close(); err != nil {
+					return err
+				}
+			}
+			if err := bw.Flush(); err != nil {
+				return err
+			}
+			return f.Close()
+		})
+	}
+	return mp
+}
+
+// createOutput opens a file for output: "-" for standard output, an S3
+// object given as s3://bucket/key, or a local file. The output is encrypted
+// if -encrypt-to or -passphrase-env is used.
+func createOutput(path string) (io.WriteCloser, error) {
+	var w io.WriteCloser
+	var err error
+	switch {
+	case path == "-":
+		w = nopWriteCloser{os.Stdout}
+	case strings.HasPrefix(path, "s3://"):
+		w, err = newS3Writer(path)
+	default:
+		w, err = os.Create(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return encryptOutput(w)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func (mp *multiHashPrinter) Print(r hashResult) {
+	for _, hp := range mp.printers {
+		hp.Print(r)
+	}
+}
+
+func (mp *multiHashPrinter) PrintWarning(w pathWarning) {
+	for _, hp := range mp.printers {
+		printWarning(hp, w)
+	}
+}
+
+func (mp *multiHashPrinter) Close() error {
+	var firstErr error
+	for _, c := range mp.closers {
+		if err := c(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// escapePath escapes a path for the text formats, as GNU coreutils does, so
+// that a file name with a line break in it can't break up the manifest. If
+// the path has a backslash or line break, they're escaped, and the line is
+// marked as escaped by starting it with a backslash.
+func escapePath(p string) (mark, escaped string) {
+	if !strings.ContainsAny(p, "\\\n\r") {
+		return "", p
+	}
+	return `\`, pathEscaper.Replace(p)
+}
+
+var pathEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", `\r`)
+
+// unescapePath reverses escapePath, for a line which was marked as escaped.
+func unescapePath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		if p[i] == '\\' && i+1 < len(p) {
+			i++
+			switch p[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			default:
+				b.WriteByte(p[i])
+			}
+			continue
+		}
+		b.WriteByte(p[i])
+	}
+	return b.String()
+}
+
+// hexHashPrinter prints hashes in the classic "hexhash <spc><spc> filename" format.
+type hexHashPrinter struct {
+	w io.Writer
+}
+
+func (hp hexHashPrinter) Print(r hashResult) {
+	mark, p := escapePath(r.path)
+	fmt.Fprintf(hp.w, "%s%s  %s\n", mark, hex.EncodeToString(r.hash), p)
+}
+
+func (hp hexHashPrinter) PrintWarning(w pathWarning) {
+	io.WriteString(hp.w, textWarning("#", w))
+}
+
+// base64HashPrinter prints hashes in "base64hash <spc><spc> filename" format, using standard Base64 with padding
+type base64HashPrinter struct {
+	w io.Writer
+}
+
+func (hp base64HashPrinter) Print(r hashResult) {
+	mark, p := escapePath(r.path)
+	fmt.Fprintf(hp.w, "%s%s  %s\n", mark, base64.StdEncoding.EncodeToString(r.hash), p)
+}
+
+func (hp base64HashPrinter) PrintWarning(w pathWarning) {
+	io.WriteString(hp.w, textWarning("#", w))
+}
+
+// tagHashPrinter prints hashes in the BSD-style "ALGO (filename) = hexhash"
+// format, as written by "sha256sum --tag".
+type tagHashPrinter struct {
+	w   io.Writer
+	tag string
+}
+
+func (hp tagHashPrinter) Print(r hashResult) {
+	mark, p := escapePath(r.path)
+	tag := hp.tag
+	if t, ok := bsdTags[r.algo]; ok {
+		tag = t
+	}
+	fmt.Fprintf(hp.w, "%s%s (%s) = %s\n", mark, tag, p, hex.EncodeToString(r.hash))
+}
+
+func (hp tagHashPrinter) PrintWarning(w pathWarning) {
+	io.WriteString(hp.w, textWarning("#", w))
+}
+
+// sfvHashPrinter prints CRC32s in the Simple File Verification format,
+// "filename CRC", with the CRC in upper-case hex.
+type sfvHashPrinter struct {
+	w io.Writer
+}
+
+func (hp sfvHashPrinter) Print(r hashResult) {
+	fmt.Fprintf(hp.w, "%s %s\n", r.path, strings.ToUpper(hex.EncodeToString(r.hash)))
+}
+
+func (hp sfvHashPrinter) PrintWarning(w pathWarning) {
+	io.WriteString(hp.w, textWarning(";", w))
+}
+
+// jsonBase64HashPrinter prints hashes as JSON lines with keys "hash" and
+// "path", with "hash" containing a hex hash in the same format as
+// hexHashPrinter.
+type jsonHexHashPrinter struct {
+	enc *json.Encoder
+}
+
+func (hp jsonHexHashPrinter) Print(r hashResult) {
+	hp.enc.Encode(newJSONResult(r, hex.EncodeToString))
+}
+
+func (hp jsonHexHashPrinter) PrintWarning(w pathWarning) {
+	hp.enc.Encode(newJSONWarning(w))
+}
+
+// jsonBase64HashPrinter prints hashes as JSON lines with keys "hash" and
+// "path", with "hash" containing a Base64 hash in the same format as
+// base64HashPrinter.
+type jsonBase64HashPrinter struct {
+	enc *json.Encoder
+}
+
+func (hp jsonBase64HashPrinter) Print(r hashResult) {
+	hp.enc.Encode(newJSONResult(r, base64.StdEncoding.EncodeToString))
+}
+
+func (hp jsonBase64HashPrinter) PrintWarning(w pathWarning) {
+	hp.enc.Encode(newJSONWarning(w))
+}
+
+// jsonArrayHashPrinter prints hashes as a single JSON array of objects in the
+// same format as jsonHexHashPrinter or jsonBase64HashPrinter, depending on
+// encode. The array is streamed out as results arrive, and is terminated on
+// Close.
+type jsonArrayHashPrinter struct {
+	w      io.Writer
+	encode func([]byte) string
+	pretty bool
+	count  int
+}
+
+func (hp *jsonArrayHashPrinter) Print(r hashResult) {
+	hp.write(newJSONResult(r, hp.encode))
+}
+
+func (hp *jsonArrayHashPrinter) PrintWarning(w pathWarning) {
+	hp.write(newJSONWarning(w))
+}
+
+// write adds an object to the array.
+func (hp *jsonArrayHashPrinter) write(v interface{}) {
+	var b []byte
+	if hp.pretty {
+		b, _ = json.MarshalIndent(v, "  ", "  ")
+	} else {
+		b, _ = json.Marshal(v)
+	}
+
+	sep := ","
+	if hp.count == 0 {
+		sep = "["
+	}
+	if hp.pretty {
+		fmt.Fprintf(hp.w, "%s\n  %s", sep, b)
+	} else {
+		fmt.Fprintf(hp.w, "%s%s", sep, b)
+	}
+	hp.count++
+}
+
+// byHashPrinter groups files by hash, for -fmt by-hash: once every file has
+// been hashed, it prints a JSON object on each line for each distinct hash,
+// in order, with the number of files which have it and their paths, sorted.
+type byHashPrinter struct {
+	w      io.Writer
+	groups map[string]*hashGroup // by algorithm and raw hash
+}
+
+type hashGroup struct {
+	Hash  string   `json:"hash"`
+	Algo  string   `json:"algo"`
+	Count int      `json:"count"`
+	Paths []string `json:"paths"`
+}
+
+func (hp *byHashPrinter) Print(r hashResult) {
+	algo := r.algo
+	if algo == "" {
+		algo = *flagHash
+	}
+	key := algo + "\x00" + string(r.hash)
+	g := hp.groups[key]
+	if g == nil {
+		g = &hashGroup{Hash: hex.EncodeToString(r.hash), Algo: algo}
+		hp.groups[key] = g
+	}
+	g.Count++
+	g.Paths = append(g.Paths, r.path)
+}
+
+func (hp *byHashPrinter) Close() error {
+	groups := make([]*hashGroup, 0, len(hp.groups))
+	for _, g := range hp.groups {
+		sort.Strings(g.Paths)
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Hash != groups[j].Hash {
+			return groups[i].Hash < groups[j].Hash
+		}
+		return groups[i].Algo < groups[j].Algo
+	})
+	enc := json.NewEncoder(hp.w)
+	for _, g := range groups {
+		if err := enc.Encode(g); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (hp *jsonArrayHashPrinter) Close() error {
+	switch {
+	case hp.count == 0:
+		fmt.Fprintln(hp.w, "[]")
+	case hp.pretty:
+		fmt.Fprintln(hp.w, "\n]")
+	default:
+		fmt.Fprintln(hp.w, "]")
+	}
+	return nil
+}
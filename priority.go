@@ -0,0 +1,52 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+)
+
+// I/O scheduling classes for -ionice, as used by Linux's ioprio_set.
+const (
+	ioprioClassNone       = 0
+	ioprioClassBestEffort = 2
+	ioprioClassIdle       = 3
+)
+
+// ioniceClass and ioniceLevel are parsed from -ionice by checkPriority.
+var ioniceClass, ioniceLevel int
+
+// checkPriority validates -nice and -ionice.
+func checkPriority() {
+	if *flagNice < 0 || *flagNice > 19 {
+		log.Fatal("-nice must be between 0 and 19")
+	}
+
+	class, level := *flagIonice, ""
+	if i := strings.IndexByte(class, ':'); i >= 0 {
+		class, level = class[:i], class[i+1:]
+	}
+	switch class {
+	case "":
+		ioniceClass = ioprioClassNone
+	case "idle":
+		ioniceClass = ioprioClassIdle
+	case "best-effort":
+		ioniceClass = ioprioClassBestEffort
+		ioniceLevel = 4
+	default:
+		log.Fatal("-ionice must be idle or best-effort[:level]")
+	}
+	if level != "" {
+		n, err := strconv.Atoi(level)
+		if err != nil || n < 0 || n > 7 || ioniceClass != ioprioClassBestEffort {
+			log.Fatal("-ionice level must be between 0 and 7, and is only valid with best-effort")
+		}
+		ioniceLevel = n
+	}
+}
+
+// lowPriority reports whether workers should lower their priority.
+func lowPriority() bool {
+	return *flagNice > 0 || ioniceClass != ioprioClassNone
+}
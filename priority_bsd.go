@@ -0,0 +1,26 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package main
+
+import (
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+var ioniceWarning sync.Once
+
+// lowerThreadPriority applies -nice to the whole process, as priorities
+// aren't per-thread here. I/O priorities aren't supported.
+func lowerThreadPriority() error {
+	if ioniceClass != ioprioClassNone {
+		ioniceWarning.Do(func() {
+			warnf("-ionice is not supported on this platform; ignoring")
+		})
+	}
+	if *flagNice > 0 {
+		return unix.Setpriority(unix.PRIO_PROCESS, 0, *flagNice)
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+const ioprioWhoProcess = 1
+
+// lowerThreadPriority applies -nice and -ionice to the calling thread, which
+// must be locked to its goroutine. On Linux, both priorities are per-thread,
+// so only the worker threads are affected.
+func lowerThreadPriority() error {
+	if *flagNice > 0 {
+		if err := unix.Setpriority(unix.PRIO_PROCESS, 0, *flagNice); err != nil {
+			return err
+		}
+	}
+	if ioniceClass != ioprioClassNone {
+		prio := ioniceClass<<13 | ioniceLevel
+		if _, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, 0, uintptr(prio)); errno != 0 {
+			return errno
+		}
+	}
+	return nil
+}
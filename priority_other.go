@@ -0,0 +1,9 @@
+//go:build !linux && !windows && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!windows,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package main
+
+// lowerThreadPriority does nothing, as priorities aren't supported here.
+func lowerThreadPriority() error {
+	return nil
+}
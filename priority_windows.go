@@ -0,0 +1,23 @@
+package main
+
+import (
+	"golang.org/x/sys/windows"
+)
+
+// lowerThreadPriority approximates -nice and -ionice with the priority class
+// of the whole process. Background mode lowers both CPU and I/O priority, so
+// it's used for -ionice idle.
+func lowerThreadPriority() error {
+	var class uint32
+	switch {
+	case ioniceClass == ioprioClassIdle:
+		class = windows.PROCESS_MODE_BACKGROUND_BEGIN
+	case *flagNice >= 15:
+		class = windows.IDLE_PRIORITY_CLASS
+	case *flagNice > 0:
+		class = windows.BELOW_NORMAL_PRIORITY_CLASS
+	default:
+		return nil
+	}
+	return windows.SetPriorityClass(windows.CurrentProcess(), class)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"runtime/trace"
+)
+
+// startProfiling starts the -pprof HTTP server and -trace output, if
+// requested. The returned function stops tracing, and must be called before
+// exiting for the trace to be usable.
+func startProfiling() func() {
+	if *flagPprof != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(*flagPprof, nil))
+		}()
+	}
+
+	if *flagTrace == "" {
+		return func() {}
+	}
+	f, err := os.Create(*flagTrace)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := trace.Start(f); err != nil {
+		log.Fatal(err)
+	}
+	return func() {
+		trace.Stop()
+		if err := f.Close(); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+)
+
+// A manifest's Merkle tree is built as in RFC 6962 (Certificate
+// Transparency), over its files sorted by path. Each leaf is the SHA-256 of a
+// zero byte, the file's path, another zero byte, and the file's hash, so a
+// proof ties a path to a hash. Interior nodes are the SHA-256 of a one byte
+// and their two children, and a tree of n leaves is split after the largest
+// power of two below n. The root is the manifest's tree digest.
+
+// merkleProof is an inclusion proof, as printed by prove and read by
+// prove-verify.
+type merkleProof struct {
+	Path  string   `json:"path"`
+	Hash  string   `json:"hash"`
+	Algo  string   `json:"algo,omitempty"`
+	Index int      `json:"index"`
+	Count int      `json:"count"`
+	Proof []string `json:"proof"`
+	Root  string   `json:"root"`
+}
+
+func merkleLeaf(path string, hash []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	io.WriteString(h, path)
+	h.Write([]byte{0})
+	h.Write(hash)
+	return h.Sum(nil)
+}
+
+func merkleNode(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// merkleSplit returns the largest power of two less than n, for n > 1.
+func merkleSplit(n int) int {
+	k := 1
+	for k*2 < n {
+		k *= 2
+	}
+	return k
+}
+
+// merkleRoot returns the root of the tree over the given leaves.
+func merkleRoot(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		h := sha256.Sum256(nil)
+		return h[:]
+	case 1:
+		return leaves[0]
+	}
+	k := merkleSplit(len(leaves))
+	return merkleNode(merkleRoot(leaves[:k]), merkleRoot(leaves[k:]))
+}
+
+// merklePath returns the inclusion proof for leaf m: the roots of the
+// subtrees beside the path from the leaf to the root, from the bottom up.
+func merklePath(m int, leaves [][]byte) [][]byte {
+	if len(leaves) <= 1 {
+		return nil
+	}
+	k := merkleSplit(len(leaves))
+	if m < k {
+		return append(merklePath(m, leaves[:k]), merkleRoot(leaves[k:]))
+	}
+	return append(merklePath(m-k, leaves[k:]), merkleRoot(leaves[:k]))
+}
+
+// runProve implements the prove subcommand, which prints the tree digest of
+// a manifest, and an inclusion proof for the file at path, if it's given.
+func runProve(manifest, path string) {
+	entries, _, err := readManifest(manifest, "auto")
+	if err != nil {
+		log.Fatalf("%s: %v", manifest, err)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].path < entries[j].path })
+	leaves := make([][]byte, len(entries))
+	index := -1
+	for i, e := range entries {
+		if i > 0 && e.path == entries[i-1].path {
+			log.Fatalf("%s: %s is listed more than once", manifest, e.path)
+		}
+		leaves[i] = merkleLeaf(e.path, e.hash)
+		if e.path == path {
+			index = i
+		}
+	}
+	root := hex.EncodeToString(merkleRoot(leaves))
+
+	if path == "" {
+		fmt.Printf("root %s (%d files)\n", root, len(entries))
+		return
+	}
+	if index < 0 {
+		log.Fatalf("%s: %s is not in the manifest", manifest, path)
+	}
+	e := entries[index]
+	proof := merkleProof{
+		Path:  e.path,
+		Hash:  hex.EncodeToString(e.hash),
+		Algo:  e.algo,
+		Index: index,
+		Count: len(entries),
+		Proof: []string{},
+		Root:  root,
+	}
+	for _, p := range merklePath(index, leaves) {
+		proof.Proof = append(proof.Proof, hex.EncodeToString(p))
+	}
+	enc := json.NewEncoder(os.Stdout)
+	if *flagPretty {
+		enc.SetIndent("", "  ")
+	}
+	if err := enc.Encode(proof); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// runProveVerify implements the prove-verify subcommand, which checks that an
+// inclusion proof leads from its file to its root, and, if root is given,
+// that it's the proof's root. A proof on its own only shows that it's
+// consistent; the root must come from somewhere trusted.
+func runProveVerify(name, root string) {
+	var data []byte
+	var err error
+	if name == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(name)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	var proof merkleProof
+	if err := json.Unmarshal(data, &proof); err != nil {
+		log.Fatalf("%s: %v", name, err)
+	}
+	hash, err := hex.DecodeString(proof.Hash)
+	if err != nil {
+		log.Fatalf("%s: invalid hash: %v", name, err)
+	}
+	want, err := hex.DecodeString(proof.Root)
+	if err != nil {
+		log.Fatalf("%s: invalid root: %v", name, err)
+	}
+	if root != "" {
+		given, err := decodeDigest(root)
+		if err != nil {
+			log.Fatalf("invalid root %q: %v", root, err)
+		}
+		if !bytes.Equal(given, want) {
+			log.Fatalf("%s: the proof is for root %s, not %s", name, proof.Root, root)
+		}
+	}
+	if proof.Index < 0 || proof.Index >= proof.Count {
+		log.Fatalf("%s: index %d is out of range", name, proof.Index)
+	}
+
+	// This is the verification algorithm from RFC 9162, section 2.1.3.2.
+	fn, sn := proof.Index, proof.Count-1
+	r := merkleLeaf(proof.Path, hash)
+	for _, s := range proof.Proof {
+		p, err := hex.DecodeString(s)
+		if err != nil {
+			log.Fatalf("%s: invalid proof: %v", name, err)
+		}
+		if sn == 0 {
+			log.Fatalf("%s: the proof is too long", name)
+		}
+		if fn&1 == 1 || fn == sn {
+			r = merkleNode(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = merkleNode(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 || !bytes.Equal(r, want) {
+		fmt.Printf("%s: FAILED\n", proof.Path)
+		os.Exit(1)
+	}
+	fmt.Printf("%s: OK\n", proof.Path)
+	fmt.Printf("hash %s\n", proof.Hash)
+	fmt.Printf("root %s\n", proof.Root)
+}
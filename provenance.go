@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+)
+
+// theProvenance collects the -provenance record, or is nil.
+var theProvenance *runProvenance
+
+// runProvenance collects what's needed to describe a run: how hashtree was
+// run, and where, and a summary of what it produced.
+type runProvenance struct {
+	rec     provenanceRecord
+	trailer bool // written at the end of the JSON output, not to a file
+
+	entries []manifestEntry // for the tree digest
+}
+
+// provenanceRecord is the -provenance record. TreeDigest is the Merkle root
+// of the results, as printed by the prove subcommand for the manifest.
+type provenanceRecord struct {
+	Tool       string            `json:"tool"`
+	Version    string            `json:"version"`
+	Go         string            `json:"go"`
+	Hostname   string            `json:"hostname"`
+	Flags      map[string]string `json:"flags"`
+	Algo       string            `json:"algo"`
+	Roots      []string          `json:"roots"`
+	Start      string            `json:"start"`
+	End        string            `json:"end"`
+	Files      int64             `json:"files"`
+	Bytes      int64             `json:"bytes"`
+	Errors     int64             `json:"errors"`
+	TreeDigest string            `json:"tree_digest"`
+}
+
+// checkProvenance validates -provenance, and starts the record for a run
+// over the given roots.
+func checkProvenance(cmd string, roots []string) {
+	if *flagProvenance == "" {
+		return
+	}
+	if *flagCheck != "" || cmd != "" || *flagDryRun {
+		log.Fatal("-provenance cannot be used with check mode, -dry-run, or subcommands")
+	}
+	trailer := *flagProvenance == "trailer"
+	if trailer {
+		for _, f := range outputFormats() {
+			switch f {
+			case "json", "json-hex", "json-base64":
+			default:
+				log.Fatal("-provenance trailer requires JSON lines output (json, json-hex, or json-base64)")
+			}
+		}
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		warnf("can't find the hostname for -provenance: %v", err)
+	}
+	version := "(unknown)"
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		version = bi.Main.Version
+	}
+	flags := make(map[string]string)
+	flag.Visit(func(f *flag.Flag) {
+		flags[f.Name] = provenanceFlag(f)
+	})
+	theProvenance = &runProvenance{
+		rec: provenanceRecord{
+			Tool:     "hashtree",
+			Version:  version,
+			Go:       runtime.Version(),
+			Hostname: hostname,
+			Flags:    flags,
+			Algo:     *flagHash,
+			Roots:    absRoots(roots),
+			Start:    time.Now().UTC().Format(time.RFC3339Nano),
+		},
+		trailer: trailer,
+	}
+}
+
+// provenanceFlags are the flags taking strings whose values are recorded by
+// -provenance. These are paths, names, and options; the others, such as
+// -key, -http-header, and -webhook, may hold credentials, so only that they
+// were given is recorded.
+var provenanceFlags = map[string]bool{
+	"accept-dir": true, "allow-hashes": true, "cas-link": true, "chain-log": true,
+	"check": true, "conflict": true, "deny-hashes": true, "digest-covers": true,
+	"encrypt-to": true, "fmt": true, "gid": true, "hash": true, "hash-for": true,
+	"hash-impl": true, "identity": true, "io": true, "ionice": true, "jobs": true,
+	"journal": true, "known-action": true, "known-hashes": true, "log-format": true,
+	"log-level": true, "normalize-paths": true, "o": true, "oci-files": true,
+	"out": true, "owner": true, "passphrase-env": true, "path-case": true,
+	"provenance": true, "reject-dir": true, "resume": true, "root-label": true,
+	"sample": true, "shard": true, "sidecar": true, "snapshot": true, "stats": true,
+	"stats-format": true, "tar": true, "tombstones": true, "trace": true, "uid": true,
+	"urls": true, "xattr": true,
+}
+
+// provenanceFlag returns a flag's value as recorded by -provenance: as given
+// for flags which are booleans, numbers, or sizes, or are in
+// provenanceFlags, and redacted otherwise.
+func provenanceFlag(f *flag.Flag) string {
+	value := f.Value.String()
+	if g, ok := f.Value.(flag.Getter); ok {
+		switch g.Get().(type) {
+		case bool, int, int64, uint, uint64, float64, time.Duration:
+			return value
+		}
+	}
+	if _, ok := f.Value.(*byteSize); ok {
+		return value
+	}
+	// A -hash exec: command may hold credentials, like any other command
+	if provenanceFlags[f.Name] && !(f.Name == "hash" && strings.HasPrefix(value, "exec:")) {
+		return value
+	}
+	return "(redacted)"
+}
+
+// record counts a result, with its path as printed. Files reached again
+// through a symlink are in the tree, but their bytes aren't counted twice.
+func (p *runProvenance) record(r hashResult) {
+	if p == nil {
+		return
+	}
+	if r.err != nil {
+		p.rec.Errors++
+		return
+	}
+	p.rec.Files++
+	if r.symlinkOf == "" {
+		p.rec.Bytes += r.size
+	}
+	p.entries = append(p.entries, manifestEntry{path: r.path, hash: r.hash})
+}
+
+// finish completes the record at the end of the run.
+func (p *runProvenance) finish() provenanceRecord {
+	sort.Slice(p.entries, func(i, j int) bool { return p.entries[i].path < p.entries[j].path })
+	leaves := make([][]byte, len(p.entries))
+	for i, e := range p.entries {
+		leaves[i] = merkleLeaf(e.path, e.hash)
+	}
+	p.rec.TreeDigest = hex.EncodeToString(merkleRoot(leaves))
+	p.rec.End = time.Now().UTC().Format(time.RFC3339Nano)
+	return p.rec
+}
+
+// write writes the record to the -provenance file, unless it's a trailer.
+func (p *runProvenance) write() {
+	if p == nil || p.trailer {
+		return
+	}
+	f, err := os.Create(*flagProvenance)
+	if err != nil {
+		log.Fatal(err)
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(p.finish())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Fatalf("writing -provenance: %v", err)
+	}
+}
+
+// provenanceTrailer ends JSON lines output with the -provenance record, as
+// a line like {"provenance": {...}}, which is skipped when the manifest is
+// read.
+type provenanceTrailer struct {
+	hp hashPrinter
+	w  io.Writer
+}
+
+func (pt provenanceTrailer) Print(r hashResult) {
+	pt.hp.Print(r)
+}
+
+func (pt provenanceTrailer) PrintWarning(w pathWarning) {
+	printWarning(pt.hp, w)
+}
+
+func (pt provenanceTrailer) Close() error {
+	if c, ok := pt.hp.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			return err
+		}
+	}
+	err := json.NewEncoder(pt.w).Encode(struct {
+		Provenance provenanceRecord `json:"provenance"`
+	}{theProvenance.finish()})
+	if err != nil {
+		return fmt.Errorf("writing -provenance trailer: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// publishSink sends messages to a message bus, for -publish.
+type publishSink interface {
+	send(msgs []publishMessage) error
+	close() error
+}
+
+// publishMessage is a message for a publishSink. The key is only used by
+// Kafka.
+type publishMessage struct {
+	key, value []byte
+	time       time.Time
+}
+
+// publishedResult is the JSON value of each message published: the result
+// as in the JSON output formats, with its status in check mode, or its
+// error, and when it was produced.
+type publishedResult struct {
+	jsonResult
+	Status string `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+	Time   string `json:"time"`
+}
+
+// Messages are sent in batches, of up to publishBatch messages, and at
+// least every publishInterval, so that results arrive soon after they're
+// produced without each needing a round trip of its own.
+const (
+	publishBatch    = 1000
+	publishInterval = time.Second
+)
+
+// publishPrinter publishes each result to a message bus, as well as passing
+// it on to another printer.
+type publishPrinter struct {
+	hp   hashPrinter
+	url  string
+	sink publishSink
+
+	mu      sync.Mutex
+	pending []publishMessage
+	done    chan struct{}
+	stopped sync.WaitGroup
+}
+
+// newPublishPrinter connects to the message bus given by -publish, which is
+// either kafka://broker[,broker...]/topic or nats://host/subject.
+func newPublishPrinter(hp hashPrinter, url string) *publishPrinter {
+	var sink publishSink
+	var err error
+	switch {
+	case strings.HasPrefix(url, "kafka://"):
+		sink, err = newKafkaSink(strings.TrimPrefix(url, "kafka://"))
+	case strings.HasPrefix(url, "nats://"):
+		sink, err = newNATSSink(strings.TrimPrefix(url, "nats://"))
+	default:
+		log.Fatal("-publish must be a kafka:// or nats:// URL")
+	}
+	if err != nil {
+		log.Fatalf("-publish %s: %v", url, err)
+	}
+
+	pp := &publishPrinter{hp: hp, url: url, sink: sink, done: make(chan struct{})}
+	pp.stopped.Add(1)
+	go func() {
+		defer pp.stopped.Done()
+		ticker := time.NewTicker(publishInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				pp.mu.Lock()
+				pp.flush()
+				pp.mu.Unlock()
+			case <-pp.done:
+				return
+			}
+		}
+	}()
+	return pp
+}
+
+// publish queues a message, and sends the queue once it's a full batch.
+func (pp *publishPrinter) publish(r hashResult, pr publishedResult) {
+	now := time.Now()
+	pr.Time = now.UTC().Format(time.RFC3339Nano)
+	value, err := json.Marshal(pr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	pp.pending = append(pp.pending, publishMessage{[]byte(r.path), value, now})
+	if len(pp.pending) >= publishBatch {
+		pp.flush()
+	}
+}
+
+// flush sends the queued messages. pp.mu must be held.
+func (pp *publishPrinter) flush() {
+	if len(pp.pending) == 0 {
+		return
+	}
+	if err := pp.sink.send(pp.pending); err != nil {
+		log.Fatalf("-publish %s: %v", pp.url, err)
+	}
+	debugf("published %d results to %s", len(pp.pending), pp.url)
+	pp.pending = pp.pending[:0]
+}
+
+func (pp *publishPrinter) Print(r hashResult) {
+	pp.publish(r, publishedResult{jsonResult: newJSONResult(r, hex.EncodeToString), Status: r.status})
+	pp.hp.Print(r)
+}
+
+func (pp *publishPrinter) PrintError(r hashResult) {
+	pp.publish(r, publishedResult{jsonResult: jsonResult{Path: r.path}, Error: r.err.Error()})
+	if ep, ok := pp.hp.(errorPrinter); ok {
+		ep.PrintError(r)
+	}
+}
+
+func (pp *publishPrinter) wrapped() hashPrinter {
+	return pp.hp
+}
+
+// Flush sends the messages queued so far.
+func (pp *publishPrinter) Flush() error {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	pp.flush()
+	return nil
+}
+
+func (pp *publishPrinter) PrintWarning(w pathWarning) {
+	printWarning(pp.hp, w)
+}
+
+// Close sends any messages still queued, and closes the printer it wraps.
+func (pp *publishPrinter) Close() error {
+	close(pp.done)
+	pp.stopped.Wait()
+	pp.flush()
+	if err := pp.sink.close(); err != nil {
+		return fmt.Errorf("-publish %s: %w", pp.url, err)
+	}
+	if c, ok := pp.hp.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
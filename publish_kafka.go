@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// kafkaSink produces messages to a partition of a Kafka topic, using the
+// Kafka protocol directly. It uses Metadata v4 to find the partition's
+// leader, and Produce v3 with v2 record batches, which brokers from 0.11 up
+// to 4.x all support. Connections are plain TCP, without SASL.
+type kafkaSink struct {
+	brokers   []string // the bootstrap brokers
+	topic     string
+	partition int32
+
+	conn *kafkaConn // to the partition's leader
+}
+
+// Kafka API keys and error codes used by kafkaSink.
+const (
+	kafkaProduce  = 0
+	kafkaMetadata = 3
+
+	kafkaNotLeader = 6
+)
+
+// kafkaTimeout is how long to wait for a broker, and for a produce request
+// to be acknowledged.
+const kafkaTimeout = 30 * time.Second
+
+// newKafkaSink connects to the leader of a partition given as
+// broker[:port][,broker[:port]...]/topic, optionally followed by
+// ?partition=N (default 0).
+func newKafkaSink(dest string) (*kafkaSink, error) {
+	s := &kafkaSink{}
+	if i := strings.Index(dest, "?partition="); i >= 0 {
+		n, err := strconv.ParseInt(dest[i+len("?partition="):], 10, 32)
+		if err != nil || n < 0 {
+			return nil, errors.New("invalid partition")
+		}
+		s.partition, dest = int32(n), dest[:i]
+	}
+	i := strings.IndexByte(dest, '/')
+	if i < 0 || i == len(dest)-1 {
+		return nil, errors.New("a topic is needed, as kafka://broker/topic")
+	}
+	s.topic = dest[i+1:]
+	for _, b := range strings.Split(dest[:i], ",") {
+		if _, _, err := net.SplitHostPort(b); err != nil {
+			b = net.JoinHostPort(b, "9092")
+		}
+		s.brokers = append(s.brokers, b)
+	}
+	if err := s.connect(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// connect finds the partition's leader from the first bootstrap broker
+// which answers, and connects to it.
+func (s *kafkaSink) connect() error {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	var err error
+	for _, b := range s.brokers {
+		var leader string
+		if leader, err = s.findLeader(b); err == nil {
+			s.conn, err = dialKafka(leader)
+			if err == nil {
+				return nil
+			}
+		}
+	}
+	return err
+}
+
+// findLeader asks a broker for the address of the partition's leader.
+func (s *kafkaSink) findLeader(broker string) (string, error) {
+	c, err := dialKafka(broker)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+
+	var req kafkaEncoder
+	req.int32(1)
+	req.string(s.topic)
+	req.int8(1) // allow_auto_topic_creation
+	resp, err := c.roundTrip(kafkaMetadata, 4, req.buf)
+	if err != nil {
+		return "", err
+	}
+
+	d := kafkaDecoder{buf: resp}
+	d.int32() // throttle_time_ms
+	brokers := make(map[int32]string)
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		id, host, port := d.int32(), d.string(), d.int32()
+		d.string() // rack
+		brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	d.string() // cluster_id
+	d.int32()  // controller_id
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		topicErr, name := d.int16(), d.string()
+		d.int8() // is_internal
+		if name == s.topic && topicErr != 0 {
+			return "", kafkaError(topicErr)
+		}
+		for m := d.int32(); m > 0 && d.err == nil; m-- {
+			partErr, index, leader := d.int16(), d.int32(), d.int32()
+			d.int32Array() // replica_nodes
+			d.int32Array() // isr_nodes
+			if name != s.topic || index != s.partition {
+				continue
+			}
+			if partErr != 0 {
+				return "", kafkaError(partErr)
+			}
+			if addr, ok := brokers[leader]; ok {
+				return addr, nil
+			}
+			return "", fmt.Errorf("partition %d has no leader", s.partition)
+		}
+	}
+	if d.err != nil {
+		return "", d.err
+	}
+	return "", fmt.Errorf("topic %s has no partition %d", s.topic, s.partition)
+}
+
+// send produces the messages as one record batch, waiting for all in-sync
+// replicas to have them. If the leader has moved, it's found again, and the
+// batch is sent to the new leader.
+func (s *kafkaSink) send(msgs []publishMessage) error {
+	batch := kafkaRecordBatch(msgs)
+	for attempt := 0; ; attempt++ {
+		err := s.produce(batch)
+		if err == nil || attempt > 0 {
+			return err
+		}
+		if ke, ok := err.(kafkaError); ok && ke != kafkaNotLeader {
+			return err
+		}
+		if err := s.connect(); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *kafkaSink) produce(batch []byte) error {
+	var req kafkaEncoder
+	req.int16(-1) // transactional_id
+	req.int16(-1) // acks: all in-sync replicas
+	req.int32(int32(kafkaTimeout / time.Millisecond))
+	req.int32(1)
+	req.string(s.topic)
+	req.int32(1)
+	req.int32(s.partition)
+	req.bytes(batch)
+	resp, err := s.conn.roundTrip(kafkaProduce, 3, req.buf)
+	if err != nil {
+		return err
+	}
+
+	d := kafkaDecoder{buf: resp}
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		d.string() // name
+		for m := d.int32(); m > 0 && d.err == nil; m-- {
+			d.int32() // index
+			if code := d.int16(); code != 0 {
+				return kafkaError(code)
+			}
+			d.int64() // base_offset
+			d.int64() // log_append_time_ms
+		}
+	}
+	return d.err
+}
+
+func (s *kafkaSink) close() error {
+	return s.conn.Close()
+}
+
+// kafkaRecordBatch encodes messages as a v2 record batch.
+func kafkaRecordBatch(msgs []publishMessage) []byte {
+	base := msgs[0].time.UnixNano() / int64(time.Millisecond)
+	max := base
+	var records kafkaEncoder
+	for i, m := range msgs {
+		ts := m.time.UnixNano() / int64(time.Millisecond)
+		if ts > max {
+			max = ts
+		}
+		var r kafkaEncoder
+		r.int8(0) // attributes
+		r.varint(ts - base)
+		r.varint(int64(i))
+		r.varint(int64(len(m.key)))
+		r.buf = append(r.buf, m.key...)
+		r.varint(int64(len(m.value)))
+		r.buf = append(r.buf, m.value...)
+		r.varint(0) // headers
+		records.varint(int64(len(r.buf)))
+		records.buf = append(records.buf, r.buf...)
+	}
+
+	// The CRC covers everything from the attributes on
+	var body kafkaEncoder
+	body.int16(0) // attributes
+	body.int32(int32(len(msgs) - 1))
+	body.int64(base)
+	body.int64(max)
+	body.int64(-1) // producer_id
+	body.int16(-1) // producer_epoch
+	body.int32(-1) // base_sequence
+	body.int32(int32(len(msgs)))
+	body.buf = append(body.buf, records.buf...)
+
+	var batch kafkaEncoder
+	batch.int64(0) // base_offset
+	batch.int32(int32(4 + 1 + 4 + len(body.buf)))
+	batch.int32(-1) // partition_leader_epoch
+	batch.int8(2)   // magic
+	batch.int32(int32(crc32.Checksum(body.buf, crc32.MakeTable(crc32.Castagnoli))))
+	batch.buf = append(batch.buf, body.buf...)
+	return batch.buf
+}
+
+// kafkaError is an error code from a Kafka broker.
+type kafkaError int16
+
+func (e kafkaError) Error() string {
+	switch e {
+	case 3:
+		return "unknown topic or partition"
+	case kafkaNotLeader:
+		return "not the leader for the partition"
+	case 10:
+		return "message too large"
+	case 29:
+		return "not authorized to write to the topic"
+	}
+	return fmt.Sprintf("Kafka error %d", int16(e))
+}
+
+// kafkaConn is a connection to a Kafka broker.
+type kafkaConn struct {
+	net.Conn
+	br            *bufio.Reader
+	correlationID int32
+}
+
+func dialKafka(addr string) (*kafkaConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, kafkaTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &kafkaConn{Conn: conn, br: bufio.NewReader(conn)}, nil
+}
+
+// roundTrip sends a request, with a v1 request header, and returns the body
+// of its response.
+func (c *kafkaConn) roundTrip(apiKey, apiVersion int16, body []byte) ([]byte, error) {
+	c.correlationID++
+	var req kafkaEncoder
+	req.int32(0) // size, filled in below
+	req.int16(apiKey)
+	req.int16(apiVersion)
+	req.int32(c.correlationID)
+	req.string("hashtree")
+	req.buf = append(req.buf, body...)
+	binary.BigEndian.PutUint32(req.buf, uint32(len(req.buf)-4))
+
+	c.SetDeadline(time.Now().Add(2 * kafkaTimeout))
+	if _, err := c.Write(req.buf); err != nil {
+		return nil, err
+	}
+	var head [8]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(head[:4])
+	if size < 4 || size > 64<<20 {
+		return nil, fmt.Errorf("bad response size %d", size)
+	}
+	if id := int32(binary.BigEndian.Uint32(head[4:])); id != c.correlationID {
+		return nil, fmt.Errorf("response to request %d, expected %d", id, c.correlationID)
+	}
+	resp := make([]byte, size-4)
+	if _, err := io.ReadFull(c.br, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// kafkaEncoder encodes the primitive types of the Kafka protocol.
+type kafkaEncoder struct {
+	buf []byte
+}
+
+func (e *kafkaEncoder) int8(v int8) { e.buf = append(e.buf, byte(v)) }
+
+func (e *kafkaEncoder) int16(v int16) {
+	e.buf = append(e.buf, byte(v>>8), byte(v))
+}
+
+func (e *kafkaEncoder) int32(v int32) {
+	e.buf = append(e.buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (e *kafkaEncoder) int64(v int64) {
+	e.int32(int32(v >> 32))
+	e.int32(int32(v))
+}
+
+func (e *kafkaEncoder) varint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	e.buf = append(e.buf, b[:binary.PutVarint(b[:], v)]...)
+}
+
+func (e *kafkaEncoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *kafkaEncoder) bytes(b []byte) {
+	e.int32(int32(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+// kafkaDecoder decodes the primitive types of the Kafka protocol. Once an
+// error occurs, it's kept in err, and zero values are returned.
+type kafkaDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *kafkaDecoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.buf) {
+		d.err = errors.New("truncated response")
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *kafkaDecoder) int8() int8 {
+	if b := d.take(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int16() int16 {
+	if b := d.take(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int32() int32 {
+	if b := d.take(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int64() int64 {
+	if b := d.take(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+// string reads a string, or a nullable string, which is "" if it's null.
+func (d *kafkaDecoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.take(int(n)))
+}
+
+func (d *kafkaDecoder) int32Array() {
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		d.int32()
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// natsSink publishes messages to a subject on a NATS server, using the
+// client protocol directly: a PUB command for each message, and a PING to
+// wait for the server to have processed them.
+type natsSink struct {
+	conn    net.Conn
+	subject string
+
+	mu   sync.Mutex // guards w, which the reader also writes PONGs to
+	w    *bufio.Writer
+	pong chan struct{}
+	err  error // from the server, or reading from it
+}
+
+// newNATSSink connects to a server given as [user[:password]@]host[:port]/
+// subject. A user without a password is sent as a token.
+func newNATSSink(dest string) (*natsSink, error) {
+	hostport, subject := dest, ""
+	if i := strings.IndexByte(dest, '/'); i >= 0 {
+		hostport, subject = dest[:i], dest[i+1:]
+	}
+	if subject == "" || strings.ContainsAny(subject, " \t\r\n") {
+		return nil, errors.New("a subject is needed, as nats://host/subject")
+	}
+	connect := map[string]interface{}{"verbose": false, "pedantic": false, "name": "hashtree", "lang": "go", "protocol": 0}
+	if i := strings.LastIndexByte(hostport, '@'); i >= 0 {
+		user := hostport[:i]
+		hostport = hostport[i+1:]
+		if j := strings.IndexByte(user, ':'); j >= 0 {
+			connect["user"], connect["pass"] = user[:j], user[j+1:]
+		} else {
+			connect["auth_token"] = user
+		}
+	}
+	if _, _, err := net.SplitHostPort(hostport); err != nil {
+		hostport = net.JoinHostPort(hostport, "4222")
+	}
+
+	conn, err := net.DialTimeout("tcp", hostport, 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected greeting from server: %q", strings.TrimSpace(line))
+	}
+	params, err := json.Marshal(connect)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	s := &natsSink{conn: conn, subject: subject, w: bufio.NewWriter(conn), pong: make(chan struct{}, 1)}
+	fmt.Fprintf(s.w, "CONNECT %s\r\n", params)
+	go s.read(br)
+	// Make sure that the server accepted the connection
+	if err := s.ping(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// read handles what the server sends: PINGs, which must be answered, the
+// PONGs which answer ours, and errors.
+func (s *natsSink) read(br *bufio.Reader) {
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			s.mu.Lock()
+			if s.err == nil {
+				s.err = err
+			}
+			s.mu.Unlock()
+			close(s.pong)
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case line == "PING":
+			s.mu.Lock()
+			s.w.WriteString("PONG\r\n")
+			s.w.Flush()
+			s.mu.Unlock()
+		case line == "PONG":
+			s.pong <- struct{}{}
+		case strings.HasPrefix(line, "-ERR"):
+			s.mu.Lock()
+			if s.err == nil {
+				s.err = errors.New(strings.Trim(strings.TrimSpace(line[len("-ERR"):]), "'"))
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// ping sends a PING, and waits for its PONG, which the server only sends
+// once it has processed everything before it.
+func (s *natsSink) ping() error {
+	s.mu.Lock()
+	s.w.WriteString("PING\r\n")
+	err := s.w.Flush()
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	select {
+	case _, ok := <-s.pong:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.err != nil {
+			return s.err
+		} else if !ok {
+			return errors.New("connection closed")
+		}
+		return nil
+	case <-time.After(30 * time.Second):
+		return errors.New("timed out waiting for the server")
+	}
+}
+
+func (s *natsSink) send(msgs []publishMessage) error {
+	s.mu.Lock()
+	for _, m := range msgs {
+		fmt.Fprintf(s.w, "PUB %s %d\r\n", s.subject, len(m.value))
+		s.w.Write(m.value)
+		s.w.WriteString("\r\n")
+	}
+	s.mu.Unlock()
+	return s.ping()
+}
+
+func (s *natsSink) close() error {
+	return s.conn.Close()
+}
@@ -0,0 +1,64 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+// resolveLocalRoot converts a local root given on the command line to the
+// form used to access it.
+func resolveLocalRoot(root string) string {
+	return root
+}
+
+// openLocalRoot returns a filesystem for walking and reading the tree at a
+// root returned by resolveLocalRoot.
+func openLocalRoot(root string) fs.FS {
+	return rawDirFS(root)
+}
+
+// rawDirFS is like os.DirFS, but accepts paths which aren't valid UTF-8,
+// which fs.ValidPath rejects, as file names on Unix are only bytes.
+type rawDirFS string
+
+// validRawPath is fs.ValidPath, without the check for valid UTF-8.
+func validRawPath(name string) bool {
+	if name == "." {
+		return true
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if elem == "" || elem == "." || elem == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+func (dir rawDirFS) Open(name string) (fs.File, error) {
+	if !validRawPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	f, err := os.Open(string(dir) + "/" + name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (dir rawDirFS) Stat(name string) (fs.FileInfo, error) {
+	if !validRawPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	return os.Stat(string(dir) + "/" + name)
+}
+
+// listStreams returns the names of the alternate data streams of a file.
+// Alternate data streams only exist on Windows.
+func listStreams(path string) ([]string, error) {
+	return nil, errors.New("alternate data streams are only supported on Windows")
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// resolveLocalRoot converts a local root given on the command line to the
+// form used to access it. Paths are made absolute and given a \\?\ prefix,
+// so that files deeper than MAX_PATH can be opened.
+func resolveLocalRoot(root string) string {
+	// A bare drive letter refers to the current directory on that drive,
+	// which is almost never what's meant. Treat it as the drive root.
+	if len(root) == 2 && root[1] == ':' {
+		root += `\`
+	}
+
+	if !strings.HasPrefix(root, `\\?\`) {
+		abs, err := filepath.Abs(root)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if strings.HasPrefix(abs, `\\`) {
+			root = `\\?\UNC\` + abs[2:]
+		} else {
+			root = `\\?\` + abs
+		}
+	}
+
+	return strings.TrimSuffix(root, `\`)
+}
+
+// openLocalRoot returns a filesystem for walking and reading the tree at a
+// root returned by resolveLocalRoot.
+func openLocalRoot(root string) fs.FS {
+	return longPathFS(root)
+}
+
+// longPathFS is like os.DirFS, but joins paths with backslashes, as paths
+// with a \\?\ prefix are passed to the filesystem without any normalization.
+type longPathFS string
+
+func (dir longPathFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	p := string(dir)
+	if name != "." {
+		p += `\` + filepath.FromSlash(name)
+	} else if strings.HasSuffix(p, ":") {
+		// Opening a drive root requires the trailing backslash.
+		p += `\`
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+var (
+	kernel32         = windows.NewLazySystemDLL("kernel32.dll")
+	procFindFirstStr = kernel32.NewProc("FindFirstStreamW")
+	procFindNextStr  = kernel32.NewProc("FindNextStreamW")
+)
+
+// win32FindStreamData is WIN32_FIND_STREAM_DATA.
+type win32FindStreamData struct {
+	StreamSize int64
+	StreamName [windows.MAX_PATH + 36]uint16
+}
+
+// listStreams returns the names of the alternate data streams of a file,
+// not including the default unnamed stream.
+func listStreams(path string) ([]string, error) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var data win32FindStreamData
+	h, _, err := procFindFirstStr.Call(uintptr(unsafe.Pointer(p)), 0, uintptr(unsafe.Pointer(&data)), 0)
+	if windows.Handle(h) == windows.InvalidHandle {
+		if errors.Is(err, windows.ERROR_HANDLE_EOF) {
+			return nil, nil
+		}
+		return nil, &fs.PathError{Op: "FindFirstStreamW", Path: path, Err: err}
+	}
+	defer windows.FindClose(windows.Handle(h))
+
+	var names []string
+	for {
+		// Stream names are returned as ":name:$DATA", and the default
+		// stream is "::$DATA".
+		name := windows.UTF16ToString(data.StreamName[:])
+		name = strings.TrimSuffix(strings.TrimPrefix(name, ":"), ":$DATA")
+		if name != "" {
+			names = append(names, name)
+		}
+
+		ok, _, err := procFindNextStr.Call(h, uintptr(unsafe.Pointer(&data)))
+		if ok == 0 {
+			if errors.Is(err, windows.ERROR_HANDLE_EOF) {
+				return names, nil
+			}
+			return nil, &fs.PathError{Op: "FindNextStreamW", Path: path, Err: err}
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"flag"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+// stringList is a flag.Value which collects the values of a repeated
+// option.
+type stringList []string
+
+func stringListFlag(name string, usage string) *stringList {
+	var l stringList
+	flag.Var(&l, name, usage)
+	return &l
+}
+
+func (l *stringList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// rootPrefixes returns the prefix for the paths of files under each root.
+// With -label-roots or -root-label, it's the root's label followed by a
+// slash, so that files with the same relative path under different roots
+// can be told apart. Otherwise, it's empty.
+func rootPrefixes(roots []string) []string {
+	prefixes := make([]string, len(roots))
+	labels := *flagRootLabel
+	if !*flagLabelRoots && len(labels) == 0 {
+		return prefixes
+	}
+	if len(labels) > 0 && len(labels) != len(roots) {
+		log.Fatal("-root-label must be given once for each path")
+	}
+
+	seen := make(map[string]bool)
+	for i, root := range roots {
+		label := filepath.ToSlash(root)
+		if len(labels) > 0 {
+			label = labels[i]
+		}
+		if label == "" {
+			log.Fatal("root labels cannot be empty")
+		}
+		prefix := label
+		if !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		if seen[prefix] {
+			log.Fatalf("more than one path has the label %s", label)
+		}
+		seen[prefix] = true
+		prefixes[i] = prefix
+	}
+	return prefixes
+}
+
+// labeledFS serves the files of a root under its label, so that a task's
+// path can include the label.
+type labeledFS struct {
+	fs.FS
+	prefix string
+}
+
+func (l labeledFS) Open(name string) (fs.File, error) {
+	return l.FS.Open(strings.TrimPrefix(name, l.prefix))
+}
+
+// openedRoot is a root which is open for hashing.
+type openedRoot struct {
+	root   string // as returned by resolveRoot
+	prefix string // from rootPrefixes
+	fs     fs.FS  // serves files by their relative paths
+}
+
+// resolveRoot converts a root given on the command line to the form used to
+// access it.
+func resolveRoot(root string) string {
+	if isDAV(root) {
+		return root
+	}
+	return resolveLocalRoot(root)
+}
+
+// openRoot returns a filesystem for walking and reading the tree at a root
+// returned by resolveRoot.
+func openRoot(root string) fs.FS {
+	if isDAV(root) {
+		return openDAV(root)
+	}
+	return openLocalRoot(root)
+}
+
+func openRoots(roots, prefixes []string) []openedRoot {
+	var opened []openedRoot
+	for i, rootPath := range roots {
+		root := resolveRoot(snapshotPath(rootPath))
+		opened = append(opened, openedRoot{root, prefixes[i], openRoot(root)})
+	}
+	return opened
+}
+
+// task returns the task for the file at the relative path p.
+func (r openedRoot) task(p string) hashTask {
+	if r.prefix == "" {
+		return hashTask{root: r.root, path: p, fs: r.fs}
+	}
+	return hashTask{root: r.root, path: r.prefix + p, fs: labeledFS{r.fs, r.prefix}, prefix: r.prefix}
+}
+
+// rootFor returns the root a path from a manifest belongs to, by the
+// longest matching label, or false if it isn't under any of them.
+func rootFor(roots []openedRoot, p string) (openedRoot, bool) {
+	best, found := openedRoot{}, false
+	for _, r := range roots {
+		if strings.HasPrefix(p, r.prefix) && (!found || len(r.prefix) > len(best.prefix)) {
+			best, found = r, true
+		}
+	}
+	return best, found
+}
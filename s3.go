@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3PartSize is the size of each part of a multipart upload. Manifests no
+// larger than this are uploaded with a single PUT.
+const s3PartSize = 16 << 20
+
+// s3Writer uploads everything written to it to an S3 object when closed,
+// using a multipart upload for large objects so that no more than one part
+// is held in memory. Credentials, the region, and an endpoint for
+// S3-compatible stores like MinIO are taken from the usual AWS_*
+// environment variables.
+type s3Writer struct {
+	client              *http.Client
+	endpoint            *url.URL
+	pathStyle           bool
+	bucket, key, region string
+	accessKey, secret   string
+	sessionToken        string
+
+	buf      bytes.Buffer
+	uploadID string
+	etags    []string
+	err      error
+}
+
+func newS3Writer(u string) (*s3Writer, error) {
+	bucketKey := strings.TrimPrefix(u, "s3://")
+	i := strings.IndexByte(bucketKey, '/')
+	if i <= 0 || i == len(bucketKey)-1 {
+		return nil, fmt.Errorf("%s: must be of the form s3://bucket/key", u)
+	}
+	w := &s3Writer{
+		client:       &http.Client{Timeout: 10 * time.Minute},
+		bucket:       bucketKey[:i],
+		key:          bucketKey[i+1:],
+		region:       os.Getenv("AWS_REGION"),
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secret:       os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if w.accessKey == "" || w.secret == "" {
+		return nil, errors.New("S3 output requires AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	if w.region == "" {
+		w.region = "us-east-1"
+	}
+
+	// Custom endpoints are assumed to need path-style requests, as MinIO
+	// does by default.
+	endpoint := os.Getenv("AWS_ENDPOINT_URL")
+	if endpoint == "" {
+		endpoint = "https://s3." + w.region + ".amazonaws.com"
+	} else {
+		w.pathStyle = true
+	}
+	var err error
+	if w.endpoint, err = url.Parse(endpoint); err != nil {
+		return nil, fmt.Errorf("AWS_ENDPOINT_URL: %w", err)
+	}
+	return w, nil
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.buf.Write(p)
+	for w.buf.Len() >= s3PartSize && w.err == nil {
+		w.err = w.uploadPart(w.buf.Next(s3PartSize))
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	return len(p), nil
+}
+
+func (w *s3Writer) Close() error {
+	if w.err != nil {
+		w.abort()
+		return w.err
+	}
+	if w.uploadID == "" {
+		_, err := w.do("PUT", nil, w.buf.Bytes())
+		return err
+	}
+	if w.buf.Len() > 0 {
+		if err := w.uploadPart(w.buf.Bytes()); err != nil {
+			w.abort()
+			return err
+		}
+	}
+
+	type part struct {
+		PartNumber int
+		ETag       string
+	}
+	var complete struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}
+	for i, etag := range w.etags {
+		complete.Parts = append(complete.Parts, part{i + 1, etag})
+	}
+	body, _ := xml.Marshal(complete)
+	resp, err := w.do("POST", url.Values{"uploadId": {w.uploadID}}, body)
+	if err != nil {
+		w.abort()
+		return err
+	}
+	// CompleteMultipartUpload can fail after returning 200 OK
+	if bytes.Contains(resp, []byte("<Error>")) {
+		w.abort()
+		return fmt.Errorf("completing upload to s3://%s/%s: %s", w.bucket, w.key, resp)
+	}
+	return nil
+}
+
+func (w *s3Writer) uploadPart(data []byte) error {
+	if w.uploadID == "" {
+		resp, err := w.do("POST", url.Values{"uploads": {""}}, nil)
+		if err != nil {
+			return err
+		}
+		var result struct {
+			UploadID string `xml:"UploadId"`
+		}
+		if err := xml.Unmarshal(resp, &result); err != nil || result.UploadID == "" {
+			return fmt.Errorf("starting upload to s3://%s/%s: unexpected response", w.bucket, w.key)
+		}
+		w.uploadID = result.UploadID
+	}
+
+	n := len(w.etags) + 1
+	req, err := w.request("PUT", url.Values{"partNumber": {fmt.Sprint(n)}, "uploadId": {w.uploadID}}, data)
+	if err != nil {
+		return err
+	}
+	resp, err := w.send(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	w.etags = append(w.etags, resp.Header.Get("ETag"))
+	return nil
+}
+
+// abort cancels a multipart upload, so the parts aren't kept (and billed).
+func (w *s3Writer) abort() {
+	if w.uploadID != "" {
+		w.do("DELETE", url.Values{"uploadId": {w.uploadID}}, nil)
+	}
+}
+
+// do makes a request for the object, and returns the response body.
+func (w *s3Writer) do(method string, query url.Values, body []byte) ([]byte, error) {
+	req, err := w.request(method, query, body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := w.send(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+func (w *s3Writer) request(method string, query url.Values, body []byte) (*http.Request, error) {
+	u := *w.endpoint
+	if w.pathStyle {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + w.bucket + "/" + w.key
+	} else {
+		u.Host = w.bucket + "." + u.Host
+		u.Path = "/" + w.key
+	}
+	u.RawPath = s3EscapePath(u.Path)
+	u.RawQuery = strings.ReplaceAll(query.Encode(), "uploads=", "uploads")
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if w.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", w.sessionToken)
+	}
+	signV4(req, body, w.accessKey, w.secret, w.region, time.Now())
+	return req, nil
+}
+
+func (w *s3Writer) send(req *http.Request) (*http.Response, error) {
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3://%s/%s: %s: %s", w.bucket, w.key, resp.Status, bytes.TrimSpace(msg))
+	}
+	return resp, nil
+}
+
+// signV4 signs an S3 request with AWS Signature Version 4, covering all of
+// its headers.
+func signV4(req *http.Request, body []byte, accessKey, secret, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	// url.Values.Encode sorts by key, and escapes as SigV4 requires except
+	// for spaces.
+	query := req.URL.Query()
+	canonQuery := strings.ReplaceAll(query.Encode(), "+", "%20")
+
+	canonRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		canonQuery,
+		canonHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonRequest))
+
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+// s3EscapePath escapes each segment of an object path as SigV4 requires.
+func s3EscapePath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-._~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
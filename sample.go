@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io/fs"
+	"log"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// checkSample validates -sample, -sample-bytes, and -sample-seed.
+func checkSample() {
+	if *flagSample == "" && *flagSampleBytes == 0 {
+		if flagWasSet("sample-seed") {
+			log.Fatal("-sample-seed requires -sample or -sample-bytes")
+		}
+		return
+	}
+	switch {
+	case *flagCheck == "":
+		log.Fatal("-sample and -sample-bytes can only be used in check mode")
+	case *flagSample != "" && *flagSampleBytes != 0:
+		log.Fatal("-sample and -sample-bytes cannot be used together")
+	case *flagStrict:
+		log.Fatal("-sample and -sample-bytes cannot be used with -strict")
+	case *flagSampleBytes != 0 && *flagTar != "":
+		log.Fatal("-sample-bytes cannot be used with -tar")
+	}
+	if *flagSample != "" {
+		if _, _, err := parseSample(*flagSample); err != nil {
+			log.Fatal("-sample must be a number of files, or a percentage like 5%")
+		}
+	}
+}
+
+// parseSample parses -sample, which is either a number of files, or a
+// percentage of the files in the manifest.
+func parseSample(s string) (n int, percent float64, err error) {
+	if strings.HasSuffix(s, "%") {
+		percent, err = strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+		if err == nil && (percent <= 0 || percent > 100) {
+			err = strconv.ErrRange
+		}
+		return 0, percent, err
+	}
+	n, err = strconv.Atoi(s)
+	if err == nil && n <= 0 {
+		err = strconv.ErrRange
+	}
+	return n, 0, err
+}
+
+// filterSample returns a random subset of the manifest entries to verify,
+// for -sample or -sample-bytes, in manifest order. The subset is chosen
+// with -sample-seed, so that the same files can be checked again. For
+// -sample-bytes, files are added until their total size reaches the limit,
+// using the sizes in the manifest if it was written with -stat, or the
+// current sizes of the files otherwise.
+func filterSample(entries []manifestEntry, roots []openedRoot) []manifestEntry {
+	if *flagSample == "" && *flagSampleBytes == 0 {
+		return entries
+	}
+	seed := *flagSampleSeed
+	if !flagWasSet("sample-seed") {
+		seed = time.Now().UnixNano()
+	}
+	order := rand.New(rand.NewSource(seed)).Perm(len(entries))
+
+	var picked []int
+	var total int64
+	if *flagSample != "" {
+		n, percent, _ := parseSample(*flagSample)
+		if percent > 0 {
+			n = int(math.Ceil(float64(len(entries)) * percent / 100))
+		}
+		if n > len(order) {
+			n = len(order)
+		}
+		picked = order[:n]
+	} else {
+		for _, i := range order {
+			if total >= int64(*flagSampleBytes) {
+				break
+			}
+			picked = append(picked, i)
+			total += entrySize(entries[i], roots)
+		}
+	}
+	sort.Ints(picked)
+
+	sampled := make([]manifestEntry, len(picked))
+	for j, i := range picked {
+		sampled[j] = entries[i]
+	}
+	if !*flagStatus {
+		infof("verifying a sample of %d of %d files, with -sample-seed %d", len(sampled), len(entries), seed)
+	}
+	return sampled
+}
+
+// entrySize returns the size of a file listed in the manifest, or 0 if it
+// can't be found.
+func entrySize(e manifestEntry, roots []openedRoot) int64 {
+	if !e.mtime.IsZero() {
+		return e.size
+	}
+	r, ok := rootFor(roots, e.path)
+	if !ok {
+		return 0
+	}
+	fi, err := fs.Stat(r.fs, strings.TrimPrefix(e.path, r.prefix))
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
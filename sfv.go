@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+// checkSFV defaults -hash to crc32, the only hash SFV files can hold, when
+// writing SFV output.
+func checkSFV() {
+	if *flagCheck != "" {
+		return
+	}
+	for _, f := range outputFormats() {
+		if f != "sfv" {
+			continue
+		}
+		if !flagWasSet("hash") {
+			*flagHash = "crc32"
+		} else if *flagHash != "crc32" {
+			log.Fatal("sfv output requires -hash crc32")
+		}
+	}
+}
+
+// isSFVLine reports whether a manifest line looks like an SFV entry,
+// "filename CRC", rather than a "hash <spc><spc> filename" entry.
+func isSFVLine(line string) bool {
+	i := strings.LastIndexByte(line, ' ')
+	if i <= 0 || len(line)-i-1 != 8 {
+		return false
+	}
+	if _, err := hex.DecodeString(line[i+1:]); err != nil {
+		return false
+	}
+	if j := strings.Index(line, "  "); j >= 0 {
+		if _, err := decodeDigest(line[:j]); err == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// readSFVManifest reads an SFV file. Blank lines and comments, which start
+// with ";", are ignored, except for a -header before the first entry.
+func readSFVManifest(r io.Reader) ([]manifestEntry, *manifestHeader, error) {
+	var entries []manifestEntry
+	var header *manifestHeader
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSuffix(sc.Text(), "\r")
+		if header == nil && len(entries) == 0 && strings.HasPrefix(text, "; hashtree ") {
+			var err error
+			if header, err = parseHeader(text); err != nil {
+				return nil, nil, fmt.Errorf("manifest line %d: %w", line, err)
+			}
+			continue
+		}
+		if strings.TrimSpace(text) == "" || text[0] == ';' {
+			continue
+		}
+
+		i := strings.LastIndexByte(text, ' ')
+		if i <= 0 {
+			return nil, nil, fmt.Errorf("manifest line %d: malformed line", line)
+		}
+		h, err := hex.DecodeString(text[i+1:])
+		if err != nil || len(h) != 4 {
+			return nil, nil, fmt.Errorf("manifest line %d: invalid CRC", line)
+		}
+		entries = append(entries, manifestEntry{path: text[:i], hash: h, algo: "crc32"})
+	}
+	return entries, header, sc.Err()
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+)
+
+// shardIndex and shardCount are parsed from -shard by checkShard. A
+// shardCount of 0 means sharding is disabled.
+var shardIndex, shardCount uint64
+
+func checkShard() {
+	if *flagShard == "" {
+		return
+	}
+	var i, n uint64
+	if _, err := fmt.Sscanf(*flagShard, "%d/%d", &i, &n); err != nil || n == 0 || i < 1 || i > n {
+		log.Fatal("-shard must be of the form i/n, with 1 <= i <= n")
+	}
+	shardIndex, shardCount = i-1, n
+}
+
+// inShard reports whether a file belongs to the shard selected with -shard.
+// Files are assigned to shards by a hash of their path relative to the root,
+// so the assignment is the same on every machine, and doesn't depend on the
+// order in which files are found.
+func inShard(path string) bool {
+	if shardCount == 0 {
+		return true
+	}
+	h := fnv.New64a()
+	h.Write([]byte(path))
+	return h.Sum64()%shardCount == shardIndex
+}
+
+// filterShard returns the manifest entries which belong to the shard selected
+// with -shard.
+func filterShard(entries []manifestEntry) []manifestEntry {
+	if shardCount == 0 {
+		return entries
+	}
+	var filtered []manifestEntry
+	for _, e := range entries {
+		if inShard(e.path) {
+			filtered = append(filtered, e)
+		}
+	}
+	return filtered
+}
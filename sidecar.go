@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// theSidecars collects the hashes to write with -sidecar write, or is nil.
+var theSidecars *sidecarWriter
+
+// sidecarName returns the name of the sidecar files for -hash, such as
+// SHA256SUMS.
+func sidecarName() string {
+	return strings.ToUpper(*flagHash) + "SUMS"
+}
+
+// checkSidecar validates -sidecar, and sets up theSidecars for the given
+// roots with -sidecar write.
+func checkSidecar(cmd string, roots, prefixes []string) {
+	switch *flagSidecar {
+	case "":
+		return
+	case "write", "verify":
+	default:
+		log.Fatal("-sidecar must be write or verify")
+	}
+	switch {
+	case cmd != "" || *flagCheck != "" || *flagDryRun:
+		log.Fatal("-sidecar cannot be used with check mode, -dry-run, or subcommands")
+	case *flagXattr != "" || *flagArchives || *flagADS:
+		log.Fatal("-sidecar cannot be used with -xattr, -archives, or -ads")
+	case *flagURLs != "" || *flagTar != "":
+		log.Fatal("-sidecar cannot be used with -urls or -tar")
+	case *flagSidecar == "verify" && (*flagJournal != "" || *flagResume != ""):
+		log.Fatal("-sidecar verify cannot be used with -journal or -resume")
+	case *flagSidecar == "verify" && len(roots) != 1 && prefixes[0] == "":
+		log.Fatal("-sidecar verify requires exactly one path, unless -label-roots is used")
+	}
+	if *flagSidecar != "write" {
+		return
+	}
+	theSidecars = &sidecarWriter{
+		prefixes: make(map[string]string),
+		dirs:     make(map[sidecarDir]map[string][]byte),
+	}
+	for i, root := range roots {
+		theSidecars.prefixes[resolveRoot(root)] = prefixes[i]
+	}
+}
+
+// isSidecar reports whether the walk should skip a file, as it's one of the
+// sidecars being written or verified.
+func isSidecar(name string) bool {
+	return *flagSidecar != "" && name == sidecarName()
+}
+
+// sidecarWriter collects the hash of each file by directory, and writes a
+// sidecar file into each directory, in the hex format, listing the files
+// directly in it.
+type sidecarWriter struct {
+	prefixes map[string]string // by resolved root
+	dirs     map[sidecarDir]map[string][]byte
+}
+
+type sidecarDir struct {
+	root string // resolved
+	dir  string // relative to the root, with slashes
+}
+
+// record adds a result to the sidecar for its directory.
+func (s *sidecarWriter) record(r hashResult) {
+	if s == nil || r.err != nil || r.status != "" {
+		return
+	}
+	prefix, ok := s.prefixes[r.root]
+	if !ok {
+		return
+	}
+	dir, name := path.Split(strings.TrimPrefix(r.path, prefix))
+	key := sidecarDir{r.root, strings.TrimSuffix(dir, "/")}
+	if s.dirs[key] == nil {
+		s.dirs[key] = make(map[string][]byte)
+	}
+	s.dirs[key][name] = r.hash
+}
+
+// write writes the sidecar files, replacing any which are already there.
+func (s *sidecarWriter) write() {
+	if s == nil {
+		return
+	}
+	for key, files := range s.dirs {
+		p := key.root
+		if key.dir != "" {
+			p += string(filepath.Separator) + filepath.FromSlash(key.dir)
+		}
+		if err := writeSidecar(filepath.Join(p, sidecarName()), files); err != nil {
+			log.Fatal("writing sidecar: ", err)
+		}
+	}
+	debugf("wrote %d %s files", len(s.dirs), sidecarName())
+}
+
+// writeSidecar writes a sidecar file, sorted by name. It's written to a
+// temporary file first, so that an existing sidecar is never left half
+// written.
+func writeSidecar(name string, files map[string][]byte) error {
+	var names []string
+	for n := range files {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	tmp := name + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	hp := hexHashPrinter{bw}
+	for _, n := range names {
+		hp.Print(hashResult{path: n, hash: files[n]})
+	}
+	err = bw.Flush()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// loadSidecars reads the sidecar files under each root, for -sidecar verify,
+// and returns their entries with the paths of the files they list.
+func loadSidecars(roots, prefixes []string) []manifestEntry {
+	var entries []manifestEntry
+	for _, r := range openRoots(roots, prefixes) {
+		err := fs.WalkDir(r.fs, ".", func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() || d.Name() != sidecarName() {
+				return nil
+			}
+			f, err := r.fs.Open(p)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			listed, _, err := readTextManifest(f, hex.DecodeString)
+			if err != nil {
+				return fmt.Errorf("%s: %w", p, err)
+			}
+			for _, e := range listed {
+				e.path = r.prefix + path.Join(path.Dir(p), e.path)
+				entries = append(entries, e)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	debugf("loaded %d files from %s files", len(entries), sidecarName())
+	return entries
+}
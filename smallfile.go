@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"sync"
+)
+
+// smallFileBufs holds buffers for reading small files whole, for
+// -small-files. Each is one byte larger than the threshold, so that a file
+// which has grown since it was statted can be told apart from one which is
+// exactly the threshold size.
+var smallFileBufs = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, *flagSmallFiles+1)
+		return &b
+	},
+}
+
+// hashSmallFile hashes f, which was opened for task, by reading it into
+// memory with as few reads as possible, if it's a regular file smaller than
+// -small-files. This avoids most of the overhead of the copy loop in
+// hashReader, which dominates for trees of tiny files. It returns false if
+// the file isn't small, in which case nothing has been read from it.
+func hashSmallFile(hf hashFactory, f fs.File, buf []byte) (hashResult, bool) {
+	if *flagSmallFiles <= 0 {
+		return hashResult{}, false
+	}
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() || fi.Size() > int64(*flagSmallFiles) {
+		return hashResult{}, false
+	}
+
+	bp := smallFileBufs.Get().(*[]byte)
+	defer smallFileBufs.Put(bp)
+	data := *bp
+
+	rd := fileReader(f)
+	if byteLimiter != nil || iopsLimiter != nil || readMeter != nil {
+		rd = meteredReader{rd}
+	}
+	n := 0
+	for n < len(data) {
+		k, err := rd.Read(data[n:])
+		n += k
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return hashResult{err: err}, true
+		}
+	}
+
+	if n == len(data) {
+		// The file has grown past the threshold; hash the rest normally
+		r := hashCopy(hf, io.MultiReader(bytes.NewReader(data), rd), buf)
+		return r, true
+	}
+	return hashCopy(hf, bytes.NewReader(data[:n]), nil), true
+}
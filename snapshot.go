@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// snapshot is a read-only snapshot of a root, taken with -snapshot.
+type snapshot struct {
+	path    string // where the root can be read in the snapshot
+	release func() error
+}
+
+// snapshots maps each root, as given on the command line, to its snapshot.
+var (
+	snapshots       map[string]*snapshot
+	releaseSnapshot sync.Once
+)
+
+// checkSnapshot validates -snapshot.
+func checkSnapshot(cmd string) {
+	if *flagSnapshot == "" {
+		return
+	}
+	switch kind := *flagSnapshot; {
+	case kind == "vss":
+		if runtime.GOOS != "windows" {
+			log.Fatal("-snapshot vss is only supported on Windows")
+		}
+	case kind == "btrfs" || kind == "zfs":
+		if runtime.GOOS == "windows" {
+			log.Fatalf("-snapshot %s is not supported on Windows", kind)
+		}
+	case strings.HasPrefix(kind, "exec:"):
+	default:
+		log.Fatal("-snapshot must be vss, btrfs, zfs, or exec:<command>")
+	}
+	switch {
+	case cmd != "":
+		log.Fatal("-snapshot cannot be used with subcommands")
+	case *flagResume != "":
+		log.Fatal("-snapshot cannot be used with -resume")
+	case *flagXattr == "write" || *flagSidecar == "write":
+		log.Fatal("-snapshot cannot be used with -xattr write or -sidecar write")
+	}
+}
+
+// snapshotPath returns the path a root is read from: the root in its
+// snapshot, with -snapshot, or the root itself.
+func snapshotPath(root string) string {
+	if s := snapshots[root]; s != nil {
+		return s.path
+	}
+	return root
+}
+
+// takeSnapshots takes a snapshot of each root, for -snapshot. The snapshots
+// are released by releaseSnapshots, which is also called if the run fails or
+// is interrupted.
+func takeSnapshots(roots []string) {
+	if *flagSnapshot == "" {
+		return
+	}
+	snapshots = make(map[string]*snapshot)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		releaseSnapshots()
+		os.Exit(130)
+	}()
+
+	// Each snapshot is named for the process and root, so that several
+	// roots (or runs) on the same filesystem don't clash.
+	for i, root := range roots {
+		if _, ok := snapshots[root]; ok {
+			continue
+		}
+		abs, err := filepath.Abs(root)
+		if err != nil {
+			log.Fatal(err)
+		}
+		name := fmt.Sprintf("hashtree-%d-%d", os.Getpid(), i)
+		var s *snapshot
+		switch {
+		case *flagSnapshot == "vss":
+			s, err = snapshotVSS(abs)
+		case *flagSnapshot == "btrfs":
+			s, err = snapshotBtrfs(abs, name)
+		case *flagSnapshot == "zfs":
+			s, err = snapshotZFS(abs, name)
+		default:
+			s, err = snapshotExec(strings.TrimPrefix(*flagSnapshot, "exec:"), abs)
+		}
+		if err != nil {
+			log.Fatalf("%s: taking snapshot: %v", root, err)
+		}
+		snapshots[root] = s
+		debugf("%s: reading from snapshot %s", root, s.path)
+	}
+}
+
+// releaseSnapshots releases the snapshots taken by takeSnapshots, once all
+// files have been read. Failures are logged, as the snapshots might need to
+// be removed by hand.
+func releaseSnapshots() {
+	releaseSnapshot.Do(func() {
+		for root, s := range snapshots {
+			if err := s.release(); err != nil {
+				errorf("%s: releasing snapshot %s: %v", root, s.path, err)
+			}
+		}
+	})
+}
+
+// runSnapshotCommand runs a command, and returns its output. Its errors go
+// to standard error.
+func runSnapshotCommand(cmd *exec.Cmd) (string, error) {
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%s: %v", strings.Join(cmd.Args, " "), err)
+	}
+	return out.String(), nil
+}
+
+// snapshotBtrfs takes a read-only snapshot of a btrfs subvolume, inside the
+// subvolume itself. Snapshots aren't recursive, so it shows up as an empty
+// directory in its own snapshot.
+func snapshotBtrfs(root, name string) (*snapshot, error) {
+	path := filepath.Join(root, "."+name)
+	if _, err := runSnapshotCommand(exec.Command("btrfs", "subvolume", "snapshot", "-r", root, path)); err != nil {
+		return nil, err
+	}
+	return &snapshot{path, func() error {
+		_, err := runSnapshotCommand(exec.Command("btrfs", "subvolume", "delete", path))
+		return err
+	}}, nil
+}
+
+// snapshotZFS takes a snapshot of the ZFS dataset holding a root, and reads
+// it through the dataset's .zfs/snapshot directory.
+func snapshotZFS(root, name string) (*snapshot, error) {
+	out, err := runSnapshotCommand(exec.Command("zfs", "list", "-H", "-o", "name,mountpoint", root))
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Split(strings.TrimSpace(out), "\t")
+	if len(fields) != 2 || !filepath.IsAbs(fields[1]) {
+		return nil, fmt.Errorf("%s is not in a mounted ZFS filesystem", root)
+	}
+	dataset, mountpoint := fields[0], fields[1]
+	rel, err := filepath.Rel(mountpoint, root)
+	if err != nil {
+		return nil, err
+	}
+
+	snap := dataset + "@" + name
+	if _, err := runSnapshotCommand(exec.Command("zfs", "snapshot", snap)); err != nil {
+		return nil, err
+	}
+	return &snapshot{filepath.Join(mountpoint, ".zfs", "snapshot", name, rel), func() error {
+		_, err := runSnapshotCommand(exec.Command("zfs", "destroy", snap))
+		return err
+	}}, nil
+}
+
+// snapshotVSS creates a Volume Shadow Copy of the volume holding a root,
+// using WMI from PowerShell, which requires administrator rights.
+func snapshotVSS(root string) (*snapshot, error) {
+	volume := filepath.VolumeName(root)
+	if len(volume) != 2 || volume[1] != ':' {
+		return nil, fmt.Errorf("%s is not on a local volume", root)
+	}
+	out, err := runSnapshotCommand(exec.Command("powershell", "-NoProfile", "-Command",
+		`$r = Invoke-CimMethod -ClassName Win32_ShadowCopy -MethodName Create -Arguments @{Volume='`+volume+`\'; Context='ClientAccessible'}; `+
+			`if ($r.ReturnValue -ne 0) { Write-Error "Win32_ShadowCopy.Create returned $($r.ReturnValue)"; exit 1 }; `+
+			`$s = Get-CimInstance Win32_ShadowCopy | Where-Object ID -eq $r.ShadowID; $s.ID; $s.DeviceObject`))
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Fields(out)
+	if len(lines) != 2 {
+		return nil, fmt.Errorf("unexpected output from PowerShell: %q", out)
+	}
+	id, device := lines[0], lines[1]
+	return &snapshot{device + root[len(volume):], func() error {
+		_, err := runSnapshotCommand(exec.Command("powershell", "-NoProfile", "-Command",
+			`Get-CimInstance Win32_ShadowCopy | Where-Object ID -eq '`+id+`' | Remove-CimInstance`))
+		return err
+	}}, nil
+}
+
+// snapshotExec takes a snapshot with a command, for other snapshot systems
+// such as LVM. The command is run using the shell, with the root in
+// HASHTREE_ROOT and HASHTREE_SNAPSHOT_ACTION set to create, and must print
+// the path the root can be read from in the snapshot. It's run again to
+// release the snapshot, with HASHTREE_SNAPSHOT_ACTION set to release and the
+// path it printed in HASHTREE_SNAPSHOT.
+func snapshotExec(command, root string) (*snapshot, error) {
+	cmd := shellCommand(command)
+	cmd.Env = append(os.Environ(), "HASHTREE_ROOT="+root, "HASHTREE_SNAPSHOT_ACTION=create")
+	out, err := runSnapshotCommand(cmd)
+	if err != nil {
+		return nil, err
+	}
+	path := strings.TrimRight(strings.SplitN(out, "\n", 2)[0], "\r")
+	if path == "" {
+		return nil, fmt.Errorf("%s printed no snapshot path", command)
+	}
+	return &snapshot{path, func() error {
+		cmd := shellCommand(command)
+		cmd.Env = append(os.Environ(), "HASHTREE_ROOT="+root, "HASHTREE_SNAPSHOT_ACTION=release", "HASHTREE_SNAPSHOT="+path)
+		_, err := runSnapshotCommand(cmd)
+		return err
+	}}, nil
+}
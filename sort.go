@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/gob"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+// checkCanonical sets up -canonical, which sorts the output, normalizes
+// paths to NFC (unless -normalize-paths is given), and rules out anything
+// which would make the manifest depend on more than the tree's contents.
+// Paths already use forward slashes on every platform, and lines always end
+// with a bare newline.
+func checkCanonical(cmd string) {
+	if !*flagCanonical {
+		return
+	}
+	switch {
+	case cmd != "" || *flagCheck != "" || *flagDryRun:
+		log.Fatal("-canonical cannot be used with check mode, -dry-run, or subcommands")
+	case *flagStream != "":
+		log.Fatal("-canonical cannot be used with -stream")
+	case *flagHeader || *flagTimings:
+		log.Fatal("-canonical cannot be used with -header or -timings, which record details of the run")
+	case *flagClones || *flagCollisions:
+		log.Fatal("-canonical cannot be used with -clones or -collisions, whose output depends on the order files are hashed in")
+	case len(*flagEncryptTo) > 0 || *flagPassphraseEnv != "":
+		log.Fatal("-canonical cannot be used with encrypted output")
+	case *flagNormalizePaths == "none" && flagWasSet("normalize-paths"):
+		log.Fatal("-canonical requires normalized paths")
+	}
+	*flagSort = true
+	if !flagWasSet("normalize-paths") {
+		*flagNormalizePaths = "nfc"
+	}
+}
+
+// sortingPrinter sorts results by path before passing them to another
+// printer, for -sort. Results are held in memory up to -sort-mem, beyond
+// which they're sorted and spilled to temporary files, which are merged when
+// the printer is closed. Errors aren't sorted, but passed on immediately.
+type sortingPrinter struct {
+	hp     hashPrinter
+	batch  []spillRecord
+	size   int64 // approximate memory used by batch
+	spills []*os.File
+}
+
+// spillRecord is a result as written to a spill file.
+type spillRecord struct {
+	Path      string
+	Hash      []byte
+	Size      int64
+	Chunks    [][]byte
+	Retries   int
+	Known     bool
+	SymlinkOf string
+	CloneOf   string
+	MIME      string
+	Entropy   float64 // -1 if there is none, as gob can't tell nil from 0
+	MTime     time.Time
+	Timing    *resultTiming
+	Algo      string
+	Status    string // for -tombstones
+	WasLocked bool
+	Root      string
+}
+
+// spillLess orders records by path, and then by hash and root, so that
+// results for the same path, such as from overlapping roots, come out in the
+// same order on every run.
+func spillLess(a, b *spillRecord) bool {
+	if a.Path != b.Path {
+		return a.Path < b.Path
+	}
+	if c := bytes.Compare(a.Hash, b.Hash); c != 0 {
+		return c < 0
+	}
+	return a.Root < b.Root
+}
+
+// spillOverhead approximates the memory used by a spillRecord, other than
+// its contents.
+const spillOverhead = 128
+
+func newSortingPrinter(hp hashPrinter) *sortingPrinter {
+	return &sortingPrinter{hp: hp}
+}
+
+func (sp *sortingPrinter) Print(r hashResult) {
+	rec := spillRecord{r.path, r.hash, r.size, r.chunks, r.retries, r.known, r.symlinkOf, r.cloneOf, r.mime, -1, r.mtime, r.timing, r.algo, r.status, r.wasLocked, r.root}
+	if r.entropy != nil {
+		rec.Entropy = *r.entropy
+	}
+	sp.batch = append(sp.batch, rec)
+	sp.size += spillOverhead + int64(len(rec.Path)+len(rec.Hash)+len(rec.SymlinkOf)+len(rec.CloneOf))
+	for _, c := range rec.Chunks {
+		sp.size += int64(len(c))
+	}
+	if sp.size >= int64(*flagSortMem) {
+		sp.spill()
+	}
+}
+
+func (sp *sortingPrinter) PrintError(r hashResult) {
+	if ep, ok := sp.hp.(errorPrinter); ok {
+		ep.PrintError(r)
+	}
+}
+
+func (sp *sortingPrinter) wrapped() hashPrinter {
+	return sp.hp
+}
+
+// PrintWarning passes warnings on immediately, like errors.
+func (sp *sortingPrinter) PrintWarning(w pathWarning) {
+	printWarning(sp.hp, w)
+}
+
+func (sp *sortingPrinter) sortBatch() {
+	sort.Slice(sp.batch, func(i, j int) bool {
+		return spillLess(&sp.batch[i], &sp.batch[j])
+	})
+}
+
+// spill writes the current batch to a temporary file.
+func (sp *sortingPrinter) spill() {
+	sp.sortBatch()
+	f, err := os.CreateTemp("", "hashtree-sort-*")
+	if err != nil {
+		log.Fatal(err)
+	}
+	bw := bufio.NewWriter(f)
+	enc := gob.NewEncoder(bw)
+	for i := range sp.batch {
+		if err := enc.Encode(&sp.batch[i]); err != nil {
+			log.Fatal("writing sort spill file: ", err)
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		log.Fatal("writing sort spill file: ", err)
+	}
+	debugf("sort: spilled %d results to %s", len(sp.batch), f.Name())
+	sp.spills = append(sp.spills, f)
+	sp.batch, sp.size = nil, 0
+}
+
+func (sp *sortingPrinter) Close() error {
+	defer func() {
+		for _, f := range sp.spills {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	// Merge the spill files and the final batch, which stays in memory
+	sp.sortBatch()
+	var sources spillHeap
+	for _, f := range sp.spills {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		dec := gob.NewDecoder(bufio.NewReader(f))
+		next := func() (spillRecord, error) {
+			var rec spillRecord
+			err := dec.Decode(&rec)
+			return rec, err
+		}
+		if err := sources.add(next); err != nil {
+			return err
+		}
+	}
+	batch := sp.batch
+	err := sources.add(func() (spillRecord, error) {
+		if len(batch) == 0 {
+			return spillRecord{}, io.EOF
+		}
+		rec := batch[0]
+		batch = batch[1:]
+		return rec, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	heap.Init(&sources)
+	for len(sources) > 0 {
+		src := sources[0]
+		rec := src.cur
+		var entropy *float64
+		if rec.Entropy >= 0 {
+			entropy = &rec.Entropy
+		}
+		sp.hp.Print(hashResult{
+			path:      rec.Path,
+			hash:      rec.Hash,
+			size:      rec.Size,
+			chunks:    rec.Chunks,
+			retries:   rec.Retries,
+			known:     rec.Known,
+			symlinkOf: rec.SymlinkOf,
+			cloneOf:   rec.CloneOf,
+			mime:      rec.MIME,
+			entropy:   entropy,
+			mtime:     rec.MTime,
+			timing:    rec.Timing,
+			algo:      rec.Algo,
+			status:    rec.Status,
+			wasLocked: rec.WasLocked,
+			root:      rec.Root,
+		})
+
+		if src.cur, err = src.next(); err == io.EOF {
+			heap.Pop(&sources)
+		} else if err != nil {
+			return err
+		} else {
+			heap.Fix(&sources, 0)
+		}
+	}
+
+	if c, ok := sp.hp.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// spillSource is a sorted run of results being merged.
+type spillSource struct {
+	cur  spillRecord
+	next func() (spillRecord, error)
+}
+
+// spillHeap is a heap of runs, ordered by their next results.
+type spillHeap []*spillSource
+
+// add adds a run to the heap, unless it's empty.
+func (h *spillHeap) add(next func() (spillRecord, error)) error {
+	cur, err := next()
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	*h = append(*h, &spillSource{cur, next})
+	return nil
+}
+
+func (h spillHeap) Len() int            { return len(h) }
+func (h spillHeap) Less(i, j int) bool  { return spillLess(&h[i].cur, &h[j].cur) }
+func (h spillHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *spillHeap) Push(x interface{}) { *h = append(*h, x.(*spillSource)) }
+func (h *spillHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// theStats collects the -stats report, or is nil.
+var theStats *usageStats
+
+// usageStats counts the files hashed in a run, and their total size, by
+// root, by top-level directory within each root ("." for the files at the
+// top level), and by file extension ("(none)" for files without one).
+type usageStats struct {
+	roots map[string]statsRoot // by resolved root
+
+	total  usageCount
+	errors int64
+	byRoot map[string]*usageCount
+	byDir  map[string]*usageCount
+	byExt  map[string]*usageCount
+}
+
+type statsRoot struct {
+	name   string // as given on the command line
+	prefix string
+}
+
+type usageCount struct {
+	Files int64 `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+// checkStats validates -stats and -stats-format, and sets up theStats for
+// the given roots.
+func checkStats(roots, prefixes []string) {
+	if *flagStats == "" {
+		return
+	}
+	switch *flagStatsFormat {
+	case "text", "json":
+	default:
+		log.Fatal("-stats-format must be text or json")
+	}
+	theStats = &usageStats{
+		roots:  make(map[string]statsRoot),
+		byRoot: make(map[string]*usageCount),
+		byDir:  make(map[string]*usageCount),
+		byExt:  make(map[string]*usageCount),
+	}
+	for i, root := range roots {
+		theStats.roots[resolveRoot(snapshotPath(root))] = statsRoot{root, prefixes[i]}
+	}
+}
+
+// record counts a result. Files reached again through a symlink aren't
+// counted twice.
+func (s *usageStats) record(r hashResult) {
+	if s == nil || r.status != "" || r.symlinkOf != "" {
+		return
+	}
+	if r.err != nil {
+		s.errors++
+		return
+	}
+
+	root, ok := s.roots[r.root]
+	if !ok {
+		// From -tar, which is named by r.root, or -urls
+		root = statsRoot{name: r.root}
+	}
+	dir := "."
+	if isURL(r.path) {
+		root.name = "(urls)"
+	} else if rel := strings.TrimPrefix(r.path, root.prefix); strings.Contains(rel, "/") {
+		dir = rel[:strings.IndexByte(rel, '/')]
+	}
+	ext := strings.ToLower(path.Ext(path.Base(r.path)))
+	if ext == "" {
+		ext = "(none)"
+	}
+
+	s.total.add(r.size)
+	s.count(s.byRoot, root.name, r.size)
+	s.count(s.byDir, root.name+"\x00"+dir, r.size)
+	s.count(s.byExt, ext, r.size)
+}
+
+func (s *usageStats) count(m map[string]*usageCount, key string, size int64) {
+	c := m[key]
+	if c == nil {
+		c = &usageCount{}
+		m[key] = c
+	}
+	c.add(size)
+}
+
+func (c *usageCount) add(size int64) {
+	c.Files++
+	c.Bytes += size
+}
+
+// statsEntry is a line of the report.
+type statsEntry struct {
+	Root      string `json:"root,omitempty"`
+	Dir       string `json:"dir,omitempty"`
+	Extension string `json:"extension,omitempty"`
+	usageCount
+}
+
+// sortedEntries returns the counts in m, largest first.
+func sortedEntries(m map[string]*usageCount, entry func(key string) statsEntry) []statsEntry {
+	var entries []statsEntry
+	for key, c := range m {
+		e := entry(key)
+		e.usageCount = *c
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Bytes != entries[j].Bytes {
+			return entries[i].Bytes > entries[j].Bytes
+		}
+		return entries[i].Root+entries[i].Dir+entries[i].Extension < entries[j].Root+entries[j].Dir+entries[j].Extension
+	})
+	return entries
+}
+
+// write writes the report to the -stats file.
+func (s *usageStats) write() {
+	if s == nil {
+		return
+	}
+	roots := sortedEntries(s.byRoot, func(key string) statsEntry {
+		return statsEntry{Root: key}
+	})
+	dirs := sortedEntries(s.byDir, func(key string) statsEntry {
+		i := strings.IndexByte(key, 0)
+		return statsEntry{Root: key[:i], Dir: key[i+1:]}
+	})
+	exts := sortedEntries(s.byExt, func(key string) statsEntry {
+		return statsEntry{Extension: key}
+	})
+
+	f, err := os.Create(*flagStats)
+	if err != nil {
+		log.Fatal(err)
+	}
+	bw := bufio.NewWriter(f)
+	if *flagStatsFormat == "json" {
+		enc := json.NewEncoder(bw)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(struct {
+			Files      int64        `json:"files"`
+			Bytes      int64        `json:"bytes"`
+			Errors     int64        `json:"errors"`
+			Roots      []statsEntry `json:"roots"`
+			Dirs       []statsEntry `json:"dirs"`
+			Extensions []statsEntry `json:"extensions"`
+		}{s.total.Files, s.total.Bytes, s.errors, roots, dirs, exts})
+	} else {
+		s.writeText(bw, roots, dirs, exts)
+	}
+	if ferr := bw.Flush(); err == nil {
+		err = ferr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Fatal("writing -stats: ", err)
+	}
+}
+
+func (s *usageStats) writeText(w io.Writer, roots, dirs, exts []statsEntry) {
+	line := func(name string, c usageCount) {
+		fmt.Fprintf(w, "  %-40s %10d files %12s\n", name, c.Files, formatBytes(c.Bytes))
+	}
+	fmt.Fprintf(w, "%d files, %s (%d bytes), %d errors\n", s.total.Files, formatBytes(s.total.Bytes), s.total.Bytes, s.errors)
+	fmt.Fprintln(w, "\nBy root:")
+	for _, e := range roots {
+		line(e.Root, e.usageCount)
+	}
+	fmt.Fprintln(w, "\nBy top-level directory:")
+	for _, e := range dirs {
+		name := e.Dir
+		if len(roots) > 1 {
+			name = e.Root + ": " + name
+		}
+		line(name, e.usageCount)
+	}
+	fmt.Fprintln(w, "\nBy extension:")
+	for _, e := range exts {
+		line(e.Extension, e.usageCount)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"math"
+	"net"
+	"strings"
+	"time"
+)
+
+// Field numbers from stream.proto.
+const (
+	pbMessageResult   = 1
+	pbMessageError    = 2
+	pbMessageProgress = 3
+	pbMessageWarning  = 4
+
+	pbResultPath      = 1
+	pbResultHash      = 2
+	pbResultSize      = 3
+	pbResultChunks    = 4
+	pbResultKnown     = 5
+	pbResultSymlinkOf = 6
+	pbResultCloneOf   = 7
+	pbResultDuration  = 8
+	pbResultWorker    = 9
+	pbResultMTime     = 10
+	pbResultMIME      = 11
+	pbResultEntropy   = 12
+	pbResultDeleted   = 13
+	pbResultWasLocked = 14
+	pbResultAlgo      = 15
+
+	pbErrorPath    = 1
+	pbErrorMessage = 2
+
+	pbProgressFiles  = 1
+	pbProgressBytes  = 2
+	pbProgressErrors = 3
+
+	pbWarningKind         = 1
+	pbWarningPath         = 2
+	pbWarningCollidesWith = 3
+)
+
+// progressInterval is the minimum time between progress messages.
+const progressInterval = time.Second
+
+// streamHashPrinter sends results, errors, and periodic progress updates to a
+// socket as length-delimited protobuf messages, as described in stream.proto.
+// Errors are reported to the consumer rather than aborting the run.
+type streamHashPrinter struct {
+	conn net.Conn
+
+	files, bytes, errors uint64
+	lastProgress         time.Time
+}
+
+func newStreamHashPrinter(addr string) *streamHashPrinter {
+	var network string
+	switch {
+	case strings.HasPrefix(addr, "unix:"):
+		network, addr = "unix", addr[len("unix:"):]
+	case strings.HasPrefix(addr, "tcp:"):
+		network, addr = "tcp", addr[len("tcp:"):]
+	default:
+		log.Fatal("-stream address must start with unix: or tcp:")
+	}
+
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return &streamHashPrinter{conn: conn, lastProgress: time.Now()}
+}
+
+func (hp *streamHashPrinter) Print(r hashResult) {
+	var m []byte
+	m = pbAppendBytes(m, pbResultPath, []byte(r.path))
+	m = pbAppendBytes(m, pbResultHash, r.hash)
+	m = pbAppendUint(m, pbResultSize, uint64(r.size))
+	for _, c := range r.chunks {
+		m = pbAppendBytes(m, pbResultChunks, c)
+	}
+	if r.known {
+		m = pbAppendUint(m, pbResultKnown, 1)
+	}
+	if r.symlinkOf != "" {
+		m = pbAppendBytes(m, pbResultSymlinkOf, []byte(r.symlinkOf))
+	}
+	if r.cloneOf != "" {
+		m = pbAppendBytes(m, pbResultCloneOf, []byte(r.cloneOf))
+	}
+	if r.mime != "" {
+		m = pbAppendBytes(m, pbResultMIME, []byte(r.mime))
+	}
+	if r.entropy != nil {
+		m = pbAppendDouble(m, pbResultEntropy, *r.entropy)
+	}
+	if r.wasLocked {
+		m = pbAppendUint(m, pbResultWasLocked, 1)
+	}
+	if r.algo != "" {
+		m = pbAppendBytes(m, pbResultAlgo, []byte(r.algo))
+	}
+	if !r.mtime.IsZero() {
+		m = pbAppendUint(m, pbResultMTime, uint64(r.mtime.UnixNano()))
+	}
+	if r.timing != nil {
+		m = pbAppendDouble(m, pbResultDuration, float64(r.timing.Duration)/float64(time.Millisecond))
+		m = pbAppendUint(m, pbResultWorker, uint64(r.timing.Worker))
+	}
+	if r.status == statusDeleted {
+		hp.send(pbMessageResult, pbAppendUint(m, pbResultDeleted, 1))
+		return
+	}
+	hp.send(pbMessageResult, m)
+
+	hp.files++
+	hp.bytes += uint64(r.size)
+	hp.maybeSendProgress()
+}
+
+func (hp *streamHashPrinter) PrintError(r hashResult) {
+	var m []byte
+	m = pbAppendBytes(m, pbErrorPath, []byte(r.path))
+	m = pbAppendBytes(m, pbErrorMessage, []byte(r.err.Error()))
+	hp.send(pbMessageError, m)
+
+	hp.errors++
+	hp.maybeSendProgress()
+}
+
+func (hp *streamHashPrinter) PrintWarning(w pathWarning) {
+	var m []byte
+	m = pbAppendBytes(m, pbWarningKind, []byte(w.name()))
+	m = pbAppendBytes(m, pbWarningPath, []byte(w.path))
+	if w.other != "" {
+		m = pbAppendBytes(m, pbWarningCollidesWith, []byte(w.other))
+	}
+	hp.send(pbMessageWarning, m)
+}
+
+// Close sends a final progress message and closes the connection.
+func (hp *streamHashPrinter) Close() error {
+	hp.sendProgress()
+	return hp.conn.Close()
+}
+
+func (hp *streamHashPrinter) maybeSendProgress() {
+	if time.Since(hp.lastProgress) >= progressInterval {
+		hp.sendProgress()
+	}
+}
+
+func (hp *streamHashPrinter) sendProgress() {
+	var m []byte
+	m = pbAppendUint(m, pbProgressFiles, hp.files)
+	m = pbAppendUint(m, pbProgressBytes, hp.bytes)
+	m = pbAppendUint(m, pbProgressErrors, hp.errors)
+	hp.send(pbMessageProgress, m)
+	hp.lastProgress = time.Now()
+}
+
+// send wraps an encoded inner message in a Message and writes it to the
+// connection with a length prefix.
+func (hp *streamHashPrinter) send(field int, inner []byte) {
+	msg := pbAppendBytes(nil, field, inner)
+	frame := pbAppendVarint(make([]byte, 0, len(msg)+10), uint64(len(msg)))
+	frame = append(frame, msg...)
+	if _, err := hp.conn.Write(frame); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// The following implement the small subset of the protobuf wire format
+// needed to encode the messages in stream.proto.
+
+func pbAppendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func pbAppendUint(b []byte, field int, v uint64) []byte {
+	b = pbAppendVarint(b, uint64(field)<<3)
+	return pbAppendVarint(b, v)
+}
+
+func pbAppendDouble(b []byte, field int, v float64) []byte {
+	b = pbAppendVarint(b, uint64(field)<<3|1)
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], math.Float64bits(v))
+	return append(b, buf[:]...)
+}
+
+func pbAppendBytes(b []byte, field int, v []byte) []byte {
+	b = pbAppendVarint(b, uint64(field)<<3|2)
+	b = pbAppendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
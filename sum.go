@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io/fs"
+	"log"
+	"os"
+)
+
+// checkSum rejects options which need a tree to walk, or a root to find
+// files under, for sum.
+func checkSum(cmd string) {
+	if cmd != "sum" {
+		return
+	}
+	switch {
+	case *flagCheck != "" || *flagDryRun:
+		log.Fatal("sum cannot be used with check mode or -dry-run")
+	case *flagURLs != "" || *flagTar != "":
+		log.Fatal("sum cannot be used with -urls or -tar")
+	case *flagXattr != "" || *flagADS || *flagArchives:
+		log.Fatal("sum cannot be used with -xattr, -ads, or -archives")
+	case *flagJournal != "" || *flagResume != "" || *flagSnapshot != "" || *flagSidecar != "":
+		log.Fatal("sum cannot be used with -journal, -resume, -snapshot, or -sidecar")
+	}
+
+	// Like sha256sum, print the files in the order they were given, unless
+	// -jobs asks for them to be hashed in parallel.
+	if !flagWasSet("jobs") {
+		*flagJobs = "1"
+	}
+}
+
+// sumFS opens files by the names they were given on the command line, for
+// sum, rather than by paths relative to a root. - is standard input.
+type sumFS struct{}
+
+func (sumFS) Open(name string) (fs.File, error) {
+	if name == "-" {
+		return os.Stdin, nil
+	}
+	return os.Open(name)
+}
+
+// feedSum queues each of the files given to sum, as they were given. Unlike
+// the paths given to the main command, directories aren't walked, so they
+// fail like any other file which can't be read.
+func feedSum(files []string, tasks chan<- hashTask) {
+	for _, name := range files {
+		tasks <- hashTask{path: name, fs: sumFS{}}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+)
+
+// fileID identifies a file independently of the path it was reached by.
+type fileID struct {
+	dev, ino uint64
+}
+
+// symlinkWalker tracks the files and directories seen while walking a tree
+// with -follow-symlinks, so that symlink loops are only walked once, and
+// files reached through symlinks aren't hashed twice.
+type symlinkWalker struct {
+	root string
+	dir  fs.FS
+	seen map[fileID]string // path each file or directory was first seen at
+
+	// links are the symlinks found so far. They're followed once the rest
+	// of the tree has been walked, so that files are reported under their
+	// own paths in preference to a symlink's.
+	links     []string
+	following bool
+}
+
+func newSymlinkWalker(root string, dir fs.FS) *symlinkWalker {
+	return &symlinkWalker{root: root, dir: dir, seen: make(map[fileID]string)}
+}
+
+func (sw *symlinkWalker) id(p string) fileID {
+	fi, err := fs.Stat(sw.dir, p)
+	if err != nil {
+		log.Fatal(err)
+	}
+	id, err := fileIDOf(hashTask{root: sw.root, path: p}.osPath(), fi)
+	if err != nil {
+		log.Fatalf("%s: %v", p, err)
+	}
+	return id
+}
+
+// enterDir reports whether to walk the directory p, which is false if it has
+// already been walked by another path.
+func (sw *symlinkWalker) enterDir(p string) bool {
+	id := sw.id(p)
+	if first, ok := sw.seen[id]; ok {
+		debugf("%s: skipping, already walked as %s", p, first)
+		return false
+	}
+	sw.seen[id] = p
+	return true
+}
+
+// visitFile records the file p. If it was reached through a symlink and has
+// already been seen, the path it was first seen at is returned. Hard links
+// which aren't reached through symlinks are hashed separately as usual.
+func (sw *symlinkWalker) visitFile(p string) string {
+	id := sw.id(p)
+	if first, ok := sw.seen[id]; ok {
+		if sw.following {
+			return first
+		}
+		return ""
+	}
+	sw.seen[id] = p
+	return ""
+}
+
+// aliasResolver fills in the hashes of results for files which were reached
+// through symlinks, and so weren't hashed again, from the result for the
+// path the file was first seen at. Since results arrive in any order, it
+// remembers every result with -follow-symlinks.
+type aliasResolver struct {
+	results map[string]hashResult
+	pending map[string][]hashResult
+}
+
+func newAliasResolver() *aliasResolver {
+	return &aliasResolver{
+		results: make(map[string]hashResult),
+		pending: make(map[string][]hashResult),
+	}
+}
+
+// resolve returns the results which are ready to be printed now that r has
+// arrived.
+func (ar *aliasResolver) resolve(r hashResult) []hashResult {
+	if r.symlinkOf != "" {
+		if target, ok := ar.results[r.symlinkOf]; ok {
+			return []hashResult{resolveAlias(r, target)}
+		}
+		ar.pending[r.symlinkOf] = append(ar.pending[r.symlinkOf], r)
+		return nil
+	}
+
+	ar.results[r.path] = hashResult{hash: r.hash, size: r.size, chunks: r.chunks, err: r.err}
+	ready := []hashResult{r}
+	for _, alias := range ar.pending[r.path] {
+		ready = append(ready, resolveAlias(alias, r))
+	}
+	delete(ar.pending, r.path)
+	return ready
+}
+
+// unresolved returns the results whose targets were never seen, which can
+// only happen if the walk was cut short.
+func (ar *aliasResolver) unresolved() []hashResult {
+	var rs []hashResult
+	for _, aliases := range ar.pending {
+		for _, alias := range aliases {
+			alias.err = errors.New("symlink target was not hashed")
+			rs = append(rs, alias)
+		}
+	}
+	return rs
+}
+
+func resolveAlias(alias, target hashResult) hashResult {
+	alias.hash, alias.size, alias.chunks, alias.err = target.hash, target.size, target.chunks, target.err
+	return alias
+}
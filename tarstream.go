@@ -0,0 +1,87 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// gzipMagic is the magic number at the start of every gzip member.
+const gzipMagic = "\x1f\x8b"
+
+// hashTarStream hashes each file in a tar stream read from the file name
+// (or standard input, for "-"), for -tar, as it's read and without writing
+// anything to disk. The stream may be compressed with gzip or zstd. Since
+// the stream can only be read in order, files are hashed one at a time,
+// here rather than by the worker pool.
+//
+// In check mode, files which are absent from the manifest are skipped, or
+// reported as extra with -strict.
+func hashTarStream(name string, hf hashFactory, results chan<- hashResult, cp *checkPrinter) {
+	var f io.Reader = os.Stdin
+	if name != "-" {
+		file, err := os.Open(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer file.Close()
+		f = file
+	}
+	fail := func(err error) {
+		results <- hashResult{path: name, err: fmt.Errorf("%s: reading tar stream: %w", name, err)}
+	}
+
+	br := bufio.NewReader(f)
+	var rd io.Reader = br
+	magic, _ := br.Peek(len(zstdMagic))
+	switch {
+	case strings.HasPrefix(string(magic), gzipMagic):
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			fail(err)
+			return
+		}
+		defer zr.Close()
+		rd = zr
+	case string(magic) == zstdMagic:
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			fail(err)
+			return
+		}
+		defer zr.Close()
+		rd = zr
+	}
+
+	buf := make([]byte, 1024*1024)
+	ar := &tarArchiveReader{tr: tar.NewReader(rd)}
+	for {
+		member, mr, err := ar.Next()
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			fail(err)
+			return
+		}
+		p := strings.TrimPrefix(member, "./")
+		if !inShard(p) {
+			continue
+		}
+		if cp != nil && cp.isExtra(p) {
+			if *flagStrict {
+				results <- hashResult{path: p, status: statusExtra}
+			}
+			continue
+		}
+		r := hashReader(hashFor(hf, p), mr, buf)
+		r.path, r.root, r.algo = p, name, algoFor(p)
+		results <- r
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"log"
+	"sort"
+)
+
+// statusDeleted is the status of a -tombstones record: a file which was in
+// the previous manifest, but wasn't found by this run.
+const statusDeleted = "DELETED"
+
+// theTombstones tracks the files in the -tombstones manifest, or is nil.
+var theTombstones *tombstones
+
+type tombstones struct {
+	previous []manifestEntry
+	seen     map[string]bool
+}
+
+// checkTombstones validates -tombstones, and reads the previous manifest.
+func checkTombstones(cmd string) {
+	if *flagTombstones == "" {
+		return
+	}
+	if *flagCheck != "" || cmd != "" || *flagDryRun {
+		log.Fatal("-tombstones cannot be used with check mode, -dry-run, or subcommands")
+	}
+	checkJSONOutput("-tombstones")
+	entries, _, err := readManifest(*flagTombstones, "auto")
+	if err != nil {
+		log.Fatalf("%s: %v", *flagTombstones, err)
+	}
+	theTombstones = &tombstones{previous: entries, seen: make(map[string]bool)}
+}
+
+// record notes that a path, as printed, was found by this run, whether or
+// not it could be read.
+func (t *tombstones) record(path string) {
+	if t != nil {
+		t.seen[path] = true
+	}
+}
+
+// print prints a deleted record, with its last known hash, for each file in
+// the previous manifest which this run didn't find, in sorted order.
+func (t *tombstones) print(hp hashPrinter) {
+	if t == nil {
+		return
+	}
+	sort.SliceStable(t.previous, func(i, j int) bool { return t.previous[i].path < t.previous[j].path })
+	deleted := 0
+	for i, e := range t.previous {
+		if t.seen[e.path] || i > 0 && e.path == t.previous[i-1].path {
+			continue
+		}
+		hp.Print(hashResult{path: e.path, hash: e.hash, algo: e.algo, status: statusDeleted})
+		deleted++
+	}
+	debugf("%d files deleted since %s", deleted, *flagTombstones)
+}
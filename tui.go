@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+)
+
+// Parameters for -tui.
+const (
+	tuiInterval  = 250 * time.Millisecond
+	tuiErrorRows = 8
+)
+
+// tuiSparks are the bars used to draw the throughput graph, from lowest to
+// highest.
+var tuiSparks = []rune("▁▂▃▄▅▆▇█")
+
+// theTUI is the full-screen display for -tui, or nil.
+var theTUI *tui
+
+// tui is a full-screen terminal display of a run's progress: the file each
+// worker is hashing, overall throughput, and recent errors. It's drawn on
+// the terminal's alternate screen on standard error, so the results
+// themselves have to go elsewhere.
+//
+// Log messages are shown in the error pane, and also written to the normal
+// screen, switching back to it until the next time the display is drawn.
+// That way, the terminal is left in a usable state, with the message shown,
+// if the message was fatal.
+type tui struct {
+	mu      sync.Mutex
+	entered bool // whether the alternate screen is showing
+	workers map[int]tuiWorker
+	files   int64
+	errors  []string
+	nErrors int
+
+	start     time.Time
+	lastBytes int64
+	lastTick  time.Time
+	rates     []float64 // bytes per second, at each tick
+	done      chan struct{}
+	stopped   chan struct{}
+}
+
+type tuiWorker struct {
+	path  string
+	start time.Time
+}
+
+// checkTUI validates -tui.
+func checkTUI() {
+	if !*flagTUI {
+		return
+	}
+	if !term.IsTerminal(int(os.Stderr.Fd())) {
+		log.Fatal("-tui requires standard error to be a terminal")
+	}
+	if term.IsTerminal(int(os.Stdout.Fd())) && len(*flagOut) == 0 && *flagStream == "" {
+		log.Fatal("-tui requires output to be redirected, or written with -out or -stream")
+	}
+	if err := enableVirtualTerminal(os.Stderr); err != nil {
+		log.Fatal("-tui: ", err)
+	}
+}
+
+// startTUI takes over the terminal, and starts drawing the display.
+func startTUI() {
+	t := &tui{
+		workers:  make(map[int]tuiWorker),
+		start:    time.Now(),
+		lastTick: time.Now(),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	theTUI = t
+	setLogOutput(tuiLog{t})
+
+	// Give the terminal back if the run is interrupted
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	go func() {
+		<-sigs
+		releaseSnapshots()
+		t.mu.Lock()
+		t.restore()
+		os.Exit(130)
+	}()
+
+	go func() {
+		defer close(t.stopped)
+		ticker := time.NewTicker(tuiInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-t.done:
+				return
+			case <-ticker.C:
+				t.draw()
+			}
+		}
+	}()
+}
+
+// stop gives the terminal back, and prints a final summary.
+func (t *tui) stop() {
+	if t == nil {
+		return
+	}
+	close(t.done)
+	<-t.stopped
+	setLogOutput(os.Stderr)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.restore()
+	fmt.Fprintf(os.Stderr, "%d files, %s in %s, %d errors\n", t.files, formatBytes(atomic.LoadInt64(&readMeter.bytes)), time.Since(t.start).Round(time.Second), t.nErrors)
+}
+
+// restore switches back to the normal screen, and shows the cursor.
+func (t *tui) restore() {
+	if t.entered {
+		os.Stderr.WriteString("\x1b[?25h\x1b[?1049l")
+		t.entered = false
+	}
+}
+
+// begin records that a worker has started hashing a file.
+func (t *tui) begin(id int, path string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.workers[id] = tuiWorker{path, time.Now()}
+	t.mu.Unlock()
+}
+
+// end records that a worker has finished its file.
+func (t *tui) end(id int) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	delete(t.workers, id)
+	t.mu.Unlock()
+}
+
+// result records a result as it's printed.
+func (t *tui) result(r hashResult) {
+	if t == nil {
+		return
+	}
+	if r.err != nil {
+		t.addError(fmt.Sprintf("%s: %v", r.path, r.err))
+		return
+	}
+	t.mu.Lock()
+	t.files++
+	t.mu.Unlock()
+}
+
+func (t *tui) addError(msg string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.addErrorLocked(msg)
+}
+
+func (t *tui) addErrorLocked(msg string) {
+	t.nErrors++
+	t.errors = append(t.errors, msg)
+	if len(t.errors) > tuiErrorRows {
+		t.errors = t.errors[len(t.errors)-tuiErrorRows:]
+	}
+}
+
+// tuiLog shows log messages in the error pane, and on the normal screen.
+type tuiLog struct {
+	t *tui
+}
+
+func (l tuiLog) Write(p []byte) (int, error) {
+	l.t.mu.Lock()
+	defer l.t.mu.Unlock()
+	l.t.restore()
+	os.Stderr.Write(p)
+	l.t.addErrorLocked(strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
+func (t *tui) draw() {
+	width, height, err := term.GetSize(int(os.Stderr.Fd()))
+	if err != nil || width < 20 || height < 10 {
+		return
+	}
+
+	now := time.Now()
+	bytesRead := atomic.LoadInt64(&readMeter.bytes)
+	rate := float64(bytesRead-t.lastBytes) / now.Sub(t.lastTick).Seconds()
+	t.lastBytes, t.lastTick = bytesRead, now
+	t.rates = append(t.rates, rate)
+	if len(t.rates) > width {
+		t.rates = t.rates[len(t.rates)-width:]
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var lines []string
+	lines = append(lines, fmt.Sprintf("hashtree  %d files  %s  %s/s  %d errors  %s",
+		t.files, formatBytes(bytesRead), formatBytes(int64(rate)), t.nErrors, now.Sub(t.start).Round(time.Second)))
+	lines = append(lines, "", "Throughput (peak "+formatBytes(int64(maxRate(t.rates)))+"/s)", sparkline(t.rates), "")
+
+	ids := make([]int, 0, len(t.workers))
+	for id := range t.workers {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	lines = append(lines, fmt.Sprintf("Workers (%d busy)", len(ids)))
+	workerRows := height - len(lines) - tuiErrorRows - 3
+	for i, id := range ids {
+		if i == workerRows-1 && len(ids) > workerRows {
+			lines = append(lines, fmt.Sprintf("  ... and %d more", len(ids)-i))
+			break
+		}
+		w := t.workers[id]
+		lines = append(lines, fmt.Sprintf("%4d %7s  %s", id, now.Sub(w.start).Round(100*time.Millisecond), w.path))
+	}
+
+	lines = append(lines, "", "Errors")
+	lines = append(lines, t.errors...)
+
+	var buf bytes.Buffer
+	if !t.entered {
+		// Switch to the alternate screen, and hide the cursor
+		buf.WriteString("\x1b[?1049h\x1b[?25l")
+		t.entered = true
+	}
+	buf.WriteString("\x1b[H")
+	for i, line := range lines {
+		if i >= height {
+			break
+		}
+		buf.WriteString(truncateLine(line, width))
+		buf.WriteString("\x1b[K\r\n")
+	}
+	buf.WriteString("\x1b[J")
+	os.Stderr.Write(buf.Bytes())
+}
+
+func maxRate(rates []float64) float64 {
+	max := 0.0
+	for _, r := range rates {
+		if r > max {
+			max = r
+		}
+	}
+	return max
+}
+
+// sparkline draws rates as a bar graph one line high, scaled to the highest.
+func sparkline(rates []float64) string {
+	max := maxRate(rates)
+	var sb strings.Builder
+	for _, r := range rates {
+		i := 0
+		if max > 0 {
+			i = int(r / max * float64(len(tuiSparks)-1))
+		}
+		sb.WriteRune(tuiSparks[i])
+	}
+	return sb.String()
+}
+
+// truncateLine shortens a line to fit in width columns, keeping the end of
+// long paths, which is usually the most interesting part.
+func truncateLine(line string, width int) string {
+	n := utf8.RuneCountInString(line)
+	if n <= width {
+		return line
+	}
+	runes := []rune(line)
+	keep := width / 3
+	return string(runes[:keep]) + "…" + string(runes[n-(width-keep-1):])
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "os"
+
+// enableVirtualTerminal does nothing, since terminals on other platforms
+// process ANSI escape sequences already.
+func enableVirtualTerminal(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io"
+	"io/fs"
+	"log"
+	"os"
+)
+
+// theRing is the io_uring which files are read through, with -io uring, or
+// nil.
+var theRing *uring
+
+// checkIO validates -io, and sets up theRing.
+func checkIO() {
+	switch *flagIO {
+	case "std":
+	case "uring":
+		r, err := newURing()
+		if err != nil {
+			log.Fatal("-io uring: ", err)
+		}
+		theRing = r
+	default:
+		log.Fatal("-io must be std or uring")
+	}
+}
+
+// fileReader returns a reader for a file which is being hashed, which reads
+// through theRing if it's in use and the file is a local one.
+func fileReader(f fs.File) io.Reader {
+	if theRing == nil {
+		return f
+	}
+	osf, ok := f.(*os.File)
+	if !ok {
+		return f
+	}
+	return &uringReader{r: theRing, f: osf}
+}
+
+// uringReader reads a file sequentially through an io_uring.
+type uringReader struct {
+	r   *uring
+	f   *os.File
+	off int64
+}
+
+func (ur *uringReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	n, err := ur.r.read(ur.f, p, ur.off)
+	if err != nil {
+		return 0, &fs.PathError{Op: "read", Path: ur.f.Name(), Err: err}
+	}
+	if n == 0 {
+		return 0, io.EOF
+	}
+	ur.off += int64(n)
+	return n, nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Parts of the io_uring ABI, from <linux/io_uring.h>.
+const (
+	uringOffSQRing = 0
+	uringOffCQRing = 0x8000000
+	uringOffSQEs   = 0x10000000
+
+	uringEnterGetEvents = 1 << 0
+
+	uringOpRead = 22
+
+	uringSQESize = 64
+	uringCQESize = 16
+)
+
+// uringEntries is the size of the submission queue, which is also the
+// maximum number of reads in flight at once.
+const uringEntries = 256
+
+type uringSQOffsets struct {
+	head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type uringCQOffsets struct {
+	head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type uringParams struct {
+	sqEntries, cqEntries, flags, sqThreadCPU, sqThreadIdle, features, wqFD uint32
+	resv                                                                   [3]uint32
+	sqOff                                                                  uringSQOffsets
+	cqOff                                                                  uringCQOffsets
+}
+
+// uring is an io_uring shared by all the workers. Reads are queued by the
+// workers, and submitted in batches by a single goroutine, so that the reads
+// from many files can be submitted with one system call. Another goroutine
+// waits for reads to complete, and hands the results back.
+type uring struct {
+	fd int
+
+	sqRing, cqRing, sqes []byte
+	sqHead, sqTail       *uint32
+	sqMask               uint32
+	sqArray              []uint32
+	cqHead, cqTail       *uint32
+	cqMask               uint32
+	cqes                 []byte
+
+	ops   chan *uringOp
+	slots chan struct{} // limits the number of reads in flight
+
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[uint64]*uringOp
+}
+
+// uringOp is a single read.
+type uringOp struct {
+	fd   int32
+	buf  []byte
+	off  int64
+	done chan int32 // receives the result: bytes read, or -errno
+}
+
+func newURing() (*uring, error) {
+	var p uringParams
+	fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, uringEntries, uintptr(unsafe.Pointer(&p)), 0)
+	if errno != 0 {
+		return nil, errno
+	}
+	r := &uring{
+		fd:      int(fd),
+		ops:     make(chan *uringOp, uringEntries),
+		slots:   make(chan struct{}, uringEntries),
+		pending: make(map[uint64]*uringOp),
+	}
+
+	var err error
+	mmap := func(off int64, size uint32) []byte {
+		if err != nil {
+			return nil
+		}
+		var b []byte
+		b, err = unix.Mmap(r.fd, off, int(size), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+		return b
+	}
+	r.sqRing = mmap(uringOffSQRing, p.sqOff.array+p.sqEntries*4)
+	r.cqRing = mmap(uringOffCQRing, p.cqOff.cqes+p.cqEntries*uringCQESize)
+	r.sqes = mmap(uringOffSQEs, p.sqEntries*uringSQESize)
+	if err != nil {
+		unix.Close(r.fd)
+		return nil, err
+	}
+
+	r.sqHead = (*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.head]))
+	r.sqTail = (*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.tail]))
+	r.sqMask = *(*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.ringMask]))
+	r.sqArray = (*[1 << 20]uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.array]))[:p.sqEntries:p.sqEntries]
+	r.cqHead = (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.head]))
+	r.cqTail = (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.tail]))
+	r.cqMask = *(*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.ringMask]))
+	r.cqes = r.cqRing[p.cqOff.cqes:]
+
+	go r.submitter()
+	go r.reaper()
+	return r, nil
+}
+
+// read reads into p from f at off, returning the number of bytes read, which
+// is 0 at the end of the file.
+func (r *uring) read(f *os.File, p []byte, off int64) (int, error) {
+	r.slots <- struct{}{}
+	defer func() { <-r.slots }()
+	op := &uringOp{fd: int32(f.Fd()), buf: p, off: off, done: make(chan int32, 1)}
+	r.ops <- op
+	res := <-op.done
+	runtime.KeepAlive(f)
+	if res < 0 {
+		return 0, syscall.Errno(-res)
+	}
+	return int(res), nil
+}
+
+// submitter submits queued reads, taking as many as are waiting at once.
+func (r *uring) submitter() {
+	for op := range r.ops {
+		n := 0
+		for op != nil {
+			r.push(op)
+			n++
+			select {
+			case op = <-r.ops:
+			default:
+				op = nil
+			}
+		}
+		for n > 0 {
+			submitted, err := r.enter(uint32(n), 0, 0)
+			if err == syscall.EINTR || err == syscall.EAGAIN {
+				continue
+			} else if err != nil {
+				r.failQueued(err.(syscall.Errno))
+				break
+			}
+			n -= submitted
+		}
+	}
+}
+
+// push adds a read to the submission queue. There's always room, since no
+// more than uringEntries reads are in flight.
+func (r *uring) push(op *uringOp) {
+	r.mu.Lock()
+	r.nextID++
+	id := r.nextID
+	r.pending[id] = op
+	r.mu.Unlock()
+
+	tail := atomic.LoadUint32(r.sqTail)
+	i := tail & r.sqMask
+	sqe := r.sqes[i*uringSQESize : (i+1)*uringSQESize]
+	for j := range sqe {
+		sqe[j] = 0
+	}
+	sqe[0] = uringOpRead
+	*(*int32)(unsafe.Pointer(&sqe[4])) = op.fd
+	*(*uint64)(unsafe.Pointer(&sqe[8])) = uint64(op.off)
+	*(*uint64)(unsafe.Pointer(&sqe[16])) = uint64(uintptr(unsafe.Pointer(&op.buf[0])))
+	*(*uint32)(unsafe.Pointer(&sqe[24])) = uint32(len(op.buf))
+	*(*uint64)(unsafe.Pointer(&sqe[32])) = id
+	r.sqArray[i] = i
+	atomic.StoreUint32(r.sqTail, tail+1)
+}
+
+// failQueued fails every read which hasn't been taken by the kernel, after
+// io_uring_enter fails.
+func (r *uring) failQueued(errno syscall.Errno) {
+	head, tail := atomic.LoadUint32(r.sqHead), atomic.LoadUint32(r.sqTail)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for ; head != tail; head++ {
+		sqe := r.sqes[(head&r.sqMask)*uringSQESize:]
+		id := *(*uint64)(unsafe.Pointer(&sqe[32]))
+		if op, ok := r.pending[id]; ok {
+			delete(r.pending, id)
+			op.done <- -int32(errno)
+		}
+	}
+	atomic.StoreUint32(r.sqTail, atomic.LoadUint32(r.sqHead))
+}
+
+// reaper waits for reads to complete, and passes on their results.
+func (r *uring) reaper() {
+	for {
+		head, tail := atomic.LoadUint32(r.cqHead), atomic.LoadUint32(r.cqTail)
+		if head == tail {
+			r.enter(0, 1, uringEnterGetEvents)
+			continue
+		}
+		r.mu.Lock()
+		for ; head != tail; head++ {
+			cqe := r.cqes[(head&r.cqMask)*uringCQESize:]
+			id := *(*uint64)(unsafe.Pointer(&cqe[0]))
+			res := *(*int32)(unsafe.Pointer(&cqe[8]))
+			if op, ok := r.pending[id]; ok {
+				delete(r.pending, id)
+				op.done <- res
+			}
+		}
+		r.mu.Unlock()
+		atomic.StoreUint32(r.cqHead, head)
+	}
+}
+
+func (r *uring) enter(toSubmit, minComplete, flags uint32) (int, error) {
+	n, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(r.fd), uintptr(toSubmit), uintptr(minComplete), uintptr(flags), 0, 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(n), nil
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// uring is only supported on Linux.
+type uring struct{}
+
+func newURing() (*uring, error) {
+	return nil, errors.New("io_uring is only supported on Linux")
+}
+
+func (r *uring) read(f *os.File, p []byte, off int64) (int, error) {
+	panic("io_uring is only supported on Linux")
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// errUnstableRead is reported, with -verify-write, for a file which hashed
+// differently when it was read back.
+var errUnstableRead = errors.New("read back differently")
+
+// verifyRead re-opens and re-hashes a file for -verify-write, and checks that
+// it matches the first result. With -drop-cache, the file is dropped from the
+// page cache first, so that it's really read from the device again.
+func verifyRead(hf hashFactory, task hashTask, buf []byte, first hashResult) error {
+	iopsLimiter.wait(1)
+	f, err := task.fs.Open(task.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if osf, ok := f.(*os.File); ok && *flagDropCache {
+		if err := dropCache(osf); err != nil {
+			return fmt.Errorf("dropping from cache: %w", err)
+		}
+	}
+
+	r, ok := hashSmallFile(hf, f, buf)
+	if !ok {
+		r = hashReader(hf, fileReader(f), buf)
+	}
+	if r.err != nil {
+		return fmt.Errorf("reading back: %w", r.err)
+	}
+	if r.size != first.size || !bytes.Equal(r.hash, first.hash) {
+		return fmt.Errorf("%w: %x (%d bytes), then %x (%d bytes)", errUnstableRead, first.hash, first.size, r.hash, r.size)
+	}
+	return nil
+}
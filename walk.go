@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+)
+
+// walkDir walks the tree at root like fs.WalkDir. With -walk-batch,
+// directories are instead read in batches of that many entries, each of
+// which is walked before the next is read, so that a directory with millions
+// of entries needn't be held in memory all at once. Entries are then visited
+// in the order the filesystem returns them, rather than sorted by name.
+func walkDir(fsys fs.FS, root string, fn fs.WalkDirFunc) error {
+	if *flagWalkBatch == 0 {
+		return fs.WalkDir(fsys, root, fn)
+	}
+	fi, err := fs.Stat(fsys, root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = walkDirBatched(fsys, root, fs.FileInfoToDirEntry(fi), fn)
+	}
+	if err == fs.SkipDir {
+		return nil
+	}
+	return err
+}
+
+// walkDirBatched walks the directory at name in batches, for walkDir.
+// Filesystems which can't list a directory in parts, such as WebDAV, are
+// listed in one go.
+func walkDirBatched(fsys fs.FS, name string, d fs.DirEntry, fn fs.WalkDirFunc) error {
+	if err := fn(name, d, nil); err != nil || !d.IsDir() {
+		if err == fs.SkipDir && d.IsDir() {
+			err = nil
+		}
+		return err
+	}
+
+	f, err := fsys.Open(name)
+	if err != nil {
+		return skipDirErr(fn(name, d, err))
+	}
+	defer f.Close()
+	dir, ok := f.(fs.ReadDirFile)
+	if !ok {
+		entries, err := fs.ReadDir(fsys, name)
+		for _, e := range entries {
+			if err := walkDirBatched(fsys, path.Join(name, e.Name()), e, fn); err != nil {
+				return skipDirErr(err)
+			}
+		}
+		if err != nil {
+			return skipDirErr(fn(name, d, err))
+		}
+		return nil
+	}
+
+	for {
+		entries, err := dir.ReadDir(*flagWalkBatch)
+		for _, e := range entries {
+			if err := walkDirBatched(fsys, path.Join(name, e.Name()), e, fn); err != nil {
+				return skipDirErr(err)
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return skipDirErr(fn(name, d, err))
+		}
+	}
+}
+
+// skipDirErr turns fs.SkipDir, which skips the rest of the directory being
+// read, into nil.
+func skipDirErr(err error) error {
+	if err == fs.SkipDir {
+		return nil
+	}
+	return err
+}
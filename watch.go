@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"strings"
+	"time"
+)
+
+// alert is a change in a file's verification status, as reported by watch,
+// or a decision about a file by gate.
+type alert struct {
+	Time   time.Time `json:"time"`
+	Path   string    `json:"path"`
+	Status string    `json:"status"`
+	Error  string    `json:"error,omitempty"`
+
+	// Hash and MovedTo are only used by gate.
+	Hash    string `json:"hash,omitempty"`
+	MovedTo string `json:"moved_to,omitempty"`
+}
+
+// printAlert writes an alert as a line of text, or a JSON object.
+func printAlert(w io.Writer, asJSON bool, a alert) {
+	if asJSON {
+		json.NewEncoder(w).Encode(a)
+		return
+	}
+	line := fmt.Sprintf("%s %s: %s", a.Time.Format(time.RFC3339), a.Path, a.Status)
+	if a.Error != "" {
+		line += " (" + a.Error + ")"
+	}
+	if a.MovedTo != "" {
+		line += " -> " + a.MovedTo
+	}
+	fmt.Fprintln(w, line)
+}
+
+// watchPrinter compares hashes against a baseline manifest, and reports an
+// alert whenever a file's status differs from the last time it was checked.
+// Files are assumed to be OK before they're first checked, so a file which
+// stays OK never produces any output.
+type watchPrinter struct {
+	w        io.Writer
+	json     bool
+	expected map[string][]byte
+	last     map[string]string
+}
+
+func newWatchPrinter(entries []manifestEntry, w io.Writer) *watchPrinter {
+	wp := &watchPrinter{
+		w:        w,
+		json:     strings.HasPrefix(*flagFmt, "json"),
+		expected: make(map[string][]byte, len(entries)),
+		last:     make(map[string]string),
+	}
+	for _, e := range entries {
+		wp.expected[e.path] = e.hash
+	}
+	return wp
+}
+
+func (wp *watchPrinter) Print(r hashResult) {
+	status := statusOK
+	if string(wp.expected[r.path]) != string(r.hash) {
+		status = statusFailed
+	}
+	wp.update(alert{Path: r.path, Status: status})
+}
+
+func (wp *watchPrinter) PrintError(r hashResult) {
+	if errors.Is(r.err, fs.ErrNotExist) {
+		wp.update(alert{Path: r.path, Status: statusMissing})
+	} else {
+		wp.update(alert{Path: r.path, Status: statusFailed, Error: r.err.Error()})
+	}
+}
+
+func (wp *watchPrinter) update(a alert) {
+	last, ok := wp.last[a.Path]
+	if !ok {
+		last = statusOK
+	}
+	wp.last[a.Path] = a.Status
+	if a.Status == last {
+		return
+	}
+
+	a.Time = time.Now().UTC()
+	if a.Status != statusOK {
+		notifyMismatch(a)
+	}
+	printAlert(wp.w, wp.json, a)
+}
+
+// feedWatch queues the files in the manifest for hashing forever, paced so
+// that each pass over the manifest takes -cycle.
+func feedWatch(rootPath string, entries []manifestEntry, tasks chan<- hashTask) {
+	if len(entries) == 0 {
+		log.Fatal("nothing to watch: manifest is empty")
+	}
+	root := resolveRoot(rootPath)
+	dir := openRoot(root)
+
+	var tick <-chan time.Time
+	if interval := *flagCycle / time.Duration(len(entries)); interval > 0 {
+		tick = time.NewTicker(interval).C
+	}
+	for {
+		for _, e := range entries {
+			if tick != nil {
+				<-tick
+			}
+			tasks <- hashTask{root: root, path: e.path, fs: dir}
+		}
+	}
+}
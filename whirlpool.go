@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+// Whirlpool, as specified in ISO/IEC 10118-3:2004. There's no Whirlpool
+// implementation in the standard library or golang.org/x/crypto, so this is
+// a straightforward table-driven implementation of the final (2003) version
+// of the algorithm.
+
+const (
+	whirlpoolSize      = 64
+	whirlpoolBlockSize = 64
+	whirlpoolRounds    = 10
+)
+
+var (
+	whirlpoolC  [8][256]uint64
+	whirlpoolRC [whirlpoolRounds + 1]uint64
+)
+
+func init() {
+	// The S-box is built from three 4-bit mini-boxes.
+	e := [16]byte{0x1, 0xB, 0x9, 0xC, 0xD, 0x6, 0xF, 0x3, 0xE, 0x8, 0x7, 0x4, 0xA, 0x2, 0x5, 0x0}
+	r := [16]byte{0x7, 0xC, 0xB, 0xD, 0xE, 0x4, 0x9, 0xF, 0x6, 0x3, 0x8, 0xA, 0x2, 0x5, 0x1, 0x0}
+	var einv [16]byte
+	for i, v := range e {
+		einv[v] = byte(i)
+	}
+	var sbox [256]byte
+	for u := range sbox {
+		a, b := e[u>>4], einv[u&0xF]
+		t := r[a^b]
+		sbox[u] = e[a^t]<<4 | einv[b^t]
+	}
+
+	// Multiplication in GF(2^8) with the reduction polynomial
+	// x^8 + x^4 + x^3 + x^2 + 1.
+	mul := func(a, b byte) byte {
+		var p byte
+		for ; b != 0; b >>= 1 {
+			if b&1 != 0 {
+				p ^= a
+			}
+			hi := a & 0x80
+			a <<= 1
+			if hi != 0 {
+				a ^= 0x1D
+			}
+		}
+		return p
+	}
+
+	// Each table combines the S-box with one row of the circulant diffusion
+	// matrix cir(1, 1, 4, 1, 8, 5, 2, 9).
+	coeffs := [8]byte{1, 1, 4, 1, 8, 5, 2, 9}
+	for x := 0; x < 256; x++ {
+		var v uint64
+		for _, c := range coeffs {
+			v = v<<8 | uint64(mul(sbox[x], c))
+		}
+		for t := range whirlpoolC {
+			whirlpoolC[t][x] = bits.RotateLeft64(v, -8*t)
+		}
+	}
+
+	for i := 1; i <= whirlpoolRounds; i++ {
+		whirlpoolRC[i] = binary.BigEndian.Uint64(sbox[8*(i-1):])
+	}
+}
+
+type whirlpoolDigest struct {
+	h   [8]uint64
+	buf [whirlpoolBlockSize]byte
+	nx  int
+	len uint64 // bytes written
+}
+
+func newWhirlpool() hash.Hash {
+	return new(whirlpoolDigest)
+}
+
+func (d *whirlpoolDigest) Size() int      { return whirlpoolSize }
+func (d *whirlpoolDigest) BlockSize() int { return whirlpoolBlockSize }
+
+func (d *whirlpoolDigest) Reset() {
+	*d = whirlpoolDigest{}
+}
+
+func (d *whirlpoolDigest) Write(p []byte) (int, error) {
+	n := len(p)
+	d.len += uint64(n)
+	if d.nx > 0 {
+		k := copy(d.buf[d.nx:], p)
+		d.nx += k
+		p = p[k:]
+		if d.nx < whirlpoolBlockSize {
+			return n, nil
+		}
+		d.block(d.buf[:])
+		d.nx = 0
+	}
+	for len(p) >= whirlpoolBlockSize {
+		d.block(p[:whirlpoolBlockSize])
+		p = p[whirlpoolBlockSize:]
+	}
+	d.nx = copy(d.buf[:], p)
+	return n, nil
+}
+
+func (d *whirlpoolDigest) Sum(in []byte) []byte {
+	// Work on a copy so that the caller can keep writing.
+	d0 := *d
+
+	// Pad with a 1 bit and zeroes to 32 bytes short of a block boundary,
+	// then append the message length in bits as a 256-bit integer. Lengths
+	// over 2^64 bits aren't supported, so the top 24 bytes are always zero.
+	var pad [2 * whirlpoolBlockSize]byte
+	pad[0] = 0x80
+	n := whirlpoolBlockSize - 32 - d0.nx
+	if n <= 0 {
+		n += whirlpoolBlockSize
+	}
+	bitLen := d0.len << 3
+	d0.Write(pad[:n+24])
+	binary.BigEndian.PutUint64(pad[:8], bitLen)
+	d0.Write(pad[:8])
+
+	var out [whirlpoolSize]byte
+	for i, v := range d0.h {
+		binary.BigEndian.PutUint64(out[8*i:], v)
+	}
+	return append(in, out[:]...)
+}
+
+// whirlpoolRound computes one application of the round function to state, with the
+// given round key.
+func whirlpoolRound(state, key *[8]uint64) {
+	var out [8]uint64
+	for i := range out {
+		v := key[i]
+		for t := 0; t < 8; t++ {
+			v ^= whirlpoolC[t][byte(state[(i-t)&7]>>(56-8*t))]
+		}
+		out[i] = v
+	}
+	*state = out
+}
+
+func (d *whirlpoolDigest) block(p []byte) {
+	var m, k, state [8]uint64
+	for i := range m {
+		m[i] = binary.BigEndian.Uint64(p[8*i:])
+		k[i] = d.h[i]
+		state[i] = m[i] ^ k[i]
+	}
+
+	for r := 1; r <= whirlpoolRounds; r++ {
+		rc := [8]uint64{whirlpoolRC[r]}
+		whirlpoolRound(&k, &rc)
+		whirlpoolRound(&state, &k)
+	}
+
+	// Miyaguchi-Preneel
+	for i := range d.h {
+		d.h[i] ^= state[i] ^ m[i]
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// xattrName returns the extended attribute used to store digests made with
+// the given hash function.
+func xattrName(hashName string) string {
+	return "user.hashtree." + hashName
+}
+
+// encodeXattr formats a digest and the file's modification time (in Unix
+// nanoseconds) for storage in an extended attribute.
+func encodeXattr(digest []byte, mtime int64) []byte {
+	return []byte(fmt.Sprintf("%s %d", hex.EncodeToString(digest), mtime))
+}
+
+func decodeXattr(value []byte) (digest []byte, mtime int64, err error) {
+	fields := strings.Fields(string(value))
+	if len(fields) != 2 {
+		return nil, 0, errors.New("malformed hashtree xattr")
+	}
+	if digest, err = hex.DecodeString(fields[0]); err != nil {
+		return nil, 0, err
+	}
+	if mtime, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+		return nil, 0, err
+	}
+	return digest, mtime, nil
+}
+
+// applyXattr stores or verifies a freshly computed hash in the file's
+// extended attributes, according to the -xattr mode. fi is the result of
+// statting the file before it was hashed.
+func applyXattr(task hashTask, fi fs.FileInfo, r *hashResult) {
+	name := xattrName(*flagHash)
+	path := task.osPath()
+	mtime := fi.ModTime().UnixNano()
+
+	switch *flagXattr {
+	case "write":
+		r.err = setXattr(path, name, encodeXattr(r.hash, mtime))
+
+	case "verify":
+		value, err := getXattr(path, name)
+		if errors.Is(err, errNoXattr) {
+			r.status = statusMissing
+			return
+		} else if err != nil {
+			r.err = err
+			return
+		}
+		digest, storedMtime, err := decodeXattr(value)
+		if err != nil {
+			r.err = fmt.Errorf("%s: %w", path, err)
+			return
+		}
+		switch {
+		case string(digest) == string(r.hash):
+			r.status = statusOK
+		case storedMtime == mtime:
+			// Contents changed without the mtime changing: this is what
+			// silent corruption or tampering looks like.
+			r.status = statusFailed
+		default:
+			r.status = statusModified
+		}
+	}
+}
+
+// xattrVerifyPrinter prints the outcome of -xattr verify for each file in the
+// style of "sha256sum -c", and fails the run if any file didn't verify.
+type xattrVerifyPrinter struct {
+	failures int
+}
+
+func (hp *xattrVerifyPrinter) Print(r hashResult) {
+	fmt.Printf("%s: %s\n", r.path, r.status)
+	if r.status != statusOK {
+		hp.failures++
+	}
+}
+
+func (hp *xattrVerifyPrinter) Close() error {
+	if hp.failures > 0 {
+		return fmt.Errorf("%d files did not verify", hp.failures)
+	}
+	return nil
+}
+
+func checkXattrMode() {
+	switch *flagXattr {
+	case "", "write", "verify":
+	default:
+		log.Fatal("-xattr must be write or verify")
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+import (
+	"errors"
+	"io/fs"
+)
+
+var (
+	errNoXattr    = errors.New("no such attribute")
+	errXattrUnsup = errors.New("extended attributes are not supported on this platform")
+)
+
+func getXattr(path, name string) ([]byte, error) {
+	return nil, &fs.PathError{Op: "getxattr", Path: path, Err: errXattrUnsup}
+}
+
+func setXattr(path, name string, value []byte) error {
+	return &fs.PathError{Op: "setxattr", Path: path, Err: errXattrUnsup}
+}